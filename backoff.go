@@ -0,0 +1,58 @@
+package gq
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff delay before a failed message is delivered again
+type Backoff interface {
+	// Delay for a message that has been delivered attempts times
+	Delay(attempts int) time.Duration
+}
+
+// FixedBackoff same delay for every retry
+type FixedBackoff time.Duration
+
+// Delay ... implements Backoff
+func (f FixedBackoff) Delay(attempts int) time.Duration {
+	return time.Duration(f)
+}
+
+// ExponentialBackoff delay that grows by Multiplier for every attempt up to Max
+type ExponentialBackoff struct {
+	// Delay after the first attempt
+	Initial time.Duration
+	// Upper bound on the delay, 0 means no bound
+	Max time.Duration
+	// Growth per attempt, defaults to 2 when not set
+	Multiplier float64
+	// Randomize the delay between half and all of the computed delay
+	Jitter bool
+}
+
+// Delay ... implements Backoff
+func (e ExponentialBackoff) Delay(attempts int) time.Duration {
+	multiplier := e.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	if attempts < 1 {
+		attempts = 1
+	}
+	d := float64(e.Initial) * math.Pow(multiplier, float64(attempts-1))
+	if e.Max > 0 && d > float64(e.Max) {
+		d = float64(e.Max)
+	}
+	// Overflow protection when there is no maximum
+	if d > math.MaxInt64 {
+		d = math.MaxInt64
+	}
+	delay := time.Duration(d)
+	if e.Jitter && delay > 1 {
+		half := delay / 2
+		delay = half + time.Duration(rand.Int63n(int64(delay-half)))
+	}
+	return delay
+}
@@ -0,0 +1,35 @@
+package gq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFixedBackoff(t *testing.T) {
+	b := FixedBackoff(5 * time.Second)
+	for attempts := 1; attempts < 5; attempts++ {
+		if d := b.Delay(attempts); d != 5*time.Second {
+			t.Errorf("Expected fixed delay of 5s for attempt %d however was %s", attempts, d)
+		}
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff{Initial: time.Second, Max: 10 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second}
+	for i, e := range expected {
+		if d := b.Delay(i + 1); d != e {
+			t.Errorf("Expected delay %s for attempt %d however was %s", e, i+1, d)
+		}
+	}
+}
+
+func TestExponentialBackoffJitter(t *testing.T) {
+	b := ExponentialBackoff{Initial: time.Second, Jitter: true}
+	for i := 0; i < 100; i++ {
+		d := b.Delay(3)
+		if d < 2*time.Second || d > 4*time.Second {
+			t.Fatalf("Expected jittered delay between 2s and 4s however was %s", d)
+		}
+	}
+}
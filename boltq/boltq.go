@@ -0,0 +1,564 @@
+package boltq
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/lateefj/gq"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ErrNotCreated returned when the queue buckets do not exist, call Create first
+var ErrNotCreated = errors.New("boltq: queue has not been created")
+
+// Where a message is, the first byte of its index entry
+const (
+	inReady    byte = 'r'
+	inDelayed  byte = 'd'
+	inInFlight byte = 'i'
+	// Waiting in the ordering bucket behind an older message with the same key
+	inBlocked byte = 'b'
+)
+
+// Boltq Structure for a queue in a bbolt database, pure Go so no cgo is needed. Ready
+// messages are kept in a bucket ordered by priority then sequence, checked out messages
+// in a bucket ordered by when their checkout expires so redelivery only looks at the
+// start of it, and delayed messages in a bucket ordered by when they become visible.
+// Only the oldest message of an ordering key is in those buckets, the rest wait in the
+// ordering bucket and the next is moved to ready when the oldest is committed.
+// Several queues can share a database with different prefixes.
+type Boltq struct {
+	DB     *bolt.DB
+	Prefix string
+	TTL    time.Duration
+	// Delay before a failed message is delivered again, nil means right away
+	Backoff gq.Backoff
+	exit    bool
+	mutex   sync.RWMutex
+}
+
+// NewBoltq ... Queue in the database with bucket names starting with the prefix
+func NewBoltq(db *bolt.DB, prefix string) *Boltq {
+	return &Boltq{DB: db, Prefix: prefix}
+}
+
+// buckets ... Messages that can be checked out, delayed, checked out, id to location
+// and ordering key heads
+func (b *Boltq) buckets() [][]byte {
+	return [][]byte{b.name("ready"), b.name("delayed"), b.name("inflight"), b.name("index"), b.name("ordering")}
+}
+
+func (b *Boltq) name(bucket string) []byte {
+	return []byte(b.Prefix + bucket)
+}
+
+// itob ... Big endian so keys sort numerically
+func itob(v uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, v)
+	return k
+}
+
+// readyKey ... Highest priority first then by sequence
+func readyKey(r *record) []byte {
+	// Flipping the sign bit orders signed priorities as unsigned, inverting makes it descending
+	return append(itob(^(uint64(int64(r.Priority)) ^ (1 << 63))), itob(uint64(r.Id))...)
+}
+
+// timeKey ... Ordered by the time then sequence
+func timeKey(t time.Time, id int64) []byte {
+	n := t.UnixNano()
+	if n < 0 {
+		n = 0
+	}
+	return append(itob(uint64(n)), itob(uint64(id))...)
+}
+
+// keyTime ... Time at the start of a timeKey
+func keyTime(k []byte) int64 {
+	return int64(binary.BigEndian.Uint64(k))
+}
+
+// orderingEntry ... Messages with the same ordering key sort together by sequence
+func orderingEntry(key string, id int64) []byte {
+	return append(orderingPrefix(key), itob(uint64(id))...)
+}
+
+// orderingPrefix ... Start of the ordering entries for the key
+func orderingPrefix(key string) []byte {
+	return append([]byte(key), 0)
+}
+
+// deadline ... When a checkout expires, the later of the TTL and any lease. Without a
+// TTL a checkout never expires.
+func (b *Boltq) deadline(r *record) time.Time {
+	ttl := r.TTL
+	if ttl <= 0 {
+		ttl = b.TTL
+	}
+	if ttl <= 0 {
+		return time.Unix(0, math.MaxInt64)
+	}
+	d := r.Checkout.Add(ttl)
+	if r.LeaseUntil.After(d) {
+		return r.LeaseUntil
+	}
+	return d
+}
+
+// tx ... Buckets of the queue within a transaction
+type tx struct {
+	b                                          *Boltq
+	ready, delayed, inflight, index, orderings *bolt.Bucket
+}
+
+func (b *Boltq) tx(t *bolt.Tx) (*tx, error) {
+	bs := make([]*bolt.Bucket, 0, 5)
+	for _, name := range b.buckets() {
+		bucket := t.Bucket(name)
+		if bucket == nil {
+			return nil, ErrNotCreated
+		}
+		bs = append(bs, bucket)
+	}
+	return &tx{b: b, ready: bs[0], delayed: bs[1], inflight: bs[2], index: bs[3], orderings: bs[4]}, nil
+}
+
+// put ... Stores the record in the bucket for its location and points the index at it
+func (t *tx) put(r *record, location byte, now time.Time) error {
+	var bucket *bolt.Bucket
+	var key []byte
+	switch {
+	case location == inBlocked:
+		bucket, key = t.orderings, orderingEntry(r.OrderingKey, r.Id)
+	case location == inInFlight:
+		bucket, key = t.inflight, timeKey(t.b.deadline(r), r.Id)
+	case r.VisibleAt.After(now):
+		location, bucket, key = inDelayed, t.delayed, timeKey(r.VisibleAt, r.Id)
+	default:
+		location, bucket, key = inReady, t.ready, readyKey(r)
+	}
+	if err := bucket.Put(key, encodeRecord(r)); err != nil {
+		return err
+	}
+	return t.index.Put(itob(uint64(r.Id)), append([]byte{location}, key...))
+}
+
+// get ... Record for the id and its location, nil when it is not in the queue
+func (t *tx) get(id int64) (*record, byte, error) {
+	loc := t.index.Get(itob(uint64(id)))
+	if loc == nil {
+		return nil, 0, nil
+	}
+	r, err := decodeRecord(t.bucket(loc[0]).Get(loc[1:]))
+	return r, loc[0], err
+}
+
+// remove ... Deletes the record from its location, the index is left to the caller
+func (t *tx) remove(id int64) error {
+	loc := t.index.Get(itob(uint64(id)))
+	if loc == nil {
+		return nil
+	}
+	return t.bucket(loc[0]).Delete(loc[1:])
+}
+
+func (t *tx) bucket(location byte) *bolt.Bucket {
+	switch location {
+	case inDelayed:
+		return t.delayed
+	case inInFlight:
+		return t.inflight
+	case inBlocked:
+		return t.orderings
+	}
+	return t.ready
+}
+
+// due ... Moves the records at the start of a time keyed bucket that are before now back
+// to ready, used for delayed messages that are visible and checkouts that expired
+func (t *tx) due(bucket *bolt.Bucket, now time.Time) error {
+	records := make([]*record, 0)
+	keys := make([][]byte, 0)
+	c := bucket.Cursor()
+	for k, v := c.First(); k != nil && keyTime(k) < now.UnixNano(); k, v = c.Next() {
+		r, err := decodeRecord(v)
+		if err != nil {
+			return err
+		}
+		records = append(records, r)
+		// Cursor keys are only valid until the bucket is changed
+		keys = append(keys, append([]byte(nil), k...))
+	}
+	for i, r := range records {
+		if err := bucket.Delete(keys[i]); err != nil {
+			return err
+		}
+		r.Checkout = time.Time{}
+		r.LeaseUntil = time.Time{}
+		if err := t.put(r, inReady, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// order ... Adds a new message to its ordering key, returns true when an older
+// message with the key is still in the queue so the new one has to wait
+func (t *tx) order(r *record) (bool, error) {
+	prefix := orderingPrefix(r.OrderingKey)
+	k, _ := t.orderings.Cursor().Seek(prefix)
+	if k != nil && bytes.HasPrefix(k, prefix) {
+		return true, nil
+	}
+	return false, t.orderings.Put(orderingEntry(r.OrderingKey, r.Id), nil)
+}
+
+// promote ... Once the head of an ordering key is committed the next message with
+// the key, if it is waiting, becomes the head and is made ready
+func (t *tx) promote(key string, now time.Time) error {
+	prefix := orderingPrefix(key)
+	k, v := t.orderings.Cursor().Seek(prefix)
+	// Heads have no value, their record is in ready, delayed or in flight
+	if k == nil || !bytes.HasPrefix(k, prefix) || len(v) == 0 {
+		return nil
+	}
+	r, err := decodeRecord(v)
+	if err != nil {
+		return err
+	}
+	if err = t.orderings.Put(append([]byte(nil), k...), nil); err != nil {
+		return err
+	}
+	return t.put(r, inReady, now)
+}
+
+// Create ... builds the buckets
+func (b *Boltq) Create() error {
+	return b.CreateContext(context.Background())
+}
+
+// CreateContext ... builds the buckets
+func (b *Boltq) CreateContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.DB.Update(func(t *bolt.Tx) error {
+		for _, name := range b.buckets() {
+			if _, err := t.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Destroy ... removes the buckets
+func (b *Boltq) Destroy() error {
+	return b.DestroyContext(context.Background())
+}
+
+// DestroyContext ... removes the buckets
+func (b *Boltq) DestroyContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.DB.Update(func(t *bolt.Tx) error {
+		for _, name := range b.buckets() {
+			if t.Bucket(name) == nil {
+				continue
+			}
+			if err := t.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// StopConsumer ... Stop consuming messages
+func (b *Boltq) StopConsumer() {
+	b.mutex.Lock()
+	b.exit = true
+	b.mutex.Unlock()
+}
+
+// Exit ...
+func (b *Boltq) Exit() bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.exit
+}
+
+// Publish ... Adds the messages to the queue
+func (b *Boltq) Publish(messages []*gq.Message) error {
+	return b.PublishContext(context.Background(), messages)
+}
+
+// PublishContext ... Adds the messages to the queue, idempotency keys are not checked
+func (b *Boltq) PublishContext(ctx context.Context, messages []*gq.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.DB.Update(func(bt *bolt.Tx) error {
+		t, err := b.tx(bt)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		for _, m := range messages {
+			id, err := t.index.NextSequence()
+			if err != nil {
+				return err
+			}
+			r := &record{Id: int64(id), Timestamp: now, VisibleAt: now, TTL: m.TTL, OrderingKey: m.OrderingKey,
+				Priority: m.Priority, Headers: m.Headers, Payload: m.Payload}
+			if !m.NotBefore.IsZero() {
+				r.VisibleAt = m.NotBefore
+			}
+			location := inReady
+			if r.OrderingKey != "" {
+				blocked, err := t.order(r)
+				if err != nil {
+					return err
+				}
+				if blocked {
+					location = inBlocked
+				}
+			}
+			if err = t.put(r, location, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Commit ... Removes messages that succeeded and releases those that failed
+func (b *Boltq) Commit(recipts []*gq.Receipt) error {
+	return b.CommitContext(context.Background(), recipts)
+}
+
+// CommitContext ... Removes messages that succeeded, failed messages record the error
+// and are released for retry after the backoff
+func (b *Boltq) CommitContext(ctx context.Context, recipts []*gq.Receipt) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(recipts) == 0 {
+		return nil
+	}
+	return b.DB.Update(func(bt *bolt.Tx) error {
+		t, err := b.tx(bt)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		for _, receipt := range recipts {
+			r, location, err := t.get(receipt.Id)
+			if err != nil {
+				return err
+			}
+			// Already removed or released by an earlier receipt, waiting messages were
+			// never delivered
+			if r == nil || location == inBlocked || (!receipt.Success && location != inInFlight) {
+				continue
+			}
+			if err = t.remove(r.Id); err != nil {
+				return err
+			}
+			if receipt.Success {
+				if err = t.index.Delete(itob(uint64(r.Id))); err != nil {
+					return err
+				}
+				if r.OrderingKey != "" {
+					if err = t.orderings.Delete(orderingEntry(r.OrderingKey, r.Id)); err != nil {
+						return err
+					}
+					if err = t.promote(r.OrderingKey, now); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			r.LastError = receipt.Error
+			r.Checkout = time.Time{}
+			r.LeaseUntil = time.Time{}
+			r.VisibleAt = now
+			if b.Backoff != nil {
+				r.VisibleAt = now.Add(b.Backoff.Delay(r.Attempts))
+			}
+			if err = t.put(r, inReady, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Extend ... Extends the lease on checked out messages so they are not delivered again
+// until lease from now even if the TTL passes, see gq.Heartbeat
+func (b *Boltq) Extend(ctx context.Context, ms []*gq.ConsumerMessage, lease time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.DB.Update(func(bt *bolt.Tx) error {
+		t, err := b.tx(bt)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		for _, m := range ms {
+			r, location, err := t.get(m.Id)
+			if err != nil {
+				return err
+			}
+			if r == nil || location != inInFlight || !r.Checkout.Equal(m.Checkout) {
+				continue
+			}
+			if err = t.remove(m.Id); err != nil {
+				return err
+			}
+			r.LeaseUntil = now.Add(lease)
+			if err = t.put(r, inInFlight, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ConsumeBatch ... This consumes a number of messages up to the limit
+func (b *Boltq) ConsumeBatch(size int) ([]*gq.ConsumerMessage, error) {
+	return b.ConsumeBatchContext(context.Background(), size)
+}
+
+// ConsumeBatchContext ... Checks out up to size messages, highest priority first then
+// oldest first, only the oldest message of an ordering key is delivered at a time.
+// Expired checkouts and delayed messages that are now visible go back to ready first.
+func (b *Boltq) ConsumeBatchContext(ctx context.Context, size int) ([]*gq.ConsumerMessage, error) {
+	ms := make([]*gq.ConsumerMessage, 0)
+	if err := ctx.Err(); err != nil {
+		return ms, err
+	}
+	err := b.DB.Update(func(bt *bolt.Tx) error {
+		t, err := b.tx(bt)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		if err = t.due(t.inflight, now); err != nil {
+			return err
+		}
+		if err = t.due(t.delayed, now); err != nil {
+			return err
+		}
+		records := make([]*record, 0, size)
+		keys := make([][]byte, 0, size)
+		c := t.ready.Cursor()
+		for k, v := c.First(); k != nil && len(records) < size; k, v = c.Next() {
+			r, err := decodeRecord(v)
+			if err != nil {
+				return err
+			}
+			records = append(records, r)
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for i, r := range records {
+			if err = t.ready.Delete(keys[i]); err != nil {
+				return err
+			}
+			r.Checkout = now
+			r.LeaseUntil = time.Time{}
+			r.Attempts++
+			if err = t.put(r, inInFlight, now); err != nil {
+				return err
+			}
+			m := &gq.ConsumerMessage{Id: r.Id}
+			m.Payload = r.Payload
+			m.Headers = r.Headers
+			m.TTL = r.TTL
+			m.OrderingKey = r.OrderingKey
+			m.Priority = r.Priority
+			m.Timestamp = r.Timestamp
+			m.Checkout = r.Checkout
+			m.Attempts = r.Attempts
+			ms = append(ms, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return make([]*gq.ConsumerMessage, 0), err
+	}
+	return ms, nil
+}
+
+// unlock ... Returns checked out messages that were never handed to a consumer to the
+// queue straight away, the delivery does not count as an attempt
+func (b *Boltq) unlock(ms []*gq.ConsumerMessage) error {
+	return b.DB.Update(func(bt *bolt.Tx) error {
+		t, err := b.tx(bt)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		for _, m := range ms {
+			r, location, err := t.get(m.Id)
+			if err != nil {
+				return err
+			}
+			if r == nil || location != inInFlight || !r.Checkout.Equal(m.Checkout) {
+				continue
+			}
+			if err = t.remove(r.Id); err != nil {
+				return err
+			}
+			r.Checkout = time.Time{}
+			r.LeaseUntil = time.Time{}
+			r.Attempts--
+			if err = t.put(r, inReady, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Stream ... Creates a stream of consumption
+func (b *Boltq) Stream(size int, messages chan []*gq.ConsumerMessage, pause time.Duration) {
+	b.StreamContext(context.Background(), size, messages, pause)
+}
+
+// StreamContext ... Creates a stream of consumption that ends when the context is done
+// or StopConsumer is called
+func (b *Boltq) StreamContext(ctx context.Context, size int, messages chan []*gq.ConsumerMessage, pause time.Duration) {
+	defer close(messages)
+	for {
+		// Consume until there are no more messages or there is an error
+		for {
+			if b.Exit() || ctx.Err() != nil {
+				return
+			}
+			ms, err := b.ConsumeBatchContext(ctx, size)
+			if len(ms) == 0 || err != nil {
+				break
+			}
+			select {
+			case messages <- ms:
+			case <-ctx.Done():
+				b.unlock(ms)
+				return
+			}
+		}
+		select {
+		case <-time.After(pause):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package boltq
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lateefj/gq"
+	"github.com/lateefj/gq/gqtest"
+	bolt "go.etcd.io/bbolt"
+)
+
+var db *bolt.DB
+
+const testPath = "/tmp/gq_boltq_test.db"
+
+func init() {
+	var err error
+	os.Remove(testPath)
+	db, err = bolt.Open(testPath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+var _ gq.ContextMQ = (*Boltq)(nil)
+var _ gq.Extender = (*Boltq)(nil)
+
+func setup(t *testing.T) *Boltq {
+	mq := NewBoltq(db, "test_")
+	if err := mq.Create(); err != nil {
+		t.Fatalf("Could not create buckets %s", err)
+	}
+	return mq
+}
+
+func cleanup(mq *Boltq) {
+	mq.Destroy()
+}
+
+func publish(t *testing.T, mq *Boltq, messages ...*gq.Message) {
+	if err := mq.Publish(messages); err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	queues := 0
+	gqtest.RunConformance(t, func(t *testing.T, cfg gqtest.Config) gq.MQ {
+		// Dead letters, deduplication and aging are not supported
+		if cfg.MaxAttempts > 0 || cfg.DedupWindow > 0 || cfg.Aging > 0 {
+			return nil
+		}
+		queues++
+		mq := NewBoltq(db, fmt.Sprintf("conformance%d_", queues))
+		mq.TTL = cfg.TTL
+		mq.Backoff = cfg.Backoff
+		return mq
+	})
+}
+
+func TestNotCreated(t *testing.T) {
+	mq := NewBoltq(db, "missing_")
+	if _, err := mq.ConsumeBatch(1); err != ErrNotCreated {
+		t.Errorf("Expected not created error got %v", err)
+	}
+}
+
+// Test delayed messages and failed messages wait in the delayed bucket until visible
+func TestDelayedDelivery(t *testing.T) {
+	mq := setup(t)
+	defer cleanup(mq)
+	mq.Backoff = gq.FixedBackoff(50 * time.Millisecond)
+	publish(t, mq, &gq.Message{Payload: []byte("later"), NotBefore: time.Now().Add(100 * time.Millisecond)}, &gq.Message{Payload: []byte("now")})
+	ms, err := mq.ConsumeBatch(10)
+	if err != nil || len(ms) != 1 || string(ms[0].Payload) != "now" {
+		t.Fatalf("Expected only the visible message got %+v error %v", ms, err)
+	}
+	if err = mq.Commit([]*gq.Receipt{&gq.Receipt{Id: ms[0].Id, Success: false, Error: "failed"}}); err != nil {
+		t.Fatalf("Failed to commit %s", err)
+	}
+	if ms, _ = mq.ConsumeBatch(10); len(ms) != 0 {
+		t.Fatalf("Expected the failed message to wait for the backoff got %d", len(ms))
+	}
+	time.Sleep(150 * time.Millisecond)
+	ms, _ = mq.ConsumeBatch(10)
+	if len(ms) != 2 || string(ms[0].Payload) != "later" || ms[1].Attempts != 2 {
+		t.Errorf("Expected both messages in id order once visible got %+v", ms)
+	}
+}
+
+func TestExtendLease(t *testing.T) {
+	mq := setup(t)
+	defer cleanup(mq)
+	mq.TTL = 50 * time.Millisecond
+	ctx := context.Background()
+	publish(t, mq, &gq.Message{Payload: []byte("long")})
+	ms, _ := mq.ConsumeBatch(1)
+	if len(ms) != 1 {
+		t.Fatalf("Expected 1 message got %d", len(ms))
+	}
+	if err := mq.Extend(ctx, ms, 200*time.Millisecond); err != nil {
+		t.Fatalf("Failed to extend %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if again, _ := mq.ConsumeBatch(1); len(again) != 0 {
+		t.Fatalf("Expected the leased message to be held past the TTL got %d", len(again))
+	}
+	time.Sleep(150 * time.Millisecond)
+	if again, _ := mq.ConsumeBatch(1); len(again) != 1 || again[0].Attempts != 2 {
+		t.Errorf("Expected the message once the lease passed got %+v", again)
+	}
+}
+
+func TestOrderingPriority(t *testing.T) {
+	mq := setup(t)
+	defer cleanup(mq)
+	publish(t, mq,
+		&gq.Message{Payload: []byte("a1"), OrderingKey: "a"},
+		&gq.Message{Payload: []byte("a2"), OrderingKey: "a", Priority: 10},
+		&gq.Message{Payload: []byte("low"), Priority: -1},
+		&gq.Message{Payload: []byte("high"), Priority: 5},
+	)
+	ms, _ := mq.ConsumeBatch(10)
+	payloads := ""
+	for _, m := range ms {
+		payloads += string(m.Payload) + " "
+	}
+	if payloads != "high a1 low " {
+		t.Fatalf("Expected priority order with one message per key got %s", payloads)
+	}
+	mq.Commit([]*gq.Receipt{&gq.Receipt{Id: ms[1].Id, Success: true}})
+	ms, _ = mq.ConsumeBatch(10)
+	if len(ms) != 1 || string(ms[0].Payload) != "a2" {
+		t.Errorf("Expected the next message for the key once the first was committed got %+v", ms)
+	}
+}
+
+// Test messages and checkouts survive closing and reopening the database
+func TestReopen(t *testing.T) {
+	path := t.TempDir() + "/reopen.db"
+	pdb, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mq := NewBoltq(pdb, "test_")
+	mq.Create()
+	publish(t, mq, &gq.Message{Payload: []byte("one"), Headers: map[string]string{"type": "test"}}, &gq.Message{Payload: []byte("two")})
+	mq.ConsumeBatch(1)
+	pdb.Close()
+
+	pdb, err = bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pdb.Close()
+	mq = NewBoltq(pdb, "test_")
+	ms, err := mq.ConsumeBatch(10)
+	if err != nil || len(ms) != 1 || string(ms[0].Payload) != "two" {
+		t.Fatalf("Expected only the message that was not checked out got %+v error %v", ms, err)
+	}
+	if err = mq.Commit([]*gq.Receipt{&gq.Receipt{Id: 1, Success: true}, &gq.Receipt{Id: 2, Success: true}}); err != nil {
+		t.Fatalf("Failed to commit %s", err)
+	}
+	if ms, _ = mq.ConsumeBatch(10); len(ms) != 0 {
+		t.Errorf("Expected an empty queue got %d", len(ms))
+	}
+}
+
+// Test messages waiting on their ordering key are kept out of ready
+func TestOrderingBlocked(t *testing.T) {
+	mq := setup(t)
+	defer cleanup(mq)
+	for i := 0; i < 100; i++ {
+		publish(t, mq, &gq.Message{Payload: []byte("a"), OrderingKey: "a"})
+	}
+	publish(t, mq, &gq.Message{Payload: []byte("b")})
+	ready := 0
+	db.View(func(bt *bolt.Tx) error {
+		ready = bt.Bucket(mq.name("ready")).Stats().KeyN
+		return nil
+	})
+	if ready != 2 {
+		t.Fatalf("Expected only the head of the key and the unordered message ready got %d", ready)
+	}
+	for i := 1; i <= 100; i++ {
+		ms, err := mq.ConsumeBatch(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range ms {
+			if m.OrderingKey == "a" && m.Id != int64(i) {
+				t.Fatalf("Expected message %d for the key got %d", i, m.Id)
+			}
+			mq.Commit([]*gq.Receipt{&gq.Receipt{Id: m.Id, Success: true}})
+		}
+	}
+	if ms, _ := mq.ConsumeBatch(10); len(ms) != 0 {
+		t.Errorf("Expected an empty queue got %d", len(ms))
+	}
+}
+
+func TestRecordEncoding(t *testing.T) {
+	now := time.Now().UTC()
+	r := &record{Id: 7, Timestamp: now, VisibleAt: now, Attempts: 2, TTL: time.Second, OrderingKey: "k",
+		Priority: -3, Headers: map[string]string{"type": "test"}, Payload: []byte("payload"), LastError: "failed"}
+	decoded, err := decodeRecord(encodeRecord(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r, decoded) {
+		t.Errorf("Expected %+v got %+v", r, decoded)
+	}
+	if _, err = decodeRecord([]byte(`{"id":7}`)); err != errCorrupt {
+		t.Errorf("Expected a record of another version to be corrupt got %v", err)
+	}
+	if _, err = decodeRecord(encodeRecord(r)[:10]); err != errCorrupt {
+		t.Errorf("Expected a truncated record to be corrupt got %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package boltq
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// recordVersion first byte of a record so the format can change
+const recordVersion byte = 1
+
+// errCorrupt returned when a stored record cannot be decoded
+var errCorrupt = errors.New("boltq: corrupt record")
+
+// record ... Message as it is stored in the buckets
+type record struct {
+	Id          int64
+	Timestamp   time.Time
+	Checkout    time.Time
+	VisibleAt   time.Time
+	LeaseUntil  time.Time
+	Attempts    int
+	TTL         time.Duration
+	OrderingKey string
+	Priority    int
+	Headers     map[string]string
+	Payload     []byte
+	LastError   string
+}
+
+// encodeRecord ... Binary form of the record, varints for the numbers and length
+// prefixed strings so the payload is stored as is
+func encodeRecord(r *record) []byte {
+	b := make([]byte, 0, 64+len(r.OrderingKey)+len(r.LastError)+len(r.Payload))
+	b = append(b, recordVersion)
+	b = binary.AppendVarint(b, r.Id)
+	b = appendTime(b, r.Timestamp)
+	b = appendTime(b, r.Checkout)
+	b = appendTime(b, r.VisibleAt)
+	b = appendTime(b, r.LeaseUntil)
+	b = binary.AppendVarint(b, int64(r.Attempts))
+	b = binary.AppendVarint(b, int64(r.TTL))
+	b = appendBytes(b, []byte(r.OrderingKey))
+	b = binary.AppendVarint(b, int64(r.Priority))
+	b = appendBytes(b, []byte(r.LastError))
+	b = binary.AppendUvarint(b, uint64(len(r.Headers)))
+	for k, v := range r.Headers {
+		b = appendBytes(b, []byte(k))
+		b = appendBytes(b, []byte(v))
+	}
+	return appendBytes(b, r.Payload)
+}
+
+// appendTime ... Time as nanoseconds since the epoch, the zero time is kept apart so
+// it reads back as zero
+func appendTime(b []byte, t time.Time) []byte {
+	if t.IsZero() {
+		return binary.AppendVarint(b, math.MinInt64)
+	}
+	return binary.AppendVarint(b, t.UnixNano())
+}
+
+func appendBytes(b []byte, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// decoder ... Reads the fields of a binary record keeping the first error
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errCorrupt
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errCorrupt
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) time() time.Time {
+	n := d.varint()
+	if n == math.MinInt64 {
+		return time.Time{}
+	}
+	return time.Unix(0, n).UTC()
+}
+
+func (d *decoder) bytes() []byte {
+	if d.err != nil {
+		return nil
+	}
+	size := d.uvarint()
+	if d.err == nil && size > uint64(len(d.b)) {
+		d.err = errCorrupt
+	}
+	if d.err != nil {
+		return nil
+	}
+	v := d.b[:size]
+	d.b = d.b[size:]
+	return v
+}
+
+// decodeRecord ... Record from its binary form, the value is copied as bbolt values are
+// only valid for the life of the transaction
+func decodeRecord(v []byte) (*record, error) {
+	r := &record{}
+	if len(v) == 0 || v[0] != recordVersion {
+		return nil, errCorrupt
+	}
+	d := &decoder{b: v[1:]}
+	r.Id = d.varint()
+	r.Timestamp = d.time()
+	r.Checkout = d.time()
+	r.VisibleAt = d.time()
+	r.LeaseUntil = d.time()
+	r.Attempts = int(d.varint())
+	r.TTL = time.Duration(d.varint())
+	r.OrderingKey = string(d.bytes())
+	r.Priority = int(d.varint())
+	r.LastError = string(d.bytes())
+	headers := d.uvarint()
+	if headers > uint64(len(d.b)) {
+		return nil, errCorrupt
+	}
+	if headers > 0 {
+		r.Headers = make(map[string]string, headers)
+		for i := uint64(0); i < headers; i++ {
+			k := string(d.bytes())
+			r.Headers[k] = string(d.bytes())
+		}
+	}
+	if payload := d.bytes(); payload != nil {
+		r.Payload = append([]byte(nil), payload...)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return r, nil
+}
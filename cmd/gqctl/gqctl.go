@@ -0,0 +1,457 @@
+// gqctl is a command line tool for operating gq queues
+//
+//	gqctl [flags] command [arguments]
+//
+// Commands:
+//
+//	create                       create the queue tables, with -topic the topic is
+//	                             also added to the topic list
+//	destroy                      drop the queue tables and everything in them, with
+//	                             -topic the topic is also removed from the topic list
+//	stats [-estimate]            message counts by state
+//	peek [-state -after -limit]  print messages without checking them out
+//	publish [-in file]           publish each line of stdin or the file as a message
+//	export [-out file]           write every message to stdout or the file as JSON Lines
+//	import [-in file]            load messages written by export from stdin or the file
+//	purge                        remove every message, dead letters are kept
+//	release [-older duration]    make stuck checkouts available again
+//	dlq list [-after -limit]     print dead letters
+//	dlq show id                  print a dead letter
+//	dlq requeue [-all] [id...]   move dead letters back into the queue
+//	dlq purge                    remove every dead letter
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lateefj/gq"
+	"github.com/lateefj/gq/liteq"
+	"github.com/lateefj/gq/pq"
+	_ "github.com/lib/pq" // Postgresql Driver
+)
+
+const (
+	pgStorageType     = "postgres"
+	sqliteStorageType = "sqlite3"
+)
+
+var errUsage = errors.New("usage: gqctl [-type sqlite3|postgres] [-dsn dsn] [-prefix prefix] [-topic topic] [-ttl duration] [-max-attempts n] command [arguments]")
+
+// backend ... Everything gqctl needs from a queue
+type backend interface {
+	gq.ContextMQ
+	gq.StatsQueue
+	gq.Browser
+	gq.DeadLetterQueue
+	gq.AdminQueue
+	gq.Restorer
+}
+
+// topicDeleter ... Backend that keeps track of its topics
+type topicDeleter interface {
+	DeleteTopic(ctx context.Context, name string) error
+}
+
+// queue ... Backend with the topic it was opened for, a topic is destroyed
+// through DeleteTopic so it is also removed from the topics table
+type queue struct {
+	backend
+	topic   string
+	deleter topicDeleter
+}
+
+func (q *queue) destroy(ctx context.Context) error {
+	if q.topic != "" {
+		return q.deleter.DeleteTopic(ctx, q.topic)
+	}
+	return q.DestroyContext(ctx)
+}
+
+// config ... Global flags
+type config struct {
+	storageType string
+	dsn         string
+	prefix      string
+	topic       string
+	ttl         time.Duration
+	maxAttempts int
+}
+
+// view ... JSON form of a message, the payload is printed as text
+type view struct {
+	Id          int64             `json:"id"`
+	Payload     string            `json:"payload"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Checkout    *time.Time        `json:"checkout,omitempty"`
+	NotBefore   *time.Time        `json:"not_before,omitempty"`
+	Attempts    int               `json:"attempts"`
+	Priority    int               `json:"priority,omitempty"`
+	OrderingKey string            `json:"ordering_key,omitempty"`
+	Error       string            `json:"error,omitempty"`
+	DeadAt      *time.Time        `json:"dead_at,omitempty"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func newView(m *gq.ConsumerMessage) *view {
+	return &view{
+		Id:          m.Id,
+		Payload:     string(m.Payload),
+		Headers:     m.Headers,
+		Timestamp:   m.Timestamp,
+		Checkout:    optionalTime(m.Checkout),
+		NotBefore:   optionalTime(m.NotBefore),
+		Attempts:    m.Attempts,
+		Priority:    m.Priority,
+		OrderingKey: m.OrderingKey,
+	}
+}
+
+func deadLetterView(d *gq.DeadLetter) *view {
+	v := newView(&d.ConsumerMessage)
+	v.Error = d.Error
+	v.DeadAt = optionalTime(d.DeadAt)
+	return v
+}
+
+func main() {
+	log.SetFlags(0)
+	err := run(context.Background(), os.Args[1:], os.Stdin, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run ... Parses the global flags and runs the command
+func run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	cfg := config{}
+	flags := flag.NewFlagSet("gqctl", flag.ContinueOnError)
+	flags.StringVar(&cfg.storageType, "type", sqliteStorageType, "Data storage type defaults to 'sqlite3' and 'postgres' is also an option")
+	flags.StringVar(&cfg.dsn, "dsn", "", "Database connection info pg example 'user=gq host=localhost dbname=pq sslmode=disable' and sqlite example /tmp/gq.db, required for sqlite")
+	flags.StringVar(&cfg.prefix, "prefix", "gq_", "Table prefix of the queue")
+	flags.StringVar(&cfg.topic, "topic", "", "Topic of the queue, empty for the default queue")
+	flags.DurationVar(&cfg.ttl, "ttl", 0, "Checkout TTL of the queue, used to tell expired checkouts apart and by release")
+	flags.IntVar(&cfg.maxAttempts, "max-attempts", 0, "Delivery attempts before a message is dead lettered, 0 never dead letters")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errUsage
+	}
+	db, q, err := open(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	command, args := flags.Arg(0), flags.Args()[1:]
+	switch command {
+	case "create":
+		return q.CreateContext(ctx)
+	case "destroy":
+		return q.destroy(ctx)
+	case "stats":
+		return stats(ctx, q, args, stdout)
+	case "peek":
+		return peek(ctx, q, args, stdout)
+	case "publish":
+		return publish(ctx, q, args, stdin, stdout)
+	case "export":
+		return export(ctx, q, args, stdout)
+	case "import":
+		return load(ctx, q, args, stdin, stdout)
+	case "purge":
+		return q.Purge(ctx)
+	case "release":
+		return release(ctx, q, args, stdout)
+	case "dlq":
+		return deadLetters(ctx, q, args, stdout)
+	}
+	return fmt.Errorf("unknown command %q\n%s", command, errUsage)
+}
+
+// open ... Database and queue for the flags
+func open(cfg config) (*sql.DB, *queue, error) {
+	dsn := cfg.dsn
+	driver := cfg.storageType
+	switch cfg.storageType {
+	case sqliteStorageType:
+		if dsn == "" {
+			return nil, nil, errors.New("-dsn is required for sqlite3, the path of the database file")
+		}
+		// cgo or pure Go depending on how liteq was built
+		driver = liteq.DriverName
+	case pgStorageType:
+		if dsn == "" {
+			dsn = fmt.Sprintf("user=%s host=localhost dbname=pq sslmode=disable", os.Getenv("USER"))
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown storage type %s", cfg.storageType)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	q := &queue{topic: cfg.topic}
+	if cfg.storageType == pgStorageType {
+		p := pq.NewPgmq(db, cfg.prefix)
+		p.Ttl = cfg.ttl
+		p.MaxAttempts = cfg.maxAttempts
+		q.backend, q.deleter = p, p
+		if cfg.topic != "" {
+			q.backend, err = p.Topic(cfg.topic)
+		}
+	} else {
+		l := &liteq.Liteq{DB: db, Prefix: cfg.prefix, TTL: cfg.ttl, MaxAttempts: cfg.maxAttempts}
+		q.backend, q.deleter = l, l
+		if cfg.topic != "" {
+			q.backend, err = l.Topic(cfg.topic)
+		}
+	}
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return db, q, nil
+}
+
+func stats(ctx context.Context, q *queue, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	estimate := flags.Bool("estimate", false, "Use planner estimates rather than counting, postgres only")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	s, err := q.Stats(ctx, *estimate)
+	if err != nil {
+		return err
+	}
+	if !s.Estimated {
+		fmt.Fprintf(stdout, "ready\t%d\nin_flight\t%d\nexpired\t%d\ndelayed\t%d\n", s.Ready, s.InFlight, s.Expired, s.Delayed)
+	}
+	fmt.Fprintf(stdout, "total\t%d\ndead_letters\t%d\noldest_age\t%s\nbytes\t%d\n", s.Total, s.DeadLetters, s.OldestAge, s.Bytes)
+	return nil
+}
+
+func peek(ctx context.Context, q *queue, args []string, stdout io.Writer) error {
+	opts := gq.BrowseOptions{}
+	var state string
+	flags := flag.NewFlagSet("peek", flag.ContinueOnError)
+	flags.StringVar(&state, "state", "", "Only messages that are ready, in_flight, expired or delayed")
+	flags.Int64Var(&opts.After, "after", 0, "Only messages with an id greater than this")
+	flags.IntVar(&opts.Limit, "limit", 10, "Maximum number of messages")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	opts.State = gq.MessageState(state)
+	ms, err := q.Browse(ctx, opts)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(stdout)
+	for _, m := range ms {
+		if err = encoder.Encode(newView(m)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func publish(ctx context.Context, q *queue, args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("publish", flag.ContinueOnError)
+	inPath := flags.String("in", "", "File to read messages from, defaults to stdin")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	in := stdin
+	if *inPath != "" {
+		f, err := os.Open(*inPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	scanner := bufio.NewScanner(in)
+	bufSize := 64 * 4096
+	scanner.Buffer(make([]byte, bufSize), bufSize)
+	messages := make([]*gq.Message, 0)
+	for scanner.Scan() {
+		messages = append(messages, &gq.Message{Payload: []byte(scanner.Text())})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := q.PublishContext(ctx, messages); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "published %d\n", len(messages))
+	return nil
+}
+
+func export(ctx context.Context, q *queue, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	outPath := flags.String("out", "", "File to write messages to, defaults to stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *outPath == "" {
+		_, err := gq.Export(ctx, q, stdout)
+		return err
+	}
+	f, err := os.Create(*outPath)
+	if err != nil {
+		return err
+	}
+	n, err := gq.Export(ctx, q, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "exported %d\n", n)
+	return nil
+}
+
+// load ... Import command, import is a keyword
+func load(ctx context.Context, q *queue, args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	inPath := flags.String("in", "", "File to read exported messages from, defaults to stdin")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	in := stdin
+	if *inPath != "" {
+		f, err := os.Open(*inPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	n, err := gq.Import(ctx, q, in)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "imported %d\n", n)
+	return nil
+}
+
+func release(ctx context.Context, q *queue, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("release", flag.ContinueOnError)
+	older := flags.Duration("older", 0, "Release checkouts older than this, 0 releases those past their TTL")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	n, err := q.ReleaseCheckouts(ctx, *older)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "released %d\n", n)
+	return nil
+}
+
+func deadLetters(ctx context.Context, q *queue, args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: gqctl dlq list|show|requeue|purge")
+	}
+	encoder := json.NewEncoder(stdout)
+	command, args := args[0], args[1:]
+	switch command {
+	case "list":
+		flags := flag.NewFlagSet("dlq list", flag.ContinueOnError)
+		after := flags.Int64("after", 0, "Only dead letters with an id greater than this")
+		limit := flags.Int("limit", 10, "Maximum number of dead letters")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		ds, err := q.DeadLetters(ctx, *after, *limit)
+		if err != nil {
+			return err
+		}
+		for _, d := range ds {
+			if err = encoder.Encode(deadLetterView(d)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "show":
+		if len(args) != 1 {
+			return errors.New("usage: gqctl dlq show id")
+		}
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return err
+		}
+		d, err := q.DeadLetter(ctx, id)
+		if err != nil {
+			return err
+		}
+		return encoder.Encode(deadLetterView(d))
+	case "requeue":
+		flags := flag.NewFlagSet("dlq requeue", flag.ContinueOnError)
+		all := flags.Bool("all", false, "Requeue every dead letter")
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		ids, err := requeueIds(ctx, q, *all, flags.Args())
+		if err != nil {
+			return err
+		}
+		n, err := q.RequeueDeadLetters(ctx, ids)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "requeued %d\n", n)
+		return nil
+	case "purge":
+		return q.PurgeDeadLetters(ctx)
+	}
+	return fmt.Errorf("unknown dlq command %q", command)
+}
+
+// requeueIds ... Ids from the arguments or every dead letter id with all
+func requeueIds(ctx context.Context, q *queue, all bool, args []string) ([]int64, error) {
+	ids := make([]int64, 0)
+	if !all {
+		for _, a := range args {
+			id, err := strconv.ParseInt(a, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		return ids, nil
+	}
+	var after int64
+	for {
+		ds, err := q.DeadLetters(ctx, after, 1000)
+		if err != nil {
+			return nil, err
+		}
+		if len(ds) == 0 {
+			return ids, nil
+		}
+		for _, d := range ds {
+			ids = append(ids, d.Id)
+		}
+		after = ds[len(ds)-1].Id
+	}
+}
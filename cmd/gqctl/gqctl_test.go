@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lateefj/gq"
+	"github.com/lateefj/gq/liteq"
+)
+
+const testPath = "/tmp/gqctl_test.db"
+
+// gqctl ... Runs a command against the test database returning the output
+func gqctl(t *testing.T, stdin string, args ...string) string {
+	var out bytes.Buffer
+	args = append([]string{"-dsn", testPath + "?_busy_timeout=5000", "-prefix", "gqctl_"}, args...)
+	err := run(context.Background(), args, strings.NewReader(stdin), &out)
+	if err != nil {
+		t.Fatalf("gqctl %v failed %s", args, err)
+	}
+	return out.String()
+}
+
+func TestCommands(t *testing.T) {
+	os.Remove(testPath)
+	defer os.Remove(testPath)
+
+	gqctl(t, "", "create")
+	if out := gqctl(t, "one\ntwo\nthree\n", "publish"); out != "published 3\n" {
+		t.Fatalf("Expected 3 published got %s", out)
+	}
+	if out := gqctl(t, "", "stats"); !strings.Contains(out, "ready\t3\n") {
+		t.Fatalf("Expected 3 ready got %s", out)
+	}
+	out := gqctl(t, "", "peek", "-limit", "2")
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 2 || !strings.Contains(lines[0], `"payload":"one"`) {
+		t.Fatalf("Expected the first 2 messages got %s", out)
+	}
+	if out = gqctl(t, "", "release"); out != "released 0\n" {
+		t.Fatalf("Expected nothing released got %s", out)
+	}
+	if out = gqctl(t, "", "dlq", "list"); out != "" {
+		t.Fatalf("Expected no dead letters got %s", out)
+	}
+	if out = gqctl(t, "", "dlq", "requeue", "-all"); out != "requeued 0\n" {
+		t.Fatalf("Expected nothing requeued got %s", out)
+	}
+	exported := gqctl(t, "", "export")
+	if lines := strings.Split(strings.TrimSpace(exported), "\n"); len(lines) != 3 {
+		t.Fatalf("Expected 3 exported messages got %s", exported)
+	}
+	gqctl(t, "", "purge")
+	if out = gqctl(t, exported, "import"); out != "imported 3\n" {
+		t.Fatalf("Expected 3 imported got %s", out)
+	}
+	if out = gqctl(t, "", "peek", "-limit", "1"); !strings.Contains(out, `"payload":"one"`) {
+		t.Fatalf("Expected the imported messages in order got %s", out)
+	}
+	gqctl(t, "", "purge")
+	if out = gqctl(t, "", "stats"); !strings.Contains(out, "total\t0\n") {
+		t.Fatalf("Expected an empty queue after purge got %s", out)
+	}
+	gqctl(t, "", "destroy")
+
+	err := run(context.Background(), []string{"-dsn", testPath, "bogus"}, strings.NewReader(""), &bytes.Buffer{})
+	if err == nil {
+		t.Error("Expected an unknown command to fail")
+	}
+}
+
+func TestTopicCreateDestroy(t *testing.T) {
+	os.Remove(testPath)
+	defer os.Remove(testPath)
+
+	db, q, err := open(config{storageType: sqliteStorageType, dsn: testPath, prefix: "gqctl_"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	l := q.deleter.(*liteq.Liteq)
+	gqctl(t, "", "-topic", "orders", "create")
+	topics, err := l.Topics(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topics) != 1 || topics[0] != "orders" {
+		t.Errorf("Expected the created topic in the topics got %v", topics)
+	}
+	gqctl(t, "", "-topic", "orders", "destroy")
+	topics, err = l.Topics(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topics) != 0 {
+		t.Errorf("Expected the destroyed topic to be removed from the topics got %v", topics)
+	}
+}
+
+func TestSqliteDSNRequired(t *testing.T) {
+	err := run(context.Background(), []string{"stats"}, strings.NewReader(""), &bytes.Buffer{})
+	if err == nil {
+		t.Error("Expected sqlite3 without -dsn to fail")
+	}
+}
+
+func TestRequeueCount(t *testing.T) {
+	os.Remove(testPath)
+	defer os.Remove(testPath)
+
+	gqctl(t, "", "create")
+	gqctl(t, "one\ntwo\n", "publish")
+	db, q, err := open(config{storageType: sqliteStorageType, dsn: testPath, prefix: "gqctl_", ttl: time.Millisecond, maxAttempts: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	ms, err := q.ConsumeBatchContext(ctx, 2)
+	if err != nil || len(ms) != 2 {
+		t.Fatalf("Expected 2 messages got %d error %v", len(ms), err)
+	}
+	// Failing on the last attempt dead letters the messages
+	err = q.CommitContext(ctx, []*gq.Receipt{{Id: ms[0].Id, Error: "failed"}, {Id: ms[1].Id, Error: "failed"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := gqctl(t, "", "dlq", "requeue", "999"); out != "requeued 0\n" {
+		t.Errorf("Expected an unknown id not to be counted got %s", out)
+	}
+	if out := gqctl(t, "", "dlq", "requeue", "-all"); out != "requeued 2\n" {
+		t.Errorf("Expected 2 requeued got %s", out)
+	}
+}
@@ -16,8 +16,7 @@ import (
 	"github.com/lateefj/gq"
 	"github.com/lateefj/gq/liteq"
 	"github.com/lateefj/gq/pq"
-	_ "github.com/lib/pq"           // Postgresql Driver
-	_ "github.com/mattn/go-sqlite3" // Sqlite3 Driver
+	_ "github.com/lib/pq" // Postgresql Driver
 )
 
 const (
@@ -113,11 +112,14 @@ func init() {
 
 func db() (*sql.DB, error) {
 	d := dsn
+	driver := storageType
 	switch storageType {
 	case sqliteStorageType:
 		if dsn == "" {
 			d = sqliteDefaultDsn
 		}
+		// cgo or pure Go depending on how liteq was built
+		driver = liteq.DriverName
 
 	case pgStorageType:
 		if dsn == "" {
@@ -127,7 +129,7 @@ func db() (*sql.DB, error) {
 		log.Fatalf("Unknown storage type %s", storageType)
 	}
 
-	return conndb(storageType, d)
+	return conndb(driver, d)
 }
 
 func conndb(t, d string) (*sql.DB, error) {
@@ -0,0 +1,189 @@
+package gq
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Handler processes a single message, returning an error fails the message so
+// the queue delivers it again
+type Handler func(ctx context.Context, m *ConsumerMessage) error
+
+// Consumer runs a Handler over the messages streamed from a queue, committing
+// a receipt for every message based on the handler result
+type Consumer struct {
+	Queue   MQ
+	Handler Handler
+	// Number of messages handled at the same time, defaults to 1
+	Concurrency int
+	// Messages requested from the queue at a time, defaults to Concurrency
+	BatchSize int
+	// Wait between empty polls of the queue, defaults to 100 milliseconds
+	Pause time.Duration
+	// When set and the queue is an Extender the lease on each message is extended by
+	// this every half Lease until its handler returns, keep it under twice the queue
+	// TTL so the first extension lands before the TTL passes
+	Lease time.Duration
+	// How long handlers still running at shutdown have before their context is
+	// cancelled, 0 waits for them to finish
+	DrainTimeout time.Duration
+}
+
+// NewConsumer ... Consumer for the queue with the default settings
+func NewConsumer(q MQ, handler Handler) *Consumer {
+	return &Consumer{Queue: q, Handler: handler}
+}
+
+// Run ... Consumes until the context is done or a commit fails. On shutdown the
+// stream is stopped and every message already received is handled and committed
+// before Run returns. Returns the commit error if there was one.
+//
+// Queues that are not a ContextMQ can only be stopped with StopConsumer, which stops
+// every stream on that queue value for good. Give the Consumer its own queue value
+// in that case and do not stream from it again after Run returns.
+func (c *Consumer) Run(ctx context.Context) error {
+	concurrency := c.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	size := c.BatchSize
+	if size <= 0 {
+		size = concurrency
+	}
+	pause := c.Pause
+	if pause <= 0 {
+		pause = 100 * time.Millisecond
+	}
+
+	streamCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	// Handlers and commits outlive the run context so in flight messages drain
+	commitCtx := context.WithoutCancel(ctx)
+	handlerCtx, cancelHandlers := context.WithCancel(commitCtx)
+	defer cancelHandlers()
+	go func() {
+		<-streamCtx.Done()
+		if c.DrainTimeout > 0 {
+			select {
+			case <-time.After(c.DrainTimeout):
+				cancelHandlers()
+			case <-handlerCtx.Done():
+			}
+		}
+	}()
+
+	stream := make(chan []*ConsumerMessage, 1)
+	if cq, ok := c.Queue.(ContextMQ); ok {
+		go cq.StreamContext(streamCtx, size, stream, pause)
+	} else {
+		go c.Queue.Stream(size, stream, pause)
+		go func() {
+			<-streamCtx.Done()
+			c.Queue.StopConsumer()
+		}()
+	}
+
+	// Messages are fed to the workers one at a time so a slow message only holds
+	// its own worker, receipts are committed as they arrive
+	work := make(chan *delivery)
+	receipts := make(chan *Receipt, size)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range work {
+				receipts <- c.handle(handlerCtx, d)
+			}
+		}()
+	}
+	go func() {
+		for batch := range stream {
+			ds := make([]*delivery, len(batch))
+			for i, m := range batch {
+				ds[i] = c.deliver(handlerCtx, m)
+			}
+			for _, d := range ds {
+				work <- d
+			}
+		}
+		close(work)
+		wg.Wait()
+		close(receipts)
+	}()
+
+	var err error
+	for r := range receipts {
+		batch := []*Receipt{r}
+	collect:
+		for len(batch) < size {
+			select {
+			case r, ok := <-receipts:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, r)
+			default:
+				break collect
+			}
+		}
+		if commitErr := c.commit(commitCtx, batch); commitErr != nil && err == nil {
+			err = commitErr
+			stop()
+		}
+	}
+	return err
+}
+
+// delivery ... Message waiting for a worker with the heartbeat keeping its lease
+type delivery struct {
+	message *ConsumerMessage
+	stop    func() error
+}
+
+// deliver ... Starts extending the lease on the message when the queue supports it,
+// the lease is kept from when the message is received until it is handled
+func (c *Consumer) deliver(ctx context.Context, m *ConsumerMessage) *delivery {
+	d := &delivery{message: m}
+	if e, ok := c.Queue.(Extender); ok && c.Lease > 0 {
+		d.stop = Heartbeat(ctx, e, []*ConsumerMessage{m}, c.Lease, c.Lease/2)
+	}
+	return d
+}
+
+// handle ... Runs the handler over the message and stops its heartbeat
+func (c *Consumer) handle(ctx context.Context, d *delivery) *Receipt {
+	if d.stop != nil {
+		defer d.stop()
+	}
+	m := d.message
+	r := &Receipt{Id: m.Id, Success: true, Topic: m.Topic}
+	if err := c.call(ctx, m); err != nil {
+		r.Success = false
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// call ... Handler with a panic turned into an error
+func (c *Consumer) call(ctx context.Context, m *ConsumerMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("gq: handler panic: %v", r)
+		}
+	}()
+	return c.Handler(ctx, m)
+}
+
+// commit ... Commits the receipts with the context when the queue supports it
+func (c *Consumer) commit(ctx context.Context, receipts []*Receipt) error {
+	if len(receipts) == 0 {
+		return nil
+	}
+	if cq, ok := c.Queue.(ContextMQ); ok {
+		return cq.CommitContext(ctx, receipts)
+	}
+	return c.Queue.Commit(receipts)
+}
@@ -0,0 +1,222 @@
+package gq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sliceMQ in memory MQ that only implements the legacy interface
+type sliceMQ struct {
+	mutex    sync.Mutex
+	pending  []*ConsumerMessage
+	receipts []*Receipt
+	exit     bool
+}
+
+func newSliceMQ(size int) *sliceMQ {
+	q := &sliceMQ{}
+	for i := 0; i < size; i++ {
+		q.pending = append(q.pending, &ConsumerMessage{Id: int64(i + 1), Message: Message{Payload: []byte("test")}})
+	}
+	return q
+}
+
+func (q *sliceMQ) Create() error                     { return nil }
+func (q *sliceMQ) Destroy() error                    { return nil }
+func (q *sliceMQ) Publish(messages []*Message) error { return nil }
+func (q *sliceMQ) StopConsumer()                     { q.mutex.Lock(); q.exit = true; q.mutex.Unlock() }
+func (q *sliceMQ) Commit(recipts []*Receipt) error {
+	q.mutex.Lock()
+	q.receipts = append(q.receipts, recipts...)
+	q.mutex.Unlock()
+	return nil
+}
+func (q *sliceMQ) committed() []*Receipt { q.mutex.Lock(); defer q.mutex.Unlock(); return q.receipts }
+func (q *sliceMQ) stopped() bool         { q.mutex.Lock(); defer q.mutex.Unlock(); return q.exit }
+func (q *sliceMQ) ConsumeBatch(size int) ([]*ConsumerMessage, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if size > len(q.pending) {
+		size = len(q.pending)
+	}
+	ms := q.pending[:size]
+	q.pending = q.pending[size:]
+	return ms, nil
+}
+
+func (q *sliceMQ) Stream(size int, messages chan []*ConsumerMessage, pause time.Duration) {
+	defer close(messages)
+	for !q.stopped() {
+		ms, _ := q.ConsumeBatch(size)
+		if len(ms) == 0 {
+			time.Sleep(pause)
+			continue
+		}
+		messages <- ms
+	}
+}
+
+// waitFor ... Polls until the condition is true or the test times out
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestConsumerReceipts(t *testing.T) {
+	q := newSliceMQ(100)
+	var running, maxRunning int32
+	c := NewConsumer(q, func(ctx context.Context, m *ConsumerMessage) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		switch m.Id % 10 {
+		case 0:
+			return errors.New("failed")
+		case 5:
+			panic("boom")
+		}
+		return nil
+	})
+	c.Concurrency = 4
+	c.Pause = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.Run(ctx) }()
+	waitFor(t, func() bool { return len(q.committed()) == 100 })
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Expected no error from run got %s", err)
+	}
+	if !q.stopped() {
+		t.Error("Expected the stream to be stopped")
+	}
+	if maxRunning > 4 {
+		t.Errorf("Expected at most 4 handlers running at once got %d", maxRunning)
+	}
+	for _, r := range q.committed() {
+		switch r.Id % 10 {
+		case 0:
+			if r.Success || r.Error != "failed" {
+				t.Errorf("Expected message %d to fail with the handler error got %v %s", r.Id, r.Success, r.Error)
+			}
+		case 5:
+			if r.Success || r.Error != "gq: handler panic: boom" {
+				t.Errorf("Expected message %d to fail with the panic got %v %s", r.Id, r.Success, r.Error)
+			}
+		default:
+			if !r.Success {
+				t.Errorf("Expected message %d to succeed", r.Id)
+			}
+		}
+	}
+}
+
+func TestConsumerDrain(t *testing.T) {
+	q := newSliceMQ(4)
+	started := make(chan struct{}, 4)
+	release := make(chan struct{})
+	c := NewConsumer(q, func(ctx context.Context, m *ConsumerMessage) error {
+		started <- struct{}{}
+		<-release
+		return ctx.Err()
+	})
+	c.Concurrency = 4
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.Run(ctx) }()
+	for i := 0; i < 4; i++ {
+		<-started
+	}
+	// Shutdown while the handlers are still running
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	if len(q.committed()) != 0 {
+		t.Fatal("Expected nothing committed before the handlers finish")
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("Expected no error from run got %s", err)
+	}
+	receipts := q.committed()
+	if len(receipts) != 4 {
+		t.Fatalf("Expected the in flight messages to be committed got %d", len(receipts))
+	}
+	for _, r := range receipts {
+		if !r.Success {
+			t.Errorf("Expected in flight message %d to succeed with an uncancelled context got %s", r.Id, r.Error)
+		}
+	}
+}
+
+// extendMQ records the lease extensions
+type extendMQ struct {
+	*sliceMQ
+	extended int32
+}
+
+func (q *extendMQ) Extend(ctx context.Context, ms []*ConsumerMessage, lease time.Duration) error {
+	atomic.AddInt32(&q.extended, 1)
+	return nil
+}
+
+func TestConsumerLease(t *testing.T) {
+	q := &extendMQ{sliceMQ: newSliceMQ(1)}
+	c := NewConsumer(q, func(ctx context.Context, m *ConsumerMessage) error {
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	})
+	c.Lease = 20 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.Run(ctx) }()
+	waitFor(t, func() bool { return len(q.committed()) == 1 })
+	cancel()
+	<-done
+	extended := atomic.LoadInt32(&q.extended)
+	if extended < 3 {
+		t.Errorf("Expected the lease to be extended while the handler ran got %d", extended)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if atomic.LoadInt32(&q.extended) != extended {
+		t.Error("Expected the heartbeat to stop once the handler finished")
+	}
+}
+
+func TestConsumerSlowMessage(t *testing.T) {
+	q := newSliceMQ(20)
+	release := make(chan struct{})
+	c := NewConsumer(q, func(ctx context.Context, m *ConsumerMessage) error {
+		if m.Id == 1 {
+			<-release
+		}
+		return nil
+	})
+	c.Concurrency = 2
+	c.Pause = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.Run(ctx) }()
+	// The other worker keeps taking messages while the first one is stuck
+	waitFor(t, func() bool { return len(q.committed()) == 19 })
+	close(release)
+	waitFor(t, func() bool { return len(q.committed()) == 20 })
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Expected no error from run got %s", err)
+	}
+}
@@ -0,0 +1,312 @@
+// Package gqtest holds a conformance suite every gq.MQ implementation should pass
+package gqtest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lateefj/gq"
+)
+
+// Config settings a test needs from the queue, zero values are the queue defaults
+type Config struct {
+	// Checkout TTL, 0 meaning checkouts never expire
+	TTL time.Duration
+	// Delivery attempts before a message is dead lettered
+	MaxAttempts int
+	// Delay before a failed message is delivered again
+	Backoff gq.Backoff
+	// How long an idempotency key drops repeated publishes
+	DedupWindow time.Duration
+	// Waiting time that raises a message one priority
+	Aging time.Duration
+}
+
+// Factory returns a new queue with the settings in cfg. Each call must return a queue
+// that shares no messages with earlier ones, the suite calls Create before a test and
+// Destroy after it. Return nil when the queue does not support a setting and the tests
+// that need it are skipped.
+type Factory func(t *testing.T, cfg Config) gq.MQ
+
+// TTL used by the redelivery test, backends should support millisecond precision TTLs
+const TTL = 200 * time.Millisecond
+
+// RunConformance ... Runs every conformance test as a subtest of t against queues from
+// the factory
+func RunConformance(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		cfg  Config
+		test func(t *testing.T, q gq.MQ)
+	}{
+		{"Order", Config{}, testOrder},
+		{"TTLRedelivery", Config{TTL: TTL}, testTTLRedelivery},
+		{"PartialCommit", Config{}, testPartialCommit},
+		{"EmptyCommit", Config{}, testEmptyCommit},
+		{"ConcurrentConsumers", Config{}, testConcurrentConsumers},
+		{"StreamShutdown", Config{}, testStreamShutdown},
+		{"StreamCancel", Config{}, testStreamCancel},
+		{"StreamContextCancel", Config{}, testStreamContextCancel},
+		{"DestroyIdempotent", Config{}, testDestroyIdempotent},
+		{"Headers", Config{}, testHeaders},
+		{"MessageCopies", Config{}, testMessageCopies},
+		{"DeadLetter", Config{TTL: time.Millisecond, MaxAttempts: 2}, testDeadLetter},
+		{"NackBackoff", Config{Backoff: gq.FixedBackoff(100 * time.Millisecond)}, testNackBackoff},
+		{"DelayedDelivery", Config{}, testDelayedDelivery},
+		{"IdempotentPublish", Config{DedupWindow: 1500 * time.Millisecond}, testIdempotentPublish},
+		{"ExtendLease", Config{TTL: TTL}, testExtendLease},
+		{"OrderingKey", Config{}, testOrderingKey},
+		{"Priority", Config{}, testPriority},
+		{"PriorityAging", Config{Aging: 500 * time.Millisecond}, testPriorityAging},
+		{"Stats", Config{TTL: TTL}, testStats},
+		{"Browse", Config{}, testBrowse},
+		{"ExportImport", Config{}, func(t *testing.T, q gq.MQ) { testExportImport(t, q, factory) }},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			q := create(t, factory, tc.cfg)
+			defer q.Destroy()
+			tc.test(t, q)
+		})
+	}
+}
+
+// create ... Created queue from the factory, the test is skipped when the factory does
+// not support the settings
+func create(t *testing.T, factory Factory, cfg Config) gq.MQ {
+	q := factory(t, cfg)
+	if q == nil {
+		t.Skip("queue does not support the settings")
+	}
+	if err := q.Create(); err != nil {
+		t.Fatalf("Could not create the queue %s", err)
+	}
+	return q
+}
+
+// publish ... Publishes size messages with the payloads 0 to size - 1
+func publish(t *testing.T, q gq.MQ, size int) {
+	messages := make([]*gq.Message, size)
+	for i := range messages {
+		messages[i] = &gq.Message{Payload: []byte(fmt.Sprintf("%d", i))}
+	}
+	if err := q.Publish(messages); err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+}
+
+// consume ... Consumes a batch failing the test on an error
+func consume(t *testing.T, q gq.MQ, size int) []*gq.ConsumerMessage {
+	ms, err := q.ConsumeBatch(size)
+	if err != nil {
+		t.Fatalf("Failed to consume %s", err)
+	}
+	return ms
+}
+
+// commit ... Commits a receipt for each message with the success
+func commit(t *testing.T, q gq.MQ, ms []*gq.ConsumerMessage, success bool) {
+	receipts := make([]*gq.Receipt, len(ms))
+	for i, m := range ms {
+		receipts[i] = &gq.Receipt{Id: m.Id, Success: success, Topic: m.Topic}
+	}
+	if err := q.Commit(receipts); err != nil {
+		t.Fatalf("Failed to commit %s", err)
+	}
+}
+
+// Messages are delivered once each in publish order across batches
+func testOrder(t *testing.T, q gq.MQ) {
+	publish(t, q, 20)
+	next := 0
+	for {
+		ms := consume(t, q, 7)
+		if len(ms) == 0 {
+			break
+		}
+		for _, m := range ms {
+			if string(m.Payload) != fmt.Sprintf("%d", next) {
+				t.Fatalf("Expected payload %d got %s", next, m.Payload)
+			}
+			if m.Attempts != 1 {
+				t.Errorf("Expected the first attempt for %s got %d", m.Payload, m.Attempts)
+			}
+			next++
+		}
+		commit(t, q, ms, true)
+	}
+	if next != 20 {
+		t.Errorf("Expected 20 messages got %d", next)
+	}
+}
+
+// Checked out messages are delivered again once the TTL passes
+func testTTLRedelivery(t *testing.T, q gq.MQ) {
+	publish(t, q, 1)
+	ms := consume(t, q, 1)
+	if len(ms) != 1 {
+		t.Fatalf("Expected 1 message got %d", len(ms))
+	}
+	if again := consume(t, q, 1); len(again) != 0 {
+		t.Fatalf("Expected no delivery within the TTL got %d", len(again))
+	}
+	time.Sleep(2 * TTL)
+	again := consume(t, q, 1)
+	if len(again) != 1 || again[0].Id != ms[0].Id || again[0].Attempts != 2 {
+		t.Fatalf("Expected message %d on its second attempt got %+v", ms[0].Id, again)
+	}
+	commit(t, q, again, true)
+	if ms = consume(t, q, 1); len(ms) != 0 {
+		t.Errorf("Expected an empty queue after commit got %d", len(ms))
+	}
+}
+
+// Receipts for some of a batch leave the rest checked out
+func testPartialCommit(t *testing.T, q gq.MQ) {
+	publish(t, q, 3)
+	ms := consume(t, q, 3)
+	if len(ms) != 3 {
+		t.Fatalf("Expected 3 messages got %d", len(ms))
+	}
+	commit(t, q, ms[:1], false)
+	commit(t, q, ms[1:2], true)
+	again := consume(t, q, 3)
+	if len(again) != 1 || again[0].Id != ms[0].Id {
+		t.Fatalf("Expected only the failed message %d got %+v", ms[0].Id, again)
+	}
+	commit(t, q, append(again, ms[2]), true)
+	if again = consume(t, q, 3); len(again) != 0 {
+		t.Errorf("Expected an empty queue got %d", len(again))
+	}
+}
+
+// Committing nothing or messages that do not exist is not an error
+func testEmptyCommit(t *testing.T, q gq.MQ) {
+	if err := q.Commit(nil); err != nil {
+		t.Errorf("Expected no error committing nil got %s", err)
+	}
+	if err := q.Commit([]*gq.Receipt{}); err != nil {
+		t.Errorf("Expected no error committing no receipts got %s", err)
+	}
+	missing := []*gq.Receipt{&gq.Receipt{Id: 1 << 40, Success: true}, &gq.Receipt{Id: 1<<40 + 1, Success: false, Error: "failed"}}
+	if err := q.Commit(missing); err != nil {
+		t.Errorf("Expected no error committing missing messages got %s", err)
+	}
+}
+
+// Consumers running at the same time never receive the same message
+func testConcurrentConsumers(t *testing.T, q gq.MQ) {
+	size := 200
+	publish(t, q, size)
+	var mutex sync.Mutex
+	seen := make(map[int64]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				ms, err := q.ConsumeBatch(5)
+				if err != nil {
+					t.Errorf("Failed to consume %s", err)
+					return
+				}
+				if len(ms) == 0 {
+					return
+				}
+				mutex.Lock()
+				for _, m := range ms {
+					if seen[m.Id] {
+						t.Errorf("Message %d delivered twice", m.Id)
+					}
+					seen[m.Id] = true
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(seen) != size {
+		t.Errorf("Expected %d messages got %d", size, len(seen))
+	}
+}
+
+// Stream delivers published messages and closes the channel once stopped
+func testStreamShutdown(t *testing.T, q gq.MQ) {
+	publish(t, q, 5)
+	messages := make(chan []*gq.ConsumerMessage)
+	go q.Stream(2, messages, 10*time.Millisecond)
+	received := 0
+	for received < 5 {
+		select {
+		case ms := <-messages:
+			received += len(ms)
+			commit(t, q, ms, true)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out after %d messages", received)
+		}
+	}
+	q.StopConsumer()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-messages:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Expected the stream to close after StopConsumer")
+		}
+	}
+}
+
+// A batch the stream checked out but could not hand over before the context was
+// cancelled is available again straight away even without a TTL
+func testStreamCancel(t *testing.T, q gq.MQ) {
+	cq, ok := q.(gq.ContextMQ)
+	if !ok {
+		t.Skip("queue does not implement gq.ContextMQ")
+	}
+	publish(t, q, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	messages := make(chan []*gq.ConsumerMessage)
+	go cq.StreamContext(ctx, 1, messages, 10*time.Millisecond)
+	// Nothing reads so the stream blocks holding the batch
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case _, ok := <-messages:
+		if ok {
+			t.Fatal("Expected the stream to close without sending after the cancel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the stream to close after the cancel")
+	}
+	ms := consume(t, q, 1)
+	if len(ms) != 1 || ms[0].Attempts != 1 {
+		t.Errorf("Expected the batch back with no attempt counted got %+v", ms)
+	}
+}
+
+// Destroy can be called more than once and the queue can be created again after
+func testDestroyIdempotent(t *testing.T, q gq.MQ) {
+	publish(t, q, 1)
+	for i := 0; i < 2; i++ {
+		if err := q.Destroy(); err != nil {
+			t.Fatalf("Expected destroy %d to succeed got %s", i+1, err)
+		}
+	}
+	if err := q.Create(); err != nil {
+		t.Fatalf("Could not create the queue again %s", err)
+	}
+	if ms := consume(t, q, 1); len(ms) != 0 {
+		t.Errorf("Expected destroy to remove the messages got %d", len(ms))
+	}
+	publish(t, q, 1)
+	if ms := consume(t, q, 1); len(ms) != 1 {
+		t.Errorf("Expected the recreated queue to work got %d messages", len(ms))
+	}
+}
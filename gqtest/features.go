@@ -0,0 +1,501 @@
+package gqtest
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lateefj/gq"
+)
+
+// payloads ... Payloads of the messages separated by spaces
+func payloads(ms []*gq.ConsumerMessage) string {
+	s := ""
+	for _, m := range ms {
+		s += string(m.Payload) + " "
+	}
+	return s
+}
+
+// Cancelling the context ends the stream without StopConsumer
+func testStreamContextCancel(t *testing.T, q gq.MQ) {
+	cq, ok := q.(gq.ContextMQ)
+	if !ok {
+		t.Skip("queue does not implement gq.ContextMQ")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := make(chan []*gq.ConsumerMessage)
+	done := make(chan struct{})
+	go func() {
+		cq.StreamContext(ctx, 1, stream, 10*time.Millisecond)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Stream did not stop after the context was cancelled")
+	}
+	if _, more := <-stream; more {
+		t.Errorf("Expected stream channel to be closed")
+	}
+	err := cq.PublishContext(ctx, []*gq.Message{&gq.Message{Payload: []byte("test")}})
+	if err == nil {
+		t.Errorf("Expected publish with a cancelled context to fail")
+	}
+}
+
+// Headers are delivered with the message along with the delivery metadata
+func testHeaders(t *testing.T, q gq.MQ) {
+	headers := map[string]string{"content-type": "text/plain", "trace-id": "abc123"}
+	err := q.Publish([]*gq.Message{&gq.Message{Payload: []byte("test"), Headers: headers}})
+	if err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+	ms := consume(t, q, 1)
+	if len(ms) != 1 {
+		t.Fatalf("Expected 1 message however got %d", len(ms))
+	}
+	m := ms[0]
+	for k, v := range headers {
+		if m.Headers[k] != v {
+			t.Errorf("Expected header %s to be %s however was %s", k, v, m.Headers[k])
+		}
+	}
+	if m.Attempts != 1 {
+		t.Errorf("Expected attempts to be 1 however was %d", m.Attempts)
+	}
+	if m.Timestamp.IsZero() || m.Checkout.IsZero() {
+		t.Errorf("Expected timestamp and checkout to be set however was %s and %s", m.Timestamp, m.Checkout)
+	}
+}
+
+// Changing the buffers of a published or consumed message does not change the message
+// in the queue
+func testMessageCopies(t *testing.T, q gq.MQ) {
+	m := &gq.Message{Payload: []byte("test"), Headers: map[string]string{"k": "v"}}
+	if err := q.Publish([]*gq.Message{m}); err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+	m.Payload[0] = 'x'
+	m.Headers["k"] = "x"
+	unchanged := func(ms []*gq.ConsumerMessage, when string) {
+		if len(ms) != 1 {
+			t.Fatalf("Expected 1 message %s got %d", when, len(ms))
+		}
+		if string(ms[0].Payload) != "test" || ms[0].Headers["k"] != "v" {
+			t.Fatalf("Expected the message unchanged %s got %s %v", when, ms[0].Payload, ms[0].Headers)
+		}
+		ms[0].Payload[0] = 'x'
+		ms[0].Headers["k"] = "x"
+	}
+	if b, ok := q.(gq.Browser); ok {
+		ms, err := b.Browse(context.Background(), gq.BrowseOptions{})
+		if err != nil {
+			t.Fatalf("Failed to browse %s", err)
+		}
+		unchanged(ms, "when browsed")
+	}
+	ms := consume(t, q, 1)
+	unchanged(ms, "after publish")
+	commit(t, q, ms, false)
+	unchanged(consume(t, q, 1), "after consume")
+}
+
+// A message that fails every attempt is dead lettered and can be requeued
+func testDeadLetter(t *testing.T, q gq.MQ) {
+	dq, ok := q.(gq.DeadLetterQueue)
+	if !ok {
+		t.Skip("queue does not implement gq.DeadLetterQueue")
+	}
+	ctx := context.Background()
+	err := q.Publish([]*gq.Message{&gq.Message{Payload: []byte("test")}})
+	if err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+	for i, reason := range []string{"first failure", "second failure"} {
+		ms := consume(t, q, 1)
+		if len(ms) != 1 {
+			t.Fatalf("Expected 1 message on attempt %d got %d", i+1, len(ms))
+		}
+		err = q.Commit([]*gq.Receipt{&gq.Receipt{Id: ms[0].Id, Success: false, Error: reason}})
+		if err != nil {
+			t.Fatalf("Error committing the receipts %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ms := consume(t, q, 1); len(ms) != 0 {
+		t.Fatalf("Expected dead lettered message not to be delivered got %d", len(ms))
+	}
+
+	ds, err := dq.DeadLetters(ctx, 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to list dead letters %s", err)
+	}
+	if len(ds) != 1 {
+		t.Fatalf("Expected 1 dead letter got %d", len(ds))
+	}
+	d, err := dq.DeadLetter(ctx, ds[0].Id)
+	if err != nil {
+		t.Fatalf("Failed to get dead letter %s", err)
+	}
+	if d.Error != "second failure" || d.Attempts != 2 || string(d.Payload) != "test" {
+		t.Errorf("Unexpected dead letter error %s attempts %d payload %s", d.Error, d.Attempts, d.Payload)
+	}
+	if _, err = dq.DeadLetter(ctx, d.Id+1000); err != gq.ErrNotFound {
+		t.Errorf("Expected ErrNotFound got %v", err)
+	}
+
+	moved, err := dq.RequeueDeadLetters(ctx, []int64{d.Id, d.Id + 1000})
+	if err != nil {
+		t.Fatalf("Failed to requeue dead letter %s", err)
+	}
+	if moved != 1 {
+		t.Errorf("Expected 1 dead letter requeued got %d", moved)
+	}
+	requeued := consume(t, q, 1)
+	if len(requeued) != 1 || requeued[0].Id != d.Id {
+		t.Fatalf("Expected the requeued message got %+v", requeued)
+	}
+	if requeued[0].Attempts != 1 {
+		t.Errorf("Expected attempts to be reset however was %d", requeued[0].Attempts)
+	}
+	commit(t, q, requeued, true)
+	if err = dq.PurgeDeadLetters(ctx); err != nil {
+		t.Fatalf("Failed to purge dead letters %s", err)
+	}
+}
+
+// A failed receipt releases the message for retry after the backoff
+func testNackBackoff(t *testing.T, q gq.MQ) {
+	publish(t, q, 1)
+	ms := consume(t, q, 1)
+	if len(ms) != 1 {
+		t.Fatalf("Expected 1 message got %d", len(ms))
+	}
+	err := q.Commit([]*gq.Receipt{&gq.Receipt{Id: ms[0].Id, Success: false, Error: "failed"}})
+	if err != nil {
+		t.Fatalf("Error committing the receipts %s", err)
+	}
+	// Still within the backoff so nothing to consume
+	if again := consume(t, q, 1); len(again) != 0 {
+		t.Fatalf("Expected no messages during the backoff got %d", len(again))
+	}
+	time.Sleep(200 * time.Millisecond)
+	again := consume(t, q, 1)
+	if len(again) != 1 {
+		t.Fatalf("Expected message after the backoff got %d", len(again))
+	}
+	if again[0].Attempts != 2 {
+		t.Errorf("Expected 2 attempts however was %d", again[0].Attempts)
+	}
+	commit(t, q, again, true)
+}
+
+// A delayed message is not delivered before its time
+func testDelayedDelivery(t *testing.T, q gq.MQ) {
+	messages := []*gq.Message{
+		&gq.Message{Payload: []byte("later"), NotBefore: time.Now().Add(200 * time.Millisecond)},
+		&gq.Message{Payload: []byte("now")},
+	}
+	if err := q.Publish(messages); err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+	first := consume(t, q, len(messages))
+	if payloads(first) != "now " {
+		t.Fatalf("Expected only the immediate message got %s", payloads(first))
+	}
+	time.Sleep(300 * time.Millisecond)
+	second := consume(t, q, len(messages))
+	if payloads(second) != "later " {
+		t.Fatalf("Expected the delayed message got %s", payloads(second))
+	}
+	commit(t, q, append(first, second...), true)
+}
+
+// A retried publish with the same idempotency key is dropped until the window passes
+func testIdempotentPublish(t *testing.T, q gq.MQ) {
+	messages := []*gq.Message{
+		&gq.Message{Payload: []byte("a"), IdempotencyKey: "order-1"},
+		&gq.Message{Payload: []byte("b"), IdempotencyKey: "order-1"},
+		&gq.Message{Payload: []byte("c")},
+	}
+	for i := 0; i < 2; i++ {
+		if err := q.Publish(messages); err != nil {
+			t.Fatalf("Failed to publish %s", err)
+		}
+	}
+	// The keyed message once and the message without a key each time
+	consumed := consume(t, q, 10)
+	if payloads(consumed) != "a c c " {
+		t.Fatalf("Expected the first message with the key kept once got %s", payloads(consumed))
+	}
+	time.Sleep(2 * time.Second)
+	if err := q.Publish(messages[:1]); err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+	if again := consume(t, q, 10); len(again) != 1 {
+		t.Fatalf("Expected the key to be reusable after the window got %d messages", len(again))
+	}
+}
+
+// An extended lease holds a message past the TTL and a message TTL overrides the queue
+func testExtendLease(t *testing.T, q gq.MQ) {
+	e, ok := q.(gq.Extender)
+	if !ok {
+		t.Skip("queue does not implement gq.Extender")
+	}
+	messages := []*gq.Message{
+		&gq.Message{Payload: []byte("queue ttl")},
+		&gq.Message{Payload: []byte("message ttl"), TTL: time.Second},
+	}
+	if err := q.Publish(messages); err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+	consumed := consume(t, q, 10)
+	if len(consumed) != 2 {
+		t.Fatalf("Expected 2 messages got %d", len(consumed))
+	}
+	if consumed[1].TTL != time.Second {
+		t.Errorf("Expected the message TTL to be returned got %s", consumed[1].TTL)
+	}
+	err := e.Extend(context.Background(), consumed[:1], 600*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to extend %s", err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	// Past the queue TTL but the lease and the message TTL still hold
+	if held := consume(t, q, 10); len(held) != 0 {
+		t.Fatalf("Expected no messages while leased got %d", len(held))
+	}
+	time.Sleep(800 * time.Millisecond)
+	expired := consume(t, q, 10)
+	if len(expired) != 2 {
+		t.Fatalf("Expected both messages once the lease and TTL passed got %d", len(expired))
+	}
+	// A stale checkout no longer holds a message that has been checked out again
+	if err = e.Extend(context.Background(), consumed[:1], 2*time.Second); err != nil {
+		t.Fatalf("Failed to extend %s", err)
+	}
+	time.Sleep(TTL + 100*time.Millisecond)
+	if again := consume(t, q, 10); len(again) != 1 || string(again[0].Payload) != "queue ttl" {
+		t.Fatalf("Expected the stale extension to be ignored got %s", payloads(again))
+	}
+}
+
+// Messages with the same ordering key are delivered one at a time in order
+func testOrderingKey(t *testing.T, q gq.MQ) {
+	messages := []*gq.Message{
+		&gq.Message{Payload: []byte("a1"), OrderingKey: "a"},
+		&gq.Message{Payload: []byte("a2"), OrderingKey: "a"},
+		&gq.Message{Payload: []byte("b1"), OrderingKey: "b"},
+		&gq.Message{Payload: []byte("c")},
+	}
+	if err := q.Publish(messages); err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+	first := consume(t, q, 10)
+	if payloads(first) != "a1 b1 c " {
+		t.Fatalf("Expected a1 b1 c got %s", payloads(first))
+	}
+	if first[0].OrderingKey != "a" {
+		t.Errorf("Expected the ordering key to be returned got %s", first[0].OrderingKey)
+	}
+	if blocked := consume(t, q, 10); len(blocked) != 0 {
+		t.Fatalf("Expected a2 to wait for a1 got %s", payloads(blocked))
+	}
+	// A failed head is retried before the rest of its key
+	commit(t, q, first[:1], false)
+	retry := consume(t, q, 10)
+	if payloads(retry) != "a1 " {
+		t.Fatalf("Expected a1 to be retried got %s", payloads(retry))
+	}
+	commit(t, q, retry, true)
+	if next := consume(t, q, 10); payloads(next) != "a2 " {
+		t.Fatalf("Expected a2 after a1 got %s", payloads(next))
+	}
+}
+
+// Higher priority messages are delivered first
+func testPriority(t *testing.T, q gq.MQ) {
+	messages := []*gq.Message{
+		&gq.Message{Payload: []byte("bulk")},
+		&gq.Message{Payload: []byte("reset"), Priority: 5},
+		&gq.Message{Payload: []byte("bulk")},
+	}
+	if err := q.Publish(messages); err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+	consumed := consume(t, q, 1)
+	if len(consumed) != 1 || string(consumed[0].Payload) != "reset" || consumed[0].Priority != 5 {
+		t.Fatalf("Expected the high priority message first got %v", consumed)
+	}
+	if rest := consume(t, q, 10); len(rest) != 2 {
+		t.Fatalf("Expected the 2 bulk messages got %d", len(rest))
+	}
+}
+
+// Waiting long enough outranks a slightly higher priority
+func testPriorityAging(t *testing.T, q gq.MQ) {
+	if err := q.Publish([]*gq.Message{&gq.Message{Payload: []byte("old")}}); err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+	time.Sleep(1600 * time.Millisecond)
+	if err := q.Publish([]*gq.Message{&gq.Message{Payload: []byte("new"), Priority: 1}}); err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+	if aged := consume(t, q, 1); payloads(aged) != "old " {
+		t.Fatalf("Expected the aged message first got %s", payloads(aged))
+	}
+}
+
+// Stats count each message state
+func testStats(t *testing.T, q gq.MQ) {
+	sq, ok := q.(gq.StatsQueue)
+	if !ok {
+		t.Skip("queue does not implement gq.StatsQueue")
+	}
+	messages := []*gq.Message{
+		&gq.Message{Payload: []byte("expired")},
+		&gq.Message{Payload: []byte("in flight"), TTL: 5 * time.Second},
+		&gq.Message{Payload: []byte("delayed"), NotBefore: time.Now().Add(time.Hour)},
+		&gq.Message{Payload: []byte("ready")},
+	}
+	if err := q.Publish(messages); err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+	if consumed := consume(t, q, 2); len(consumed) != 2 {
+		t.Fatalf("Expected 2 messages got %d", len(consumed))
+	}
+	time.Sleep(300 * time.Millisecond)
+	s, err := sq.Stats(context.Background(), false)
+	if err != nil {
+		t.Fatalf("Failed to get stats %s", err)
+	}
+	if s.Ready != 1 || s.InFlight != 1 || s.Expired != 1 || s.Delayed != 1 || s.Total != 4 || s.DeadLetters != 0 {
+		t.Errorf("Expected one message in each state got %+v", s)
+	}
+	if s.OldestAge < 300*time.Millisecond || s.OldestAge > time.Minute {
+		t.Errorf("Expected the oldest age to be about 300ms got %s", s.OldestAge)
+	}
+	if s.Bytes <= 0 {
+		t.Errorf("Expected a size got %d", s.Bytes)
+	}
+	r, ok := q.(gq.Restorer)
+	if !ok {
+		return
+	}
+	// A restored message keeps its publish time but gets a higher id
+	restored := []*gq.ConsumerMessage{&gq.ConsumerMessage{Message: gq.Message{Payload: []byte("restored")}, Metadata: gq.Metadata{Timestamp: time.Now().Add(-time.Hour)}}}
+	if err = r.Restore(context.Background(), restored); err != nil {
+		t.Fatalf("Failed to restore %s", err)
+	}
+	if s, err = sq.Stats(context.Background(), false); err != nil {
+		t.Fatalf("Failed to get stats %s", err)
+	}
+	if s.OldestAge < time.Hour || s.OldestAge > 2*time.Hour {
+		t.Errorf("Expected the oldest age to be about an hour got %s", s.OldestAge)
+	}
+}
+
+// Browsing filters by state and pages by id without checking messages out
+func testBrowse(t *testing.T, q gq.MQ) {
+	b, ok := q.(gq.Browser)
+	if !ok {
+		t.Skip("queue does not implement gq.Browser")
+	}
+	ctx := context.Background()
+	notBefore := time.Now().Add(time.Hour)
+	messages := []*gq.Message{
+		&gq.Message{Payload: []byte("in flight")},
+		&gq.Message{Payload: []byte("ready"), Headers: map[string]string{"type": "test"}},
+		&gq.Message{Payload: []byte("delayed"), NotBefore: notBefore},
+	}
+	if err := q.Publish(messages); err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+	if consumed := consume(t, q, 1); len(consumed) != 1 {
+		t.Fatalf("Expected 1 message got %d", len(consumed))
+	}
+
+	all, err := b.Browse(ctx, gq.BrowseOptions{})
+	if err != nil || len(all) != 3 {
+		t.Fatalf("Expected 3 messages got %d error %v", len(all), err)
+	}
+	if all[1].Headers["type"] != "test" {
+		t.Errorf("Expected headers on browsed message got %v", all[1].Headers)
+	}
+	if all[0].Attempts != 1 || all[0].Checkout.IsZero() {
+		t.Errorf("Expected checkout metadata on the in flight message got %+v", all[0].Metadata)
+	}
+	if d := all[2].NotBefore.Sub(notBefore); d > time.Second || d < -time.Second {
+		t.Errorf("Expected not before %s got %s", notBefore, all[2].NotBefore)
+	}
+	states := map[gq.MessageState]string{gq.StateInFlight: "in flight", gq.StateReady: "ready", gq.StateDelayed: "delayed"}
+	for state, payload := range states {
+		ms, err := b.Browse(ctx, gq.BrowseOptions{State: state})
+		if err != nil || len(ms) != 1 || string(ms[0].Payload) != payload {
+			t.Errorf("Expected %s for state %s got %d messages error %v", payload, state, len(ms), err)
+		}
+	}
+	page, err := b.Browse(ctx, gq.BrowseOptions{After: all[0].Id, Limit: 1})
+	if err != nil || len(page) != 1 || page[0].Id != all[1].Id {
+		t.Errorf("Expected the second message as the next page got %v error %v", page, err)
+	}
+	if _, err = b.Browse(ctx, gq.BrowseOptions{State: "bogus"}); err != gq.ErrInvalidState {
+		t.Errorf("Expected invalid state error got %v", err)
+	}
+	// Browsing does not check anything out
+	if ready := consume(t, q, 10); len(ready) != 1 {
+		t.Errorf("Expected the ready message to still be available got %d", len(ready))
+	}
+}
+
+// Messages exported from one queue import into another keeping their metadata
+func testExportImport(t *testing.T, q gq.MQ, factory Factory) {
+	source, ok := q.(gq.Browser)
+	if _, restorer := q.(gq.Restorer); !ok || !restorer {
+		t.Skip("queue does not implement gq.Browser and gq.Restorer")
+	}
+	ctx := context.Background()
+	messages := []*gq.Message{
+		&gq.Message{Payload: []byte{0, 1, 2, 255}, Headers: map[string]string{"type": "binary"}},
+		&gq.Message{Payload: []byte("ordered"), OrderingKey: "a", Priority: 5},
+	}
+	if err := q.Publish(messages); err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+	if consumed := consume(t, q, 1); len(consumed) != 1 {
+		t.Fatalf("Expected 1 message got %d", len(consumed))
+	}
+	var buf bytes.Buffer
+	n, err := gq.Export(ctx, source, &buf)
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 messages exported got %d error %v", n, err)
+	}
+	original, _ := source.Browse(ctx, gq.BrowseOptions{})
+
+	restored := create(t, factory, Config{})
+	defer restored.Destroy()
+	n, err = gq.Import(ctx, restored, &buf)
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 messages imported got %d error %v", n, err)
+	}
+	ms, err := restored.(gq.Browser).Browse(ctx, gq.BrowseOptions{})
+	if err != nil || len(ms) != 2 {
+		t.Fatalf("Expected 2 restored messages got %d error %v", len(ms), err)
+	}
+	for i, m := range ms {
+		o := original[i]
+		if !bytes.Equal(m.Payload, o.Payload) || m.Headers["type"] != o.Headers["type"] || m.OrderingKey != o.OrderingKey || m.Priority != o.Priority {
+			t.Errorf("Expected restored message %+v got %+v", o.Message, m.Message)
+		}
+		if !m.Timestamp.Equal(o.Timestamp) || m.Attempts != o.Attempts {
+			t.Errorf("Expected timestamp %s and %d attempts got %s and %d", o.Timestamp, o.Attempts, m.Timestamp, m.Attempts)
+		}
+		if !m.Checkout.IsZero() {
+			t.Errorf("Expected restored message %d to not be checked out", m.Id)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package gqtest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lateefj/gq"
+)
+
+// TopicQueue queue that keeps messages in named topics, Q is the type Topic returns
+// for a single topic
+type TopicQueue[Q gq.MQ] interface {
+	gq.MQ
+	Topic(name string) (Q, error)
+	PublishTopic(ctx context.Context, topic string, messages []*gq.Message) error
+	ConsumeTopics(ctx context.Context, topics []string, size int) ([]*gq.ConsumerMessage, error)
+	CommitTopics(ctx context.Context, recipts []*gq.Receipt) error
+	Topics(ctx context.Context) ([]string, error)
+	DeleteTopic(ctx context.Context, name string) error
+}
+
+// RunTopics runs the topic tests against queues from factory. Each call must return a
+// queue that shares no messages or topics with earlier ones, the suite calls Create
+// before a test and Destroy after it.
+func RunTopics[Q gq.MQ](t *testing.T, factory func(t *testing.T) TopicQueue[Q]) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, q TopicQueue[Q])
+	}{
+		{"Topics", testTopics[Q]},
+		{"TopicCreate", testTopicCreate[Q]},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			q := factory(t)
+			if err := q.Create(); err != nil {
+				t.Fatalf("Could not create the queue %s", err)
+			}
+			defer q.Destroy()
+			tc.test(t, q)
+		})
+	}
+}
+
+// Topics are listed, consumed and committed together and removed by name or by
+// destroying the topic queue
+func testTopics[Q gq.MQ](t *testing.T, q TopicQueue[Q]) {
+	ctx := context.Background()
+	err := q.PublishTopic(ctx, "orders", []*gq.Message{&gq.Message{Payload: []byte("order")}})
+	if err != nil {
+		t.Fatalf("Failed to publish to orders %s", err)
+	}
+	err = q.PublishTopic(ctx, "emails", []*gq.Message{&gq.Message{Payload: []byte("email")}})
+	if err != nil {
+		t.Fatalf("Failed to publish to emails %s", err)
+	}
+	err = q.PublishTopic(ctx, "Bad-Name", []*gq.Message{&gq.Message{Payload: []byte("bad")}})
+	if err != gq.ErrInvalidTopic {
+		t.Errorf("Expected ErrInvalidTopic got %v", err)
+	}
+	topics, err := q.Topics(ctx)
+	if err != nil {
+		t.Fatalf("Failed to list topics %s", err)
+	}
+	if len(topics) != 2 || topics[0] != "emails" || topics[1] != "orders" {
+		t.Errorf("Expected topics emails and orders got %v", topics)
+	}
+
+	consumed, err := q.ConsumeTopics(ctx, []string{"orders", "emails"}, 10)
+	if err != nil {
+		t.Fatalf("Failed to consume topics %s", err)
+	}
+	if len(consumed) != 2 {
+		t.Fatalf("Expected 2 messages got %d", len(consumed))
+	}
+	recipts := make([]*gq.Receipt, len(consumed))
+	for i, m := range consumed {
+		if m.Topic != map[string]string{"order": "orders", "email": "emails"}[string(m.Payload)] {
+			t.Errorf("Message %s has wrong topic %s", m.Payload, m.Topic)
+		}
+		recipts[i] = &gq.Receipt{Id: m.Id, Success: true, Topic: m.Topic}
+	}
+	err = q.CommitTopics(ctx, recipts)
+	if err != nil {
+		t.Fatalf("Failed to commit topics %s", err)
+	}
+	consumed, err = q.ConsumeTopics(ctx, []string{"orders", "emails"}, 10)
+	if err != nil {
+		t.Fatalf("Failed to consume topics %s", err)
+	}
+	if len(consumed) != 0 {
+		t.Errorf("Expected all topic messages committed got %d", len(consumed))
+	}
+
+	err = q.DeleteTopic(ctx, "emails")
+	if err != nil {
+		t.Fatalf("Failed to delete topic %s", err)
+	}
+	topics, err = q.Topics(ctx)
+	if err != nil || len(topics) != 1 {
+		t.Errorf("Expected 1 topic left got %v error %v", topics, err)
+	}
+	// Destroying the topic queue directly also removes it from the registry
+	orders, err := q.Topic("orders")
+	if err != nil {
+		t.Fatalf("Failed to get topic %s", err)
+	}
+	if err = orders.Destroy(); err != nil {
+		t.Fatalf("Failed to destroy topic %s", err)
+	}
+	topics, err = q.Topics(ctx)
+	if err != nil || len(topics) != 0 {
+		t.Errorf("Expected no topics left got %v error %v", topics, err)
+	}
+	// and it is created again on next use
+	err = q.PublishTopic(ctx, "orders", []*gq.Message{&gq.Message{Payload: []byte("order")}})
+	if err != nil {
+		t.Fatalf("Failed to publish to the recreated topic %s", err)
+	}
+}
+
+// A topic queue created directly is registered and destroyed with the queue
+func testTopicCreate[Q gq.MQ](t *testing.T, q TopicQueue[Q]) {
+	ctx := context.Background()
+	topics, err := q.Topics(ctx)
+	if err != nil || len(topics) != 0 {
+		t.Fatalf("Expected no topics got %v error %v", topics, err)
+	}
+	orders, err := q.Topic("orders")
+	if err != nil {
+		t.Fatalf("Failed to get topic %s", err)
+	}
+	if err = orders.Create(); err != nil {
+		t.Fatalf("Failed to create topic %s", err)
+	}
+	topics, err = q.Topics(ctx)
+	if err != nil || len(topics) != 1 || topics[0] != "orders" {
+		t.Fatalf("Expected the created topic to be listed got %v error %v", topics, err)
+	}
+	if err = q.Destroy(); err != nil {
+		t.Fatalf("Failed to destroy the queue %s", err)
+	}
+	if _, err = orders.ConsumeBatch(1); err == nil {
+		t.Errorf("Expected the topic tables to be dropped with the queue")
+	}
+	topics, err = q.Topics(ctx)
+	if err != nil || len(topics) != 0 {
+		t.Errorf("Expected no topics after destroy got %v error %v", topics, err)
+	}
+}
+
+// TxQueue queue that publishes and commits inside a caller transaction
+type TxQueue interface {
+	gq.MQ
+	gq.TxMQ
+}
+
+// RunTx runs the transaction tests against queues from factory that keep their tables
+// in db. Each call must return a queue that shares no messages with earlier ones, the
+// suite calls Create before a test and Destroy after it.
+func RunTx(t *testing.T, db *sql.DB, factory func(t *testing.T) TxQueue) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, db *sql.DB, q TxQueue)
+	}{
+		{"TransactionalPublish", testTransactionalPublish},
+		{"ConsumeTx", testConsumeTx},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			q := factory(t)
+			if err := q.Create(); err != nil {
+				t.Fatalf("Could not create the queue %s", err)
+			}
+			defer q.Destroy()
+			_, err := db.Exec("CREATE TABLE IF NOT EXISTS test_orders (name TEXT);")
+			if err != nil {
+				t.Fatalf("Could not create orders table %s", err)
+			}
+			defer db.Exec("DROP TABLE IF EXISTS test_orders;")
+			tc.test(t, db, q)
+		})
+	}
+}
+
+// Publish and commit inside a caller transaction land only when it commits
+func testTransactionalPublish(t *testing.T, db *sql.DB, q TxQueue) {
+	ctx := context.Background()
+	for _, committed := range []bool{false, true} {
+		txn, err := db.Begin()
+		if err != nil {
+			t.Fatalf("Failed to begin %s", err)
+		}
+		_, err = txn.Exec("INSERT INTO test_orders (name) VALUES ('order');")
+		if err != nil {
+			t.Fatalf("Failed to insert order %s", err)
+		}
+		err = q.PublishTx(ctx, txn, []*gq.Message{&gq.Message{Payload: []byte("order created")}})
+		if err != nil {
+			t.Fatalf("Failed to publish in transaction %s", err)
+		}
+		if committed {
+			err = txn.Commit()
+		} else {
+			err = txn.Rollback()
+		}
+		if err != nil {
+			t.Fatalf("Failed to end transaction %s", err)
+		}
+	}
+	var orders int
+	if err := db.QueryRow("SELECT COUNT(*) FROM test_orders;").Scan(&orders); err != nil || orders != 1 {
+		t.Fatalf("Expected 1 order got %d error %v", orders, err)
+	}
+	consumed, err := q.ConsumeBatch(10)
+	if err != nil || len(consumed) != 1 {
+		t.Fatalf("Expected only the committed message got %d error %v", len(consumed), err)
+	}
+
+	// Rolled back receipts leave the message in the queue
+	txn, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin %s", err)
+	}
+	err = q.CommitTx(ctx, txn, []*gq.Receipt{&gq.Receipt{Id: consumed[0].Id, Success: true}})
+	if err != nil {
+		t.Fatalf("Failed to commit receipts in transaction %s", err)
+	}
+	txn.Rollback()
+	commit(t, q, consumed, false)
+	if again := consume(t, q, 10); len(again) != 1 {
+		t.Fatalf("Expected the message to remain after rollback got %d", len(again))
+	}
+}
+
+// Handler writes and message removal commit or roll back together
+func testConsumeTx(t *testing.T, db *sql.DB, q TxQueue) {
+	ctx := context.Background()
+	err := q.Publish([]*gq.Message{&gq.Message{Payload: []byte("one")}, &gq.Message{Payload: []byte("two")}})
+	if err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+	process := func(fail bool) gq.TxHandler {
+		return func(ctx context.Context, txn *sql.Tx, messages []*gq.ConsumerMessage) error {
+			for _, m := range messages {
+				_, err := txn.ExecContext(ctx, fmt.Sprintf("INSERT INTO test_orders (name) VALUES ('%s');", m.Payload))
+				if err != nil {
+					return err
+				}
+			}
+			if fail {
+				return errors.New("payment declined")
+			}
+			return nil
+		}
+	}
+	countOrders := func() int {
+		var orders int
+		if err := db.QueryRow("SELECT COUNT(*) FROM test_orders;").Scan(&orders); err != nil {
+			t.Fatalf("Failed to count orders %s", err)
+		}
+		return orders
+	}
+
+	n, err := q.ConsumeTx(ctx, 10, process(true))
+	if n != 2 || err == nil || err.Error() != "payment declined" {
+		t.Fatalf("Expected 2 messages with the handler error got %d %v", n, err)
+	}
+	if orders := countOrders(); orders != 0 {
+		t.Fatalf("Expected the handler writes to roll back got %d orders", orders)
+	}
+	n, err = q.ConsumeTx(ctx, 10, process(false))
+	if n != 2 || err != nil {
+		t.Fatalf("Expected 2 messages to be handled got %d %v", n, err)
+	}
+	if orders := countOrders(); orders != 2 {
+		t.Fatalf("Expected 2 orders got %d", orders)
+	}
+	// Nothing left to redeliver
+	n, err = q.ConsumeTx(ctx, 10, process(false))
+	if n != 0 || err != nil {
+		t.Fatalf("Expected no messages got %d %v", n, err)
+	}
+}
+
+// GroupQueue queue that delivers every message to each of its consumer groups, G is the
+// type Group returns
+type GroupQueue[G gq.MQ] interface {
+	gq.MQ
+	Group(name string) G
+	Groups(ctx context.Context) ([]string, error)
+}
+
+// RunGroups runs the consumer group tests against queues from factory. Each call must
+// return a queue that shares no messages or groups with earlier ones, the suite calls
+// Create before a test and Destroy after it.
+func RunGroups[G gq.MQ](t *testing.T, factory func(t *testing.T) GroupQueue[G]) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, q GroupQueue[G])
+	}{
+		{"ConsumerGroups", testConsumerGroups[G]},
+		{"GroupOrderingKey", testGroupOrderingKey[G]},
+		{"GroupExpiry", testGroupExpiry[G]},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			q := factory(t)
+			if err := q.Create(); err != nil {
+				t.Fatalf("Could not create the queue %s", err)
+			}
+			defer q.Destroy()
+			tc.test(t, q)
+		})
+	}
+}
+
+// Each consumer group receives every message and it is removed once all have
+// acknowledged it
+func testConsumerGroups[G gq.MQ](t *testing.T, q GroupQueue[G]) {
+	ctx := context.Background()
+	names := []string{"billing", "audit"}
+	for _, name := range names {
+		if err := q.Group(name).Create(); err != nil {
+			t.Fatalf("Failed to create group %s %s", name, err)
+		}
+	}
+	groups, err := q.Groups(ctx)
+	if err != nil || len(groups) != 2 {
+		t.Fatalf("Expected 2 groups got %v error %v", groups, err)
+	}
+
+	messages := []*gq.Message{&gq.Message{Payload: []byte("one")}, &gq.Message{Payload: []byte("two")}}
+	err = q.Group("billing").Publish(messages)
+	if err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+	for i, name := range names {
+		g := q.Group(name)
+		consumed, err := g.ConsumeBatch(10)
+		if err != nil {
+			t.Fatalf("Group %s failed to consume %s", name, err)
+		}
+		if len(consumed) != len(messages) {
+			t.Fatalf("Group %s expected %d messages got %d", name, len(messages), len(consumed))
+		}
+		again, err := g.ConsumeBatch(10)
+		if err != nil || len(again) != 0 {
+			t.Fatalf("Group %s expected checked out messages not to be redelivered got %d error %v", name, len(again), err)
+		}
+		recipts := make([]*gq.Receipt, len(consumed))
+		for j, m := range consumed {
+			recipts[j] = &gq.Receipt{Id: m.Id, Success: true}
+		}
+		if err = g.Commit(recipts); err != nil {
+			t.Fatalf("Group %s failed to commit %s", name, err)
+		}
+		// Message stays until the last group acknowledges it
+		remaining := consume(t, q, 10)
+		last := i == len(names)-1
+		if !last && len(remaining) != len(messages) {
+			t.Errorf("Expected messages to remain until every group acknowledged got %d", len(remaining))
+		}
+		if last && len(remaining) != 0 {
+			t.Errorf("Expected messages removed after every group acknowledged got %d", len(remaining))
+		}
+		// Put back the ones the plain consumer checked out
+		commit(t, q, remaining, false)
+	}
+}
+
+// A group sees only the head of each ordering key like the queue
+func testGroupOrderingKey[G gq.MQ](t *testing.T, q GroupQueue[G]) {
+	messages := []*gq.Message{
+		&gq.Message{Payload: []byte("a1"), OrderingKey: "a"},
+		&gq.Message{Payload: []byte("a2"), OrderingKey: "a"},
+		&gq.Message{Payload: []byte("b1"), OrderingKey: "b"},
+		&gq.Message{Payload: []byte("c")},
+	}
+	if err := q.Publish(messages); err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+	audit := q.Group("audit")
+	if err := audit.Create(); err != nil {
+		t.Fatalf("Failed to create group %s", err)
+	}
+	grouped, err := audit.ConsumeBatch(10)
+	if err != nil || payloads(grouped) != "a1 b1 c " {
+		t.Fatalf("Expected the group to get a1 b1 c got %s error %v", payloads(grouped), err)
+	}
+}
+
+// Group checkouts expire with the message TTL at millisecond precision and a group
+// lease holds them past it
+func testGroupExpiry[G gq.MQ](t *testing.T, q GroupQueue[G]) {
+	g := q.Group("billing")
+	ext, ok := any(g).(gq.Extender)
+	if !ok {
+		t.Skip("group does not implement gq.Extender")
+	}
+	if err := g.Create(); err != nil {
+		t.Fatalf("Could not create group %s", err)
+	}
+	err := q.Publish([]*gq.Message{&gq.Message{Payload: []byte("test"), TTL: 50 * time.Millisecond}})
+	if err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+	first, err := g.ConsumeBatch(1)
+	if err != nil || len(first) != 1 {
+		t.Fatalf("Expected 1 message got %d error %v", len(first), err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	ms, err := g.ConsumeBatch(1)
+	if err != nil || len(ms) != 1 || ms[0].Attempts != 2 {
+		t.Fatalf("Expected the message again once its TTL passed got %+v error %v", ms, err)
+	}
+	// The first checkout is stale and extending it leaves the message alone
+	if err = ext.Extend(context.Background(), first, time.Second); err != nil {
+		t.Fatalf("Failed to extend %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	ms, err = g.ConsumeBatch(1)
+	if err != nil || len(ms) != 1 || ms[0].Attempts != 3 {
+		t.Fatalf("Expected the stale extension to be ignored got %+v error %v", ms, err)
+	}
+	if err = ext.Extend(context.Background(), ms, time.Second); err != nil {
+		t.Fatalf("Failed to extend %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	leased, err := g.ConsumeBatch(1)
+	if err != nil || len(leased) != 0 {
+		t.Fatalf("Expected nothing while the group lease holds got %d error %v", len(leased), err)
+	}
+	g.Commit([]*gq.Receipt{&gq.Receipt{Id: ms[0].Id, Success: true}})
+}
@@ -0,0 +1,45 @@
+package gq
+
+import (
+	"context"
+	"time"
+)
+
+// Extender queue that can extend the lease on checked out messages so a long
+// running handler does not have them delivered to another consumer
+type Extender interface {
+	// Hold the messages as returned by ConsumeBatch for lease from now, a message that
+	// has been checked out again since is left to its new consumer
+	Extend(ctx context.Context, ms []*ConsumerMessage, lease time.Duration) error
+}
+
+// Heartbeat ... Extends the lease on the messages by lease every interval until stop is
+// called or the context is done. Stop returns the last error from Extend, a failed
+// extension is retried on the next interval.
+func Heartbeat(ctx context.Context, q Extender, ms []*ConsumerMessage, lease, interval time.Duration) (stop func() error) {
+	ctx, cancel := context.WithCancel(ctx)
+	var err error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				e := q.Extend(ctx, ms, lease)
+				// An extension cut short by stop is not a failure
+				if ctx.Err() == nil {
+					err = e
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() error {
+		cancel()
+		<-done
+		return err
+	}
+}
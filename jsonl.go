@@ -0,0 +1,109 @@
+package gq
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// record one line of an export, payloads are base64 encoded by encoding/json
+type record struct {
+	Payload     []byte            `json:"payload"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Attempts    int               `json:"attempts"`
+	NotBefore   *time.Time        `json:"not_before,omitempty"`
+	TTL         time.Duration     `json:"ttl,omitempty"`
+	OrderingKey string            `json:"ordering_key,omitempty"`
+	Priority    int               `json:"priority,omitempty"`
+}
+
+// exportBatch messages read or written at a time
+const exportBatch = 1000
+
+// Export ... Writes every message in the queue to w as JSON Lines in id order without
+// checking them out. Returns the number of messages written.
+func Export(ctx context.Context, q Browser, w io.Writer) (int, error) {
+	encoder := json.NewEncoder(w)
+	total := 0
+	opts := BrowseOptions{Limit: exportBatch}
+	for {
+		ms, err := q.Browse(ctx, opts)
+		if err != nil || len(ms) == 0 {
+			return total, err
+		}
+		for _, m := range ms {
+			r := &record{
+				Payload:     m.Payload,
+				Headers:     m.Headers,
+				Timestamp:   m.Timestamp,
+				Attempts:    m.Attempts,
+				TTL:         m.TTL,
+				OrderingKey: m.OrderingKey,
+				Priority:    m.Priority,
+			}
+			if !m.NotBefore.IsZero() {
+				notBefore := m.NotBefore
+				r.NotBefore = &notBefore
+			}
+			if err = encoder.Encode(r); err != nil {
+				return total, err
+			}
+			total++
+		}
+		opts.After = ms[len(ms)-1].Id
+	}
+}
+
+// Import ... Publishes every message in the JSON Lines from r, usually written by Export.
+// When the queue is a Restorer the publish time and attempts are kept, otherwise the
+// messages are published as new. Returns the number of messages published.
+func Import(ctx context.Context, q MQ, r io.Reader) (int, error) {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	total := 0
+	batch := make([]*ConsumerMessage, 0, exportBatch)
+	for {
+		rec := &record{}
+		err := decoder.Decode(rec)
+		if err != nil && err != io.EOF {
+			return total, err
+		}
+		if err == nil {
+			m := &ConsumerMessage{
+				Message:  Message{Payload: rec.Payload, Headers: rec.Headers, TTL: rec.TTL, OrderingKey: rec.OrderingKey, Priority: rec.Priority},
+				Metadata: Metadata{Timestamp: rec.Timestamp, Attempts: rec.Attempts},
+			}
+			if rec.NotBefore != nil {
+				m.NotBefore = *rec.NotBefore
+			}
+			batch = append(batch, m)
+		}
+		if len(batch) == exportBatch || (err == io.EOF && len(batch) > 0) {
+			if perr := publishBatch(ctx, q, batch); perr != nil {
+				return total, perr
+			}
+			total += len(batch)
+			batch = batch[:0]
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+	}
+}
+
+// publishBatch ... Restores the batch when the queue supports it otherwise publishes it
+func publishBatch(ctx context.Context, q MQ, batch []*ConsumerMessage) error {
+	if r, ok := q.(Restorer); ok {
+		return r.Restore(ctx, batch)
+	}
+	messages := make([]*Message, len(batch))
+	for i, m := range batch {
+		messages[i] = &m.Message
+	}
+	if cq, ok := q.(ContextMQ); ok {
+		return cq.PublishContext(ctx, messages)
+	}
+	return q.Publish(messages)
+}
@@ -0,0 +1,71 @@
+package gq
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// browseMQ keeps published messages so they can be browsed, it is not a Restorer
+type browseMQ struct {
+	sliceMQ
+	published []*Message
+}
+
+func (q *browseMQ) Publish(messages []*Message) error {
+	q.published = append(q.published, messages...)
+	return nil
+}
+
+func (q *browseMQ) Browse(ctx context.Context, opts BrowseOptions) ([]*ConsumerMessage, error) {
+	ms := make([]*ConsumerMessage, 0)
+	for i, m := range q.published {
+		id := int64(i + 1)
+		if id > opts.After && len(ms) < opts.Limit {
+			ms = append(ms, &ConsumerMessage{Id: id, Message: *m})
+		}
+	}
+	return ms, nil
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	notBefore := time.Now().Add(time.Hour).UTC()
+	source := &browseMQ{}
+	source.Publish([]*Message{
+		&Message{Payload: []byte("one\nline"), Headers: map[string]string{"type": "test"}},
+		&Message{Payload: []byte{0, 255}, NotBefore: notBefore, TTL: time.Minute, OrderingKey: "a", Priority: 3},
+	})
+	for i := 0; i < exportBatch; i++ {
+		source.Publish([]*Message{&Message{Payload: []byte("bulk")}})
+	}
+	var buf bytes.Buffer
+	n, err := Export(ctx, source, &buf)
+	if err != nil || n != exportBatch+2 {
+		t.Fatalf("Expected %d messages exported got %d error %v", exportBatch+2, n, err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != n {
+		t.Fatalf("Expected a line per message got %d", lines)
+	}
+
+	target := &browseMQ{}
+	n, err = Import(ctx, target, &buf)
+	if err != nil || n != exportBatch+2 {
+		t.Fatalf("Expected %d messages imported got %d error %v", exportBatch+2, n, err)
+	}
+	first, second := target.published[0], target.published[1]
+	if string(first.Payload) != "one\nline" || first.Headers["type"] != "test" {
+		t.Errorf("Expected the first message with headers got %+v", first)
+	}
+	if !bytes.Equal(second.Payload, []byte{0, 255}) || !second.NotBefore.Equal(notBefore) || second.TTL != time.Minute ||
+		second.OrderingKey != "a" || second.Priority != 3 {
+		t.Errorf("Expected the second message options kept got %+v", second)
+	}
+
+	_, err = Import(ctx, target, strings.NewReader("{bogus\n"))
+	if err == nil {
+		t.Error("Expected invalid JSON to fail the import")
+	}
+}
@@ -0,0 +1,81 @@
+package liteq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lateefj/gq"
+)
+
+// Purge ... Removes every message and the consumer group progress on them, dead letters are kept
+func (l *Liteq) Purge(ctx context.Context) error {
+	txn, err := l.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = txn.ExecContext(ctx, fmt.Sprintf("DELETE FROM %sacks;", l.Prefix))
+	if err == nil {
+		_, err = txn.ExecContext(ctx, fmt.Sprintf("DELETE FROM %sq;", l.Prefix))
+	}
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+// ReleaseCheckouts ... Makes checked out messages available again, those checked out longer
+// than olderThan or when it is 0 those past their TTL. Use it for messages stuck with a
+// consumer that died when the queue has no TTL.
+func (l *Liteq) ReleaseCheckouts(ctx context.Context, olderThan time.Duration) (int64, error) {
+	condition := l.expired("", "")
+	var args []interface{}
+	if olderThan > 0 {
+		condition = "checkout < ?"
+		args = append(args, time.Now().UTC().Add(-olderThan).Format(timeFormatSqlite))
+	}
+	q := fmt.Sprintf("UPDATE %sq SET checkout = NULL, lease_until = NULL WHERE checkout IS NOT null AND %s;", l.Prefix, condition)
+	res, err := l.DB.ExecContext(ctx, q, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Restore ... Publishes messages keeping their publish time and attempts, ids are
+// assigned by the queue. Idempotency keys are not checked.
+func (l *Liteq) Restore(ctx context.Context, messages []*gq.ConsumerMessage) error {
+	txn, err := l.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	q := fmt.Sprintf(`INSERT INTO %sq (payload, headers, ttl, ordering_key, priority, attempts, timestamp, visible_at)
+VALUES (?, ?, ?, ?, ?, ?, COALESCE(?, CURRENT_TIMESTAMP), COALESCE(?, CURRENT_TIMESTAMP));`, l.Prefix)
+	stmt, err := txn.PrepareContext(ctx, q)
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, m := range messages {
+		headers, err := encodeHeaders(m.Headers)
+		if err == nil {
+			_, err = stmt.ExecContext(ctx, m.Payload, headers, ttlMs(m.TTL), orderingKey(m.OrderingKey), m.Priority, m.Attempts,
+				optionalTime(m.Timestamp), optionalTime(m.NotBefore))
+		}
+		if err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+// optionalTime ... Value for a time column or nil when it is not set
+func optionalTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(timeFormatSqlite)
+}
@@ -0,0 +1,78 @@
+package liteq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lateefj/gq"
+)
+
+// state ... Condition for messages in the state
+func (l *Liteq) state(state gq.MessageState) (string, error) {
+	switch state {
+	case gq.StateAll:
+		return "1", nil
+	case gq.StateReady:
+		return fmt.Sprintf("checkout IS null AND visible_at <= %s", TimeWithMsSqlite), nil
+	case gq.StateInFlight:
+		return fmt.Sprintf("checkout IS NOT null AND NOT COALESCE((%s), 0)", l.expired("", "")), nil
+	case gq.StateExpired:
+		return fmt.Sprintf("checkout IS NOT null AND COALESCE((%s), 0)", l.expired("", "")), nil
+	case gq.StateDelayed:
+		return fmt.Sprintf("checkout IS null AND visible_at > %s", TimeWithMsSqlite), nil
+	}
+	return "", gq.ErrInvalidState
+}
+
+// Browse ... Messages ordered by id without checking them out, delayed messages have
+// NotBefore set to when they become visible
+func (l *Liteq) Browse(ctx context.Context, opts gq.BrowseOptions) ([]*gq.ConsumerMessage, error) {
+	ms := make([]*gq.ConsumerMessage, 0)
+	condition, err := l.state(opts.State)
+	if err != nil {
+		return ms, err
+	}
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	args := []interface{}{opts.After}
+	if !opts.Since.IsZero() {
+		condition = fmt.Sprintf("%s AND timestamp >= ?", condition)
+		// Published times only have second precision
+		args = append(args, opts.Since.UTC().Format("2006-01-02 15:04:05"))
+	}
+	args = append(args, limit)
+	q := fmt.Sprintf(`SELECT id, payload, headers, timestamp, checkout, attempts, ttl, ordering_key, priority,
+	CASE WHEN visible_at > %s THEN visible_at END
+FROM %sq WHERE id > ? AND %s ORDER BY id ASC LIMIT ?;`, TimeWithMsSqlite, l.Prefix, condition)
+	rows, err := l.DB.QueryContext(ctx, q, args...)
+	if err != nil {
+		return ms, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m := &gq.ConsumerMessage{}
+		var headers sql.NullString
+		var timestamp, checkout, notBefore sqliteTime
+		var ttl sql.NullInt64
+		var key sql.NullString
+		err = rows.Scan(&m.Id, &m.Payload, &headers, &timestamp, &checkout, &m.Attempts, &ttl, &key, &m.Priority, &notBefore)
+		if err == nil {
+			m.Headers, err = decodeHeaders(headers)
+		}
+		if err != nil {
+			return make([]*gq.ConsumerMessage, 0), err
+		}
+		m.Timestamp = timestamp.Time
+		m.Checkout = checkout.Time
+		m.NotBefore = notBefore.Time
+		m.TTL = time.Duration(ttl.Int64) * time.Millisecond
+		m.OrderingKey = key.String
+		m.Topic = l.topic
+		ms = append(ms, m)
+	}
+	return ms, rows.Err()
+}
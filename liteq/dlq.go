@@ -0,0 +1,90 @@
+package liteq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lateefj/gq"
+)
+
+const deadLetterColumns = "id, timestamp, checkout, attempts, headers, payload, last_error, dead_at"
+
+// scanDeadLetter ... Reads a row of deadLetterColumns
+func scanDeadLetter(row interface{ Scan(...interface{}) error }) (*gq.DeadLetter, error) {
+	d := &gq.DeadLetter{}
+	var timestamp, checkout, deadAt sqliteTime
+	var headers, lastError sql.NullString
+	err := row.Scan(&d.Id, &timestamp, &checkout, &d.Attempts, &headers, &d.Payload, &lastError, &deadAt)
+	if err != nil {
+		return nil, err
+	}
+	d.Timestamp = timestamp.Time
+	d.Checkout = checkout.Time
+	d.DeadAt = deadAt.Time
+	d.Error = lastError.String
+	d.Headers, err = decodeHeaders(headers)
+	return d, err
+}
+
+// DeadLetters ... List dead letters with an id greater than after
+func (l *Liteq) DeadLetters(ctx context.Context, after int64, limit int) ([]*gq.DeadLetter, error) {
+	ds := make([]*gq.DeadLetter, 0)
+	q := fmt.Sprintf("SELECT %s FROM %sdlq WHERE id > ? ORDER BY id ASC LIMIT ?;", deadLetterColumns, l.Prefix)
+	rows, err := l.DB.QueryContext(ctx, q, after, limit)
+	if err != nil {
+		return ds, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d, err := scanDeadLetter(rows)
+		if err != nil {
+			return ds, err
+		}
+		ds = append(ds, d)
+	}
+	return ds, rows.Err()
+}
+
+// DeadLetter ... Inspect a single dead letter
+func (l *Liteq) DeadLetter(ctx context.Context, id int64) (*gq.DeadLetter, error) {
+	q := fmt.Sprintf("SELECT %s FROM %sdlq WHERE id = ?;", deadLetterColumns, l.Prefix)
+	d, err := scanDeadLetter(l.DB.QueryRowContext(ctx, q, id))
+	if err == sql.ErrNoRows {
+		return nil, gq.ErrNotFound
+	}
+	return d, err
+}
+
+// RequeueDeadLetters ... Moves dead letters back into the queue with the attempts reset
+func (l *Liteq) RequeueDeadLetters(ctx context.Context, ids []int64) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	txn, err := l.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	in, args := placeholders(ids)
+	q := fmt.Sprintf(`INSERT INTO %[1]sq (id, timestamp, headers, payload, last_error, ttl, ordering_key, priority)
+SELECT id, timestamp, headers, payload, last_error, ttl, ordering_key, priority FROM %[1]sdlq WHERE id IN (%[2]s);`, l.Prefix, in)
+	var moved int64
+	result, err := txn.ExecContext(ctx, q, args...)
+	if err == nil {
+		moved, err = result.RowsAffected()
+	}
+	if err == nil {
+		_, err = txn.ExecContext(ctx, fmt.Sprintf("DELETE FROM %sdlq WHERE id IN (%s);", l.Prefix, in), args...)
+	}
+	if err != nil {
+		txn.Rollback()
+		return 0, err
+	}
+	return moved, txn.Commit()
+}
+
+// PurgeDeadLetters ... Removes all dead letters
+func (l *Liteq) PurgeDeadLetters(ctx context.Context) error {
+	_, err := l.DB.ExecContext(ctx, fmt.Sprintf("DELETE FROM %sdlq;", l.Prefix))
+	return err
+}
@@ -0,0 +1,77 @@
+package liteq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// checked databases that passed CheckDriver so Create and every topic does not check again
+var checked sync.Map
+
+// checkDriverOnce ... CheckDriver the first time the database is seen, a failed check is
+// tried again on the next call
+func checkDriverOnce(ctx context.Context, db *sql.DB) error {
+	if _, ok := checked.Load(db); ok {
+		return nil
+	}
+	if err := CheckDriver(ctx, db); err != nil {
+		return err
+	}
+	checked.Store(db, true)
+	return nil
+}
+
+// CheckDriver ... Verifies the database behaves the way the queries rely on whichever
+// driver opened it. TimeWithMsSqlite must give milliseconds, adding a TTL in seconds
+// must keep them, TIMESTAMP columns must scan back to the time written and the sqlite
+// version must support RETURNING (3.35 or newer). Create calls it once for each database.
+func CheckDriver(ctx context.Context, db *sql.DB) error {
+	// Temporary tables only exist on the connection that made them
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var now string
+	err = conn.QueryRowContext(ctx, fmt.Sprintf("SELECT %s;", TimeWithMsSqlite)).Scan(&now)
+	if err != nil {
+		return err
+	}
+	if _, err = time.ParseInLocation(timeFormatSqlite, now, time.UTC); err != nil {
+		return fmt.Errorf("liteq: %s gave %q without milliseconds", TimeWithMsSqlite, now)
+	}
+
+	start := time.Date(2020, 1, 2, 3, 4, 5, 6e6, time.UTC)
+	var expires string
+	q := "SELECT STRFTIME('%Y-%m-%d %H:%M:%f', ?, (1250 / 1000.0) || ' seconds');"
+	err = conn.QueryRowContext(ctx, q, start.Format(timeFormatSqlite)).Scan(&expires)
+	if err != nil {
+		return err
+	}
+	if want := start.Add(1250 * time.Millisecond).Format(timeFormatSqlite); expires != want {
+		return fmt.Errorf("liteq: TTL arithmetic gave %q expected %q", expires, want)
+	}
+
+	_, err = conn.ExecContext(ctx, "CREATE TEMP TABLE IF NOT EXISTS liteq_check (t TIMESTAMP);")
+	if err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "DROP TABLE IF EXISTS temp.liteq_check;")
+	_, err = conn.ExecContext(ctx, "INSERT INTO liteq_check (t) VALUES (?);", start.Format(timeFormatSqlite))
+	if err != nil {
+		return err
+	}
+	var t sqliteTime
+	err = conn.QueryRowContext(ctx, "UPDATE liteq_check SET t = t RETURNING t;").Scan(&t)
+	if err != nil {
+		return fmt.Errorf("liteq: RETURNING is not supported, sqlite 3.35 or newer is required: %w", err)
+	}
+	if !t.Time.Equal(start) {
+		return fmt.Errorf("liteq: TIMESTAMP written as %s was read as %s", start, t.Time)
+	}
+	return nil
+}
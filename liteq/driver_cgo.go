@@ -0,0 +1,11 @@
+//go:build !purego
+
+package liteq
+
+// sqlite3 database package import, needs cgo. Build with the purego tag to use a driver
+// that does not.
+import _ "github.com/mattn/go-sqlite3"
+
+// DriverName ... database/sql driver liteq registers, open the database with it. Set a
+// busy timeout with "?_busy_timeout=5000".
+const DriverName = "sqlite3"
@@ -0,0 +1,8 @@
+//go:build !purego
+
+package liteq
+
+const testDSN = testPath + "?_busy_timeout=10000"
+
+// The driver sets a busy timeout of 5 seconds unless told otherwise
+const noBusyTimeoutDSN = testPath + "?_busy_timeout=0"
@@ -0,0 +1,10 @@
+//go:build purego
+
+package liteq
+
+// Pure Go sqlite so binaries build without cgo
+import _ "modernc.org/sqlite"
+
+// DriverName ... database/sql driver liteq registers, open the database with it. Set a
+// busy timeout with "?_pragma=busy_timeout(5000)".
+const DriverName = "sqlite"
@@ -0,0 +1,7 @@
+//go:build purego
+
+package liteq
+
+const testDSN = testPath + "?_pragma=busy_timeout(10000)"
+
+const noBusyTimeoutDSN = testPath
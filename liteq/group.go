@@ -0,0 +1,377 @@
+package liteq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lateefj/gq"
+)
+
+// Group ... Named consumer group, every group receives every message and tracks
+// its own progress in the <prefix>acks table. A message is removed once every
+// group has acknowledged it or it is older than the queue Retention. Groups do
+// not dead letter, failed messages are retried after the queue Backoff.
+type Group struct {
+	Queue *Liteq
+	Name  string
+	exit  bool
+	mutex sync.RWMutex
+}
+
+// Group ... Consumer group on this queue, Create registers it
+func (l *Liteq) Group(name string) *Group {
+	return &Group{Queue: l, Name: name}
+}
+
+// Groups ... Names of the registered consumer groups
+func (l *Liteq) Groups(ctx context.Context) ([]string, error) {
+	names := make([]string, 0)
+	rows, err := l.DB.QueryContext(ctx, fmt.Sprintf("SELECT name FROM %sgroups ORDER BY name ASC;", l.Prefix))
+	if err != nil {
+		return names, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return names, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// Collect ... Removes messages every group has acknowledged or that are past the retention,
+// group commits already do this for the messages they acknowledge so this is for cleanup
+// after groups are added or removed
+func (l *Liteq) Collect(ctx context.Context) error {
+	txn, err := l.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Progress for messages that no longer exist, also takes the write lock first
+	q := fmt.Sprintf("DELETE FROM %[1]sacks WHERE NOT EXISTS (SELECT 1 FROM %[1]sq q WHERE q.id = %[1]sacks.id);", l.Prefix)
+	_, err = txn.ExecContext(ctx, q)
+	if err == nil {
+		err = l.collect(ctx, txn, fmt.Sprintf("q.id IN (SELECT id FROM %sacks WHERE acked)", l.Prefix))
+	}
+	if err == nil {
+		err = l.expire(ctx, txn)
+	}
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+// expire ... Deletes messages past the retention along with the group progress on them
+func (l *Liteq) expire(ctx context.Context, txn *sql.Tx) error {
+	if l.Retention <= 0 {
+		return nil
+	}
+	cutoff := time.Now().UTC().Add(-l.Retention).Format(timeFormatSqlite)
+	q := fmt.Sprintf("DELETE FROM %[1]sacks WHERE id IN (SELECT id FROM %[1]sq WHERE timestamp < ?);", l.Prefix)
+	_, err := txn.ExecContext(ctx, q, cutoff)
+	if err != nil {
+		return err
+	}
+	_, err = txn.ExecContext(ctx, fmt.Sprintf("DELETE FROM %sq WHERE timestamp < ?;", l.Prefix), cutoff)
+	return err
+}
+
+// collect ... Deletes messages matching the condition that every group has acknowledged
+func (l *Liteq) collect(ctx context.Context, txn *sql.Tx, condition string, args ...interface{}) error {
+	q := fmt.Sprintf(`SELECT q.id FROM %[1]sq q WHERE %[2]s AND EXISTS (SELECT 1 FROM %[1]sgroups)
+AND NOT EXISTS (
+	SELECT 1 FROM %[1]sgroups g WHERE NOT EXISTS (
+		SELECT 1 FROM %[1]sacks a WHERE a.grp = g.name AND a.id = q.id AND a.acked
+	)
+);`, l.Prefix, condition)
+	rows, err := txn.QueryContext(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+	done := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		done = append(done, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(done) == 0 {
+		return err
+	}
+	in, doneArgs := placeholders(done)
+	_, err = txn.ExecContext(ctx, fmt.Sprintf("DELETE FROM %sacks WHERE id IN (%s);", l.Prefix, in), doneArgs...)
+	if err != nil {
+		return err
+	}
+	_, err = txn.ExecContext(ctx, fmt.Sprintf("DELETE FROM %sq WHERE id IN (%s);", l.Prefix, in), doneArgs...)
+	return err
+}
+
+// groupAvailable ... Condition on the group progress a for messages q the group can
+// check out again, a checkout expires like a queue checkout with the message TTL and lease
+func (g *Group) groupAvailable() string {
+	return fmt.Sprintf("NOT a.acked AND a.visible_at <= %s AND (a.checkout IS null OR (%s))", TimeWithMsSqlite, g.Queue.expired("a.", "q."))
+}
+
+// ordered ... Condition on the queue for messages that are the oldest this group has not
+// acknowledged for their ordering key, the group name is the only parameter
+func (g *Group) ordered() string {
+	return fmt.Sprintf(`(q.ordering_key IS null OR NOT EXISTS (
+	SELECT 1 FROM %[1]sq o WHERE o.ordering_key = q.ordering_key AND o.id < q.id
+	AND NOT EXISTS (SELECT 1 FROM %[1]sacks oa WHERE oa.grp = ? AND oa.id = o.id AND oa.acked)
+))`, g.Queue.Prefix)
+}
+
+// Create ... Registers the group
+func (g *Group) Create() error {
+	return g.CreateContext(context.Background())
+}
+
+// CreateContext ... Registers the group, a new group receives every message still retained
+func (g *Group) CreateContext(ctx context.Context) error {
+	q := fmt.Sprintf("INSERT OR IGNORE INTO %sgroups (name) VALUES (?);", g.Queue.Prefix)
+	_, err := g.Queue.DB.ExecContext(ctx, q, g.Name)
+	return err
+}
+
+// Destroy ... Unregisters the group
+func (g *Group) Destroy() error {
+	return g.DestroyContext(context.Background())
+}
+
+// DestroyContext ... Unregisters the group and removes its progress
+func (g *Group) DestroyContext(ctx context.Context) error {
+	txn, err := g.Queue.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = txn.ExecContext(ctx, fmt.Sprintf("DELETE FROM %sgroups WHERE name = ?;", g.Queue.Prefix), g.Name)
+	if err == nil {
+		_, err = txn.ExecContext(ctx, fmt.Sprintf("DELETE FROM %sacks WHERE grp = ?;", g.Queue.Prefix), g.Name)
+	}
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+// Publish ... Publishes to the queue so every group receives the messages
+func (g *Group) Publish(messages []*gq.Message) error {
+	return g.Queue.PublishContext(context.Background(), messages)
+}
+
+// PublishContext ... Publishes to the queue so every group receives the messages
+func (g *Group) PublishContext(ctx context.Context, messages []*gq.Message) error {
+	return g.Queue.PublishContext(ctx, messages)
+}
+
+// ConsumeBatch ... Consumes messages this group has not yet acknowledged
+func (g *Group) ConsumeBatch(size int) ([]*gq.ConsumerMessage, error) {
+	return g.ConsumeBatchContext(context.Background(), size)
+}
+
+// ConsumeBatchContext ... Consumes messages this group has not yet acknowledged
+func (g *Group) ConsumeBatchContext(ctx context.Context, size int) ([]*gq.ConsumerMessage, error) {
+	ms := make([]*gq.ConsumerMessage, 0)
+	acks := fmt.Sprintf("%sacks", g.Queue.Prefix)
+	// Claim by inserting or updating the group progress, the insert is the first
+	// statement so the transaction holds the write lock for the whole checkout and the
+	// rows the select found available can not change before they are updated
+	q := fmt.Sprintf(`INSERT INTO %[1]s (grp, id, checkout, attempts)
+SELECT ?, q.id, ?, 1 FROM %[2]sq q
+LEFT JOIN %[1]s a ON a.grp = ? AND a.id = q.id
+WHERE q.visible_at <= %[3]s AND (a.id IS NULL OR (%[4]s)) AND %[5]s
+ORDER BY a.checkout ASC, %[6]s DESC, q.id ASC LIMIT ?
+ON CONFLICT (grp, id) DO UPDATE SET checkout = excluded.checkout, lease_until = NULL, attempts = %[1]s.attempts + 1
+RETURNING id, attempts;`, acks, g.Queue.Prefix, TimeWithMsSqlite, g.groupAvailable(), g.ordered(), g.Queue.priority("q"))
+	txn, err := g.Queue.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return ms, err
+	}
+	checkout := time.Now().UTC()
+	rows, err := txn.QueryContext(ctx, q, g.Name, checkout.Format(timeFormatSqlite), g.Name, g.Name, size)
+	if err != nil {
+		txn.Rollback()
+		return ms, err
+	}
+	attempts := make(map[int64]int)
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		var a int
+		if err = rows.Scan(&id, &a); err != nil {
+			rows.Close()
+			txn.Rollback()
+			return ms, err
+		}
+		attempts[id] = a
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(ids) == 0 {
+		txn.Rollback()
+		return ms, err
+	}
+
+	in, args := placeholders(ids)
+	q = fmt.Sprintf("SELECT id, payload, headers, timestamp, ttl, ordering_key, priority FROM %sq WHERE id IN (%s);", g.Queue.Prefix, in)
+	rows, err = txn.QueryContext(ctx, q, args...)
+	if err != nil {
+		txn.Rollback()
+		return ms, err
+	}
+	for rows.Next() {
+		m := &gq.ConsumerMessage{}
+		var headers sql.NullString
+		var timestamp sqliteTime
+		var ttl sql.NullInt64
+		var key sql.NullString
+		err = rows.Scan(&m.Id, &m.Payload, &headers, &timestamp, &ttl, &key, &m.Priority)
+		if err == nil {
+			m.Headers, err = decodeHeaders(headers)
+		}
+		if err != nil {
+			rows.Close()
+			txn.Rollback()
+			return make([]*gq.ConsumerMessage, 0), err
+		}
+		m.Timestamp = timestamp.Time
+		m.Checkout = checkout
+		m.TTL = time.Duration(ttl.Int64) * time.Millisecond
+		m.OrderingKey = key.String
+		m.Attempts = attempts[m.Id]
+		m.Topic = g.Queue.topic
+		ms = append(ms, m)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		txn.Rollback()
+		return make([]*gq.ConsumerMessage, 0), err
+	}
+	if err = txn.Commit(); err != nil {
+		return make([]*gq.ConsumerMessage, 0), err
+	}
+	sortByPriority(ms)
+	return ms, nil
+}
+
+// Extend ... Extends the lease on messages checked out by the group so they are not
+// delivered to it again until lease from now even if the TTL passes, see gq.Heartbeat
+func (g *Group) Extend(ctx context.Context, ms []*gq.ConsumerMessage, lease time.Duration) error {
+	if len(ms) == 0 {
+		return nil
+	}
+	in, args := checkouts(ms)
+	leaseUntil := time.Now().UTC().Add(lease).Format(timeFormatSqlite)
+	q := fmt.Sprintf("UPDATE %sacks SET lease_until = ? WHERE grp = ? AND (id, checkout) IN (VALUES %s);", g.Queue.Prefix, in)
+	_, err := g.Queue.DB.ExecContext(ctx, q, append([]interface{}{leaseUntil, g.Name}, args...)...)
+	return err
+}
+
+// Commit ... Acknowledges messages for this group
+func (g *Group) Commit(recipts []*gq.Receipt) error {
+	return g.CommitContext(context.Background(), recipts)
+}
+
+// CommitContext ... Acknowledges successful messages for this group and removes any that
+// every group has now acknowledged, failed messages are released after the backoff
+func (g *Group) CommitContext(ctx context.Context, recipts []*gq.Receipt) error {
+	ackIds := make([]int64, 0)
+	failed := make([]*gq.Receipt, 0)
+	for _, r := range recipts {
+		if r.Success {
+			ackIds = append(ackIds, r.Id)
+		} else {
+			failed = append(failed, r)
+		}
+	}
+	txn, err := g.Queue.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if len(ackIds) > 0 {
+		in, args := placeholders(ackIds)
+		q := fmt.Sprintf("UPDATE %sacks SET acked = 1, checkout = NULL WHERE grp = ? AND id IN (%s);", g.Queue.Prefix, in)
+		_, err = txn.ExecContext(ctx, q, append([]interface{}{g.Name}, args...)...)
+		if err == nil {
+			err = g.Queue.collect(ctx, txn, fmt.Sprintf("q.id IN (%s)", in), args...)
+		}
+	}
+	if err == nil && len(failed) > 0 {
+		err = g.release(ctx, txn, failed)
+	}
+	if err == nil {
+		err = g.Queue.expire(ctx, txn)
+	}
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+// release ... Records the error and makes failed messages available to the group after the backoff
+func (g *Group) release(ctx context.Context, txn *sql.Tx, failed []*gq.Receipt) error {
+	now := time.Now().UTC()
+	for _, r := range failed {
+		var attempts int
+		q := fmt.Sprintf("UPDATE %sacks SET checkout = NULL, last_error = ? WHERE grp = ? AND id = ? RETURNING attempts;", g.Queue.Prefix)
+		err := txn.QueryRowContext(ctx, q, r.Error, g.Name, r.Id).Scan(&attempts)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		visibleAt := now.Add(g.Queue.retryDelay(attempts)).Format(timeFormatSqlite)
+		_, err = txn.ExecContext(ctx, fmt.Sprintf("UPDATE %sacks SET visible_at = ? WHERE grp = ? AND id = ?;", g.Queue.Prefix), visibleAt, g.Name, r.Id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stream ... Creates a stream of consumption for the group
+func (g *Group) Stream(size int, messages chan []*gq.ConsumerMessage, pause time.Duration) {
+	g.StreamContext(context.Background(), size, messages, pause)
+}
+
+// StreamContext ... Creates a stream of consumption for the group that ends when the context is done
+func (g *Group) StreamContext(ctx context.Context, size int, messages chan []*gq.ConsumerMessage, pause time.Duration) {
+	stream(ctx, size, messages, pause, g.ConsumeBatchContext, g.unlock, g.Exit)
+}
+
+// unlock ... Makes messages checked out by the group but never handed to a consumer
+// available to it again straight away, the delivery does not count as an attempt
+func (g *Group) unlock(ctx context.Context, ms []*gq.ConsumerMessage) error {
+	in, args := placeholders(messageIds(ms))
+	q := fmt.Sprintf("UPDATE %sacks SET checkout = NULL, attempts = attempts - 1 WHERE grp = ? AND id IN (%s) AND checkout IS NOT null;", g.Queue.Prefix, in)
+	_, err := g.Queue.DB.ExecContext(ctx, q, append([]interface{}{g.Name}, args...)...)
+	return err
+}
+
+// StopConsumer ... Stop consuming messages
+func (g *Group) StopConsumer() {
+	g.mutex.Lock()
+	g.exit = true
+	g.mutex.Unlock()
+}
+
+// Exit ...
+func (g *Group) Exit() bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return g.exit
+}
@@ -1,60 +1,450 @@
 package liteq
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/lateefj/gq"
-
-	// sqlite3 database package impoart
-	_ "github.com/mattn/go-sqlite3"
 )
 
 // TimeWithMsSqlite ... Special constant to get a time with milliseconds. This is helpful for checkout as the timeout might be sub second
 const TimeWithMsSqlite = "STRFTIME('%Y-%m-%d %H:%M:%f', 'NOW')"
 
+// timeFormatSqlite ... Go layout matching TimeWithMsSqlite so bound times compare correctly with it
+const timeFormatSqlite = "2006-01-02 15:04:05.000"
+
+// defaultBusyTimeout ... How long a checkout waits for the write lock on a connection
+// opened without a busy timeout
+const defaultBusyTimeout = 5 * time.Second
+
 var (
 	createSchema = `
-CREATE TABLE IF NOT EXISTS %sq (
+CREATE TABLE IF NOT EXISTS %[1]sq (
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
 	timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
 	checkout TIMESTAMP,
-	payload BLOB
+	visible_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	headers TEXT,
+	payload BLOB,
+	last_error TEXT,
+	ttl INTEGER,
+	lease_until TIMESTAMP,
+	ordering_key TEXT,
+	priority INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS %[1]sdlq (
+	id INTEGER PRIMARY KEY,
+	timestamp TIMESTAMP NOT NULL,
+	checkout TIMESTAMP,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	headers TEXT,
+	payload BLOB,
+	last_error TEXT,
+	ttl INTEGER,
+	ordering_key TEXT,
+	priority INTEGER NOT NULL DEFAULT 0,
+	dead_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS %[1]sgroups (
+	name TEXT NOT NULL PRIMARY KEY,
+	timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS %[1]sacks (
+	grp TEXT NOT NULL,
+	id INTEGER NOT NULL,
+	checkout TIMESTAMP,
+	visible_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	acked BOOLEAN NOT NULL DEFAULT 0,
+	last_error TEXT,
+	lease_until TIMESTAMP,
+	PRIMARY KEY (grp, id)
 );
-CREATE INDEX IF NOT EXISTS %sq_timestamp_idx ON %sq (checkout ASC, timestamp ASC);
+CREATE TABLE IF NOT EXISTS %[1]skeys (
+	key TEXT NOT NULL PRIMARY KEY,
+	timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+`
+	// Indexes are created after the migrations since they use the added columns
+	createIndexes = `
+CREATE INDEX IF NOT EXISTS %[1]skeys_timestamp_idx ON %[1]skeys (timestamp);
+CREATE INDEX IF NOT EXISTS %[1]sacks_id_idx ON %[1]sacks (id);
+CREATE INDEX IF NOT EXISTS %[1]sq_ordering_key_idx ON %[1]sq (ordering_key, id) WHERE ordering_key IS NOT NULL;
+DROP INDEX IF EXISTS %[1]sq_timestamp_idx;
+CREATE INDEX IF NOT EXISTS %[1]sq_checkout_idx ON %[1]sq (checkout ASC, priority DESC, timestamp ASC, visible_at ASC);
 `
 	dropScrema = `
-DROP TABLE IF EXISTS %sq;
+DROP TABLE IF EXISTS %[1]skeys;
+DROP TABLE IF EXISTS %[1]sacks;
+DROP TABLE IF EXISTS %[1]sgroups;
+DROP TABLE IF EXISTS %[1]stopics;
+DROP TABLE IF EXISTS %[1]sdlq;
+DROP TABLE IF EXISTS %[1]sq;
 `
 )
 
-// Liteq Structure for sqlite
+// migrations ... Columns added since the tables were first released, tables created by
+// an older version are altered to add them. SQLite only adds NOT NULL columns with a
+// constant default so visible_at starts at the epoch, every insert sets it.
+var migrations = []struct {
+	table, column, definition string
+}{
+	{"q", "attempts", "INTEGER NOT NULL DEFAULT 0"},
+	{"q", "headers", "TEXT"},
+	{"q", "last_error", "TEXT"},
+	{"q", "visible_at", "TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00.000'"},
+	{"q", "ttl", "INTEGER"},
+	{"q", "lease_until", "TIMESTAMP"},
+	{"q", "ordering_key", "TEXT"},
+	{"q", "priority", "INTEGER NOT NULL DEFAULT 0"},
+	{"dlq", "ttl", "INTEGER"},
+	{"dlq", "ordering_key", "TEXT"},
+	{"dlq", "priority", "INTEGER NOT NULL DEFAULT 0"},
+	{"acks", "lease_until", "TIMESTAMP"},
+}
+
+// sqliteTime ... Scans a TIMESTAMP column whether the driver returns a time or text
+type sqliteTime struct {
+	Time time.Time
+}
+
+// Scan ... implements sql.Scanner
+func (st *sqliteTime) Scan(value interface{}) error {
+	var err error
+	switch v := value.(type) {
+	case nil:
+		st.Time = time.Time{}
+	case time.Time:
+		st.Time = v.UTC()
+	case string:
+		st.Time, err = parseTimeSqlite(v)
+	case []byte:
+		st.Time, err = parseTimeSqlite(string(v))
+	default:
+		err = fmt.Errorf("unsupported sqlite time type %T", value)
+	}
+	return err
+}
+
+// parseTimeSqlite ... Parse a sqlite time with or without milliseconds
+func parseTimeSqlite(v string) (time.Time, error) {
+	for _, layout := range []string{timeFormatSqlite, "2006-01-02 15:04:05", time.RFC3339Nano} {
+		t, err := time.ParseInLocation(layout, v, time.UTC)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unable to parse sqlite time %q", v)
+}
+
+// encodeHeaders ... JSON text for the headers column or nil when there are none
+func encodeHeaders(headers map[string]string) (interface{}, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(headers)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// decodeHeaders ... Parse the headers column
+func decodeHeaders(s sql.NullString) (map[string]string, error) {
+	if !s.Valid || s.String == "" {
+		return nil, nil
+	}
+	headers := make(map[string]string)
+	err := json.Unmarshal([]byte(s.String), &headers)
+	return headers, err
+}
+
+// Liteq Structure for sqlite, checkout uses UPDATE ... RETURNING so requires
+// sqlite 3.35 or newer. Open the database with DriverName, the cgo driver by default
+// or a pure Go one when built with the purego tag. When several connections share a
+// database open it with a busy timeout (see DriverName) so writers wait for the write
+// lock rather than fail, checkout waits defaultBusyTimeout on connections without one.
 type Liteq struct {
 	DB     *sql.DB
 	Prefix string
 	TTL    time.Duration
-	exit   bool
-	mutex  *sync.RWMutex
+	// Deliveries before a message is moved to the dead letter table, 0 means unlimited
+	MaxAttempts int
+	// Delay before a failed message is delivered again, nil means right away
+	Backoff gq.Backoff
+	// How long messages are kept for consumer groups that have not acknowledged them, 0 means until every group has
+	Retention time.Duration
+	// How long an idempotency key is remembered before it can be published again, 0 means forever
+	DedupWindow time.Duration
+	// Wait after which a message is treated as one priority higher so low priority
+	// messages are not starved, 0 means strict priority order
+	Aging time.Duration
+	exit  bool
+	mutex *sync.RWMutex
+	// Topic name when this queue was made by Topic
+	topic string
+	// Queue whose topics table lists this topic
+	parent     *Liteq
+	topics     map[string]*Liteq
+	topicTurn  int
+	topicMutex sync.Mutex
+}
+
+// querier ... Transaction or connection the statements of a checkout run in
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// placeholders ... Parameter list for an IN clause of ids
+func placeholders(ids []int64) (string, []interface{}) {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return strings.TrimSuffix(strings.Repeat("?,", len(ids)), ","), args
+}
+
+// checkouts ... Row values of the message ids and checkouts for an IN clause, a message
+// checked out again since has a later checkout and does not match
+func checkouts(ms []*gq.ConsumerMessage) (string, []interface{}) {
+	args := make([]interface{}, 0, 2*len(ms))
+	for _, m := range ms {
+		args = append(args, m.Id, m.Checkout.UTC().Format(timeFormatSqlite))
+	}
+	return strings.TrimSuffix(strings.Repeat("(?, ?),", len(ms)), ","), args
+}
+
+// ttlMs ... Message TTL in milliseconds for the ttl column or nil to use the queue TTL
+func ttlMs(ttl time.Duration) interface{} {
+	if ttl <= 0 {
+		return nil
+	}
+	return ttl.Milliseconds()
+}
+
+// orderingKey ... Value for the ordering_key column, nil when the message is unordered
+func orderingKey(key string) interface{} {
+	if key == "" {
+		return nil
+	}
+	return key
+}
+
+// ordered ... Condition for messages that are the oldest still in the queue for their
+// ordering key. Checkout holds the write lock so the older message being checked out or
+// not is all that matters, it stays in the table until it is committed.
+func (l *Liteq) ordered() string {
+	return fmt.Sprintf("(ordering_key IS null OR NOT EXISTS (SELECT 1 FROM %[1]sq o WHERE o.ordering_key = %[1]sq.ordering_key AND o.id < %[1]sq.id))", l.Prefix)
+}
+
+// priority ... Expression for the priority of the table rows used to order checkout,
+// with Aging a message gains one priority for every Aging it has waited
+func (l *Liteq) priority(table string) string {
+	if l.Aging <= 0 {
+		return fmt.Sprintf("%s.priority", table)
+	}
+	return fmt.Sprintf("(%[1]s.priority + CAST((JULIANDAY('now') - JULIANDAY(%[1]s.timestamp)) * 86400000 / %[2]d AS INTEGER))", table, l.Aging.Milliseconds())
+}
+
+// sortByPriority ... Highest priority first then oldest first
+func sortByPriority(ms []*gq.ConsumerMessage) {
+	sort.SliceStable(ms, func(i, j int) bool {
+		if ms[i].Priority != ms[j].Priority {
+			return ms[i].Priority > ms[j].Priority
+		}
+		return ms[i].Id < ms[j].Id
+	})
+}
+
+// available ... Condition for messages that can be checked out
+func (l *Liteq) available() string {
+	return fmt.Sprintf("visible_at <= %s AND (checkout IS null OR (%s))", TimeWithMsSqlite, l.expired("", ""))
+}
+
+// expired ... Condition for checked out messages that are available again because the
+// TTL and any lease extension have passed. The checkout and lease_until columns are
+// prefixed with checkouts and the ttl column with messages so consumer groups can use
+// their own checkouts, empty prefixes for the queue table.
+func (l *Liteq) expired(checkouts, messages string) string {
+	// Message TTL falls back to the queue TTL, with neither a checkout never expires
+	ttl := messages + "ttl"
+	if l.TTL.Seconds() > 0.0 {
+		ttl = fmt.Sprintf("COALESCE(%sttl, %d)", messages, l.TTL.Milliseconds())
+	}
+	return fmt.Sprintf("STRFTIME('%%Y-%%m-%%d %%H:%%M:%%f', %[1]scheckout, (%[2]s / 1000.0) || ' seconds') < %[3]s AND (%[1]slease_until IS null OR %[1]slease_until < %[3]s)", checkouts, ttl, TimeWithMsSqlite)
+}
+
+// retryDelay ... How long a message that failed should wait before it is delivered again
+func (l *Liteq) retryDelay(attempts int) time.Duration {
+	if l.Backoff == nil {
+		return 0
+	}
+	return l.Backoff.Delay(attempts)
+}
+
+// release ... Returns failed messages to the queue so they are delivered again after the backoff
+func (l *Liteq) release(ctx context.Context, txn *sql.Tx, ids []int64) error {
+	in, args := placeholders(ids)
+	rows, err := txn.QueryContext(ctx, fmt.Sprintf("SELECT id, attempts FROM %sq WHERE id IN (%s);", l.Prefix, in), args...)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	visible := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var attempts int
+		err = rows.Scan(&id, &attempts)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		visible[id] = now.Add(l.retryDelay(attempts)).Format(timeFormatSqlite)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	stmt, err := txn.PrepareContext(ctx, fmt.Sprintf("UPDATE %sq SET checkout = NULL, visible_at = ? WHERE id = ?;", l.Prefix))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for id, v := range visible {
+		_, err = stmt.ExecContext(ctx, v, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deadLetter ... Moves messages matching the condition into the dead letter table
+// within the transaction
+func (l *Liteq) deadLetter(ctx context.Context, txn querier, condition string, args ...interface{}) error {
+	q := fmt.Sprintf(`INSERT INTO %[1]sdlq (id, timestamp, checkout, attempts, headers, payload, last_error, ttl, ordering_key, priority)
+SELECT id, timestamp, checkout, attempts, headers, payload, last_error, ttl, ordering_key, priority FROM %[1]sq WHERE %[2]s
+RETURNING id;`, l.Prefix, condition)
+	rows, err := txn.QueryContext(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+	moved := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		moved = append(moved, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(moved) == 0 {
+		return err
+	}
+	// Only the ids just moved, the condition may match more rows now that time has passed
+	in, movedArgs := placeholders(moved)
+	_, err = txn.ExecContext(ctx, fmt.Sprintf("DELETE FROM %sq WHERE id IN (%s);", l.Prefix, in), movedArgs...)
+	return err
 }
 
 // Create ... builds any required tables
 func (l *Liteq) Create() error {
+	return l.CreateContext(context.Background())
+}
+
+// CreateContext ... builds any required tables after checking the driver, a topic
+// queue is also registered with the queue it came from
+func (l *Liteq) CreateContext(ctx context.Context) error {
 	if l.mutex == nil {
 		l.mutex = &sync.RWMutex{}
 	}
-	s := fmt.Sprintf(createSchema, l.Prefix, l.Prefix, l.Prefix)
-	_, err := l.DB.Exec(s)
-	return err
+	err := checkDriverOnce(ctx, l.DB)
+	if err != nil {
+		return err
+	}
+	s := fmt.Sprintf(createSchema, l.Prefix)
+	_, err = l.DB.ExecContext(ctx, s)
+	if err != nil {
+		return err
+	}
+	if err = l.migrate(ctx); err != nil {
+		return err
+	}
+	_, err = l.DB.ExecContext(ctx, fmt.Sprintf(createIndexes, l.Prefix))
+	if err != nil || l.parent == nil {
+		return err
+	}
+	return l.parent.registerTopic(ctx, l)
+}
+
+// migrate ... Adds any columns missing from tables created by an older version
+func (l *Liteq) migrate(ctx context.Context) error {
+	columns := make(map[string]map[string]bool)
+	for _, m := range migrations {
+		if columns[m.table] == nil {
+			existing, err := l.columns(ctx, l.Prefix+m.table)
+			if err != nil {
+				return err
+			}
+			columns[m.table] = existing
+		}
+		if columns[m.table][m.column] {
+			continue
+		}
+		q := fmt.Sprintf("ALTER TABLE %s%s ADD COLUMN %s %s;", l.Prefix, m.table, m.column, m.definition)
+		if _, err := l.DB.ExecContext(ctx, q); err != nil {
+			return err
+		}
+		columns[m.table][m.column] = true
+	}
+	return nil
+}
+
+// columns ... Names of the columns in the table
+func (l *Liteq) columns(ctx context.Context, table string) (map[string]bool, error) {
+	columns := make(map[string]bool)
+	rows, err := l.DB.QueryContext(ctx, "SELECT name FROM pragma_table_info(?);", table)
+	if err != nil {
+		return columns, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return columns, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
 }
 
 // Destroy ... removes any tables
 func (l *Liteq) Destroy() error {
+	return l.DestroyContext(context.Background())
+}
+
+// DestroyContext ... removes any tables
+func (l *Liteq) DestroyContext(ctx context.Context) error {
+	err := l.destroyTopics(ctx)
+	if err != nil {
+		return err
+	}
 	s := fmt.Sprintf(dropScrema, l.Prefix)
-	_, err := l.DB.Exec(s)
-	return err
+	_, err = l.DB.ExecContext(ctx, s)
+	if err != nil || l.parent == nil {
+		return err
+	}
+	return l.parent.unregisterTopic(ctx, l.topic)
 }
 
 // StopConsumer ... Stop consuming messages
@@ -73,123 +463,379 @@ func (l *Liteq) Exit() bool {
 
 // Publish ... This pushes a list of messages into the DB
 func (l *Liteq) Publish(messages []*gq.Message) error {
+	return l.PublishContext(context.Background(), messages)
+}
+
+// PublishContext ... This pushes a list of messages into the DB
+func (l *Liteq) PublishContext(ctx context.Context, messages []*gq.Message) error {
 
-	txn, err := l.DB.Begin()
-	defer txn.Commit()
+	txn, err := l.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = l.publish(ctx, txn, messages)
 	if err != nil {
+		txn.Rollback()
 		return err
 	}
+	return txn.Commit()
+}
 
-	q := fmt.Sprintf("INSERT INTO %sq (payload) VALUES(?);", l.Prefix)
-	stmt, err := txn.Prepare(q)
+func (l *Liteq) publish(ctx context.Context, txn *sql.Tx, messages []*gq.Message) error {
+	if l.DedupWindow > 0 {
+		cutoff := time.Now().UTC().Add(-l.DedupWindow).Format(timeFormatSqlite)
+		_, err := txn.ExecContext(ctx, fmt.Sprintf("DELETE FROM %skeys WHERE timestamp < ?;", l.Prefix), cutoff)
+		if err != nil {
+			return err
+		}
+	}
+	q := fmt.Sprintf("INSERT INTO %sq (payload, headers, ttl, ordering_key, priority, visible_at) VALUES(?, ?, ?, ?, ?, COALESCE(?, CURRENT_TIMESTAMP));", l.Prefix)
+	stmt, err := txn.PrepareContext(ctx, q)
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 	for _, m := range messages {
-		_, err := stmt.Exec(m.Payload)
+		if m.IdempotencyKey != "" {
+			// A key seen within the window means this is a retried publish
+			res, err := txn.ExecContext(ctx, fmt.Sprintf("INSERT OR IGNORE INTO %skeys (key, timestamp) VALUES (?, ?);", l.Prefix),
+				m.IdempotencyKey, time.Now().UTC().Format(timeFormatSqlite))
+			if err != nil {
+				return err
+			}
+			n, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				continue
+			}
+		}
+		var visibleAt interface{}
+		if !m.NotBefore.IsZero() {
+			visibleAt = m.NotBefore.UTC().Format(timeFormatSqlite)
+		}
+		headers, err := encodeHeaders(m.Headers)
+		if err == nil {
+			_, err = stmt.ExecContext(ctx, m.Payload, headers, ttlMs(m.TTL), orderingKey(m.OrderingKey), m.Priority, visibleAt)
+		}
 		if err != nil {
 			return err
 		}
 	}
-	return err
+	return nil
+}
+
+// PublishTx ... Publishes inside a transaction the caller owns so the messages are only
+// visible if the caller commits, the caller is responsible for commit or rollback
+func (l *Liteq) PublishTx(ctx context.Context, txn *sql.Tx, messages []*gq.Message) error {
+	return l.publish(ctx, txn, messages)
+}
+
+// CommitTx ... Commits receipts inside a transaction the caller owns so processing
+// results and the receipts land together
+func (l *Liteq) CommitTx(ctx context.Context, txn *sql.Tx, recipts []*gq.Receipt) error {
+	return l.commit(ctx, txn, recipts)
 }
 
 // Commit ... Removes any messages that bave been comsusumed by the b
 func (l *Liteq) Commit(recipts []*gq.Receipt) error {
-	deleteQuery := fmt.Sprintf("DELETE FROM %sq WHERE id IN(?)", l.Prefix)
-	deleteStmt, err := l.DB.Prepare(deleteQuery)
+	return l.CommitContext(context.Background(), recipts)
+}
+
+// CommitContext ... Removes any messages that bave been comsusumed by the b,
+// failed messages record the error and are released for retry after the backoff
+func (l *Liteq) CommitContext(ctx context.Context, recipts []*gq.Receipt) error {
+	txn, err := l.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	defer deleteStmt.Close()
+	err = l.commit(ctx, txn, recipts)
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+func (l *Liteq) commit(ctx context.Context, txn *sql.Tx, recipts []*gq.Receipt) error {
 	deleteIds := make([]int64, 0)
+	failedIds := make([]int64, 0)
 	for _, r := range recipts {
 		if r.Success {
 			deleteIds = append(deleteIds, r.Id)
+		} else {
+			failedIds = append(failedIds, r.Id)
+		}
+	}
+	if len(deleteIds) > 0 {
+		in, args := placeholders(deleteIds)
+		_, err := txn.ExecContext(ctx, fmt.Sprintf("DELETE FROM %sq WHERE id IN (%s);", l.Prefix, in), args...)
+		if err != nil {
+			return err
 		}
 	}
-	deleteClause := strings.Trim(strings.Replace(fmt.Sprint(deleteIds), " ", ",", -1), "[]")
-	_, err = deleteStmt.Exec(deleteClause)
+	if len(failedIds) == 0 {
+		return nil
+	}
+	errorStmt, err := txn.PrepareContext(ctx, fmt.Sprintf("UPDATE %sq SET last_error = ? WHERE id = ?;", l.Prefix))
+	if err != nil {
+		return err
+	}
+	defer errorStmt.Close()
+	for _, r := range recipts {
+		if !r.Success {
+			_, err = errorStmt.ExecContext(ctx, r.Error, r.Id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// Failed messages that are out of attempts go straight to the dead letter table
+	if l.MaxAttempts > 0 {
+		in, args := placeholders(failedIds)
+		err = l.deadLetter(ctx, txn, fmt.Sprintf("id IN (%s) AND attempts >= %d", in, l.MaxAttempts), args...)
+		if err != nil {
+			return err
+		}
+	}
+	return l.release(ctx, txn, failedIds)
+}
+
+// Extend ... Extends the lease on checked out messages so they are not delivered again
+// until lease from now even if the TTL passes. Call it periodically while a message
+// is still being worked on, see gq.Heartbeat.
+func (l *Liteq) Extend(ctx context.Context, ms []*gq.ConsumerMessage, lease time.Duration) error {
+	if len(ms) == 0 {
+		return nil
+	}
+	in, args := checkouts(ms)
+	leaseUntil := time.Now().UTC().Add(lease).Format(timeFormatSqlite)
+	q := fmt.Sprintf("UPDATE %sq SET lease_until = ? WHERE (id, checkout) IN (VALUES %s);", l.Prefix, in)
+	_, err := l.DB.ExecContext(ctx, q, append([]interface{}{leaseUntil}, args...)...)
 	return err
 }
 
 // ConsumeBatch ... This consumes a number of messages up to the limit
 func (l *Liteq) ConsumeBatch(size int) ([]*gq.ConsumerMessage, error) {
-	ms := make([]*gq.ConsumerMessage, 0)
-	// Find
-	q := fmt.Sprintf("SELECT id, payload FROM %sq WHERE checkout IS null", l.Prefix)
-	// If there is a TTL then checkout messages that have expired
-	if l.TTL.Seconds() > 0.0 {
-		q = fmt.Sprintf("%s OR DATETIME(checkout,  '%f second') < %s", q, l.TTL.Seconds(), TimeWithMsSqlite)
-	}
-	// Order and limit
-	q = fmt.Sprintf("%s ORDER BY checkout ASC, timestamp ASC LIMIT $1;", q)
-	txn, err := l.DB.Begin()
+	return l.ConsumeBatchContext(context.Background(), size)
+}
+
+// ConsumeBatchContext ... This consumes a number of messages up to the limit
+func (l *Liteq) ConsumeBatchContext(ctx context.Context, size int) ([]*gq.ConsumerMessage, error) {
+	// database/sql can not ask for BEGIN IMMEDIATE so the transaction is run by hand on a
+	// connection of its own, it takes the write lock before the first read and concurrent
+	// consumers wait for it rather than fail upgrading a read lock
+	conn, err := l.DB.Conn(ctx)
 	if err != nil {
-		return ms, err
+		return make([]*gq.ConsumerMessage, 0), err
 	}
-	defer txn.Commit()
+	defer conn.Close()
+	if err = beginImmediate(ctx, conn); err != nil {
+		return make([]*gq.ConsumerMessage, 0), err
+	}
+	ms, err := l.consume(ctx, conn, size)
+	if err = endImmediate(ctx, conn, err); err != nil {
+		return make([]*gq.ConsumerMessage, 0), err
+	}
+	return ms, nil
+}
 
-	stmt, err := l.DB.Prepare(q)
+// beginImmediate ... Starts a transaction holding the write lock on the connection. A
+// connection without a busy timeout is given defaultBusyTimeout, without one waiting for
+// the lock fails straight away.
+func beginImmediate(ctx context.Context, conn *sql.Conn) error {
+	var timeout int
+	err := conn.QueryRowContext(ctx, "PRAGMA busy_timeout;").Scan(&timeout)
 	if err != nil {
-		return ms, err
+		return err
 	}
-	defer stmt.Close()
+	if timeout == 0 {
+		_, err = conn.ExecContext(ctx, fmt.Sprintf("PRAGMA busy_timeout = %d;", defaultBusyTimeout.Milliseconds()))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = conn.ExecContext(ctx, "BEGIN IMMEDIATE;")
+	return err
+}
 
-	var rows *sql.Rows
+// endImmediate ... Commits the transaction started by beginImmediate or rolls it back
+// when err is set. A connection that could not be rolled back is discarded rather than
+// returned to the pool inside the transaction.
+func endImmediate(ctx context.Context, conn *sql.Conn, err error) error {
+	if err == nil {
+		if _, err = conn.ExecContext(ctx, "COMMIT;"); err == nil {
+			return nil
+		}
+	}
+	if _, rollbackErr := conn.ExecContext(context.WithoutCancel(ctx), "ROLLBACK;"); rollbackErr != nil {
+		conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	}
+	return err
+}
+
+// consume ... Checks out up to size messages in the transaction ordered by id
+func (l *Liteq) consume(ctx context.Context, txn querier, size int) ([]*gq.ConsumerMessage, error) {
+	ms := make([]*gq.ConsumerMessage, 0)
+	// Checkout in a single statement so the select and update can not interleave with another consumer
+	q := fmt.Sprintf(`UPDATE %[1]sq SET checkout = ?, lease_until = NULL, attempts = attempts + 1
+WHERE id IN (SELECT id FROM %[1]sq WHERE %[2]s AND %[3]s ORDER BY checkout ASC, %[4]s DESC, timestamp ASC, id ASC LIMIT ?)
+RETURNING id, payload, headers, timestamp, attempts, ttl, ordering_key, priority;`, l.Prefix, l.available(), l.ordered(), l.priority(l.Prefix+"q"))
+
+	// Messages out of attempts are dead lettered instead of delivered again
+	if l.MaxAttempts > 0 {
+		err := l.deadLetter(ctx, txn, fmt.Sprintf("%s AND attempts >= %d", l.available(), l.MaxAttempts))
+		if err != nil {
+			return ms, err
+		}
+	}
 
-	rows, err = stmt.Query(size)
+	checkout := time.Now().UTC()
+	rows, err := txn.QueryContext(ctx, q, checkout.Format(timeFormatSqlite), size)
 	if err != nil {
 		return ms, err
 	}
-
-	checkoutIds := make([]int64, 0)
 	defer rows.Close()
 	for rows.Next() {
-		var id int64
-		var payload []byte
-		rows.Scan(&id, &payload)
-		checkoutIds = append(checkoutIds, id)
-		ms = append(ms, &gq.ConsumerMessage{Message: gq.Message{Payload: payload}, Id: id})
+		m := &gq.ConsumerMessage{}
+		var headers sql.NullString
+		var timestamp sqliteTime
+		var ttl sql.NullInt64
+		var key sql.NullString
+		err = rows.Scan(&m.Id, &m.Payload, &headers, &timestamp, &m.Attempts, &ttl, &key, &m.Priority)
+		if err == nil {
+			m.Headers, err = decodeHeaders(headers)
+		}
+		if err != nil {
+			return make([]*gq.ConsumerMessage, 0), err
+		}
+		m.Timestamp = timestamp.Time
+		m.Checkout = checkout
+		m.TTL = time.Duration(ttl.Int64) * time.Millisecond
+		m.OrderingKey = key.String
+		m.Topic = l.topic
+		ms = append(ms, m)
+	}
+	if err = rows.Err(); err != nil {
+		return make([]*gq.ConsumerMessage, 0), err
 	}
+	// RETURNING does not guarantee order
+	sortByPriority(ms)
+	return ms, nil
+}
 
-	// Query any messages that have not been checked out
-	uq := fmt.Sprintf("UPDATE %sq SET checkout = %s WHERE id IN (?);", l.Prefix, TimeWithMsSqlite)
+// receipts ... Receipt for every message, failed with the error when there is one
+func receipts(ms []*gq.ConsumerMessage, err error) []*gq.Receipt {
+	rs := make([]*gq.Receipt, len(ms))
+	for i, m := range ms {
+		rs[i] = &gq.Receipt{Id: m.Id, Success: err == nil, Topic: m.Topic}
+		if err != nil {
+			rs[i].Error = err.Error()
+		}
+	}
+	return rs
+}
 
-	update, err := l.DB.Prepare(uq)
+// ConsumeTx ... Checks out up to size messages and hands them to the handler with the
+// same transaction. When the handler succeeds the messages are removed in that
+// transaction so its writes and the removal commit together and the messages can not
+// be redelivered. When it fails its writes are rolled back and the messages are
+// released with the error. The transaction holds the database write lock until the
+// handler returns. Returns the number of messages handled and the handler error.
+func (l *Liteq) ConsumeTx(ctx context.Context, size int, handler gq.TxHandler) (int, error) {
+	txn, err := l.DB.BeginTx(ctx, nil)
 	if err != nil {
-		return ms, err
+		return 0, err
+	}
+	ms, err := l.consume(ctx, txn, size)
+	if err != nil || len(ms) == 0 {
+		txn.Rollback()
+		return 0, err
 	}
-	checkoutClause := strings.Trim(strings.Replace(fmt.Sprint(checkoutIds), " ", ",", -1), "[]")
-	_, err = update.Exec(checkoutClause)
+	_, err = txn.ExecContext(ctx, "SAVEPOINT gq_handler;")
 	if err != nil {
 		txn.Rollback()
-		return nil, err
+		return 0, err
 	}
-	defer stmt.Close()
-	return ms, nil
+	handlerErr := handler(ctx, txn, ms)
+	if handlerErr != nil {
+		_, err = txn.ExecContext(ctx, "ROLLBACK TO SAVEPOINT gq_handler;")
+		if err != nil {
+			txn.Rollback()
+			return 0, err
+		}
+	}
+	err = l.commit(ctx, txn, receipts(ms, handlerErr))
+	if err != nil {
+		txn.Rollback()
+		return 0, err
+	}
+	if err = txn.Commit(); err != nil {
+		return 0, err
+	}
+	return len(ms), handlerErr
 }
 
 // Stream ... Creates a stream of consumption
 func (l *Liteq) Stream(size int, messages chan []*gq.ConsumerMessage, pause time.Duration) {
+	l.StreamContext(context.Background(), size, messages, pause)
+}
+
+// StreamContext ... Creates a stream of consumption that ends when the context is done
+func (l *Liteq) StreamContext(ctx context.Context, size int, messages chan []*gq.ConsumerMessage, pause time.Duration) {
+	stream(ctx, size, messages, pause, l.ConsumeBatchContext, l.unlock, l.Exit)
+}
+
+// unlock ... Returns checked out messages that were never handed to a consumer to the
+// queue straight away, the delivery does not count as an attempt
+func (l *Liteq) unlock(ctx context.Context, ms []*gq.ConsumerMessage) error {
+	in, args := placeholders(messageIds(ms))
+	q := fmt.Sprintf("UPDATE %sq SET checkout = NULL, lease_until = NULL, attempts = attempts - 1 WHERE id IN (%s) AND checkout IS NOT null;", l.Prefix, in)
+	_, err := l.DB.ExecContext(ctx, q, args...)
+	return err
+}
+
+// messageIds ... Ids of the messages
+func messageIds(ms []*gq.ConsumerMessage) []int64 {
+	ids := make([]int64, len(ms))
+	for i, m := range ms {
+		ids[i] = m.Id
+	}
+	return ids
+}
+
+// stream ... Feeds batches from consume into messages until exit or the context is done,
+// a batch checked out when the context is done is given back with unlock
+func stream(ctx context.Context, size int, messages chan []*gq.ConsumerMessage, pause time.Duration,
+	consume func(context.Context, int) ([]*gq.ConsumerMessage, error), unlock func(context.Context, []*gq.ConsumerMessage) error, exit func() bool) {
 	defer close(messages)
 	for {
 
 		// Consume until there are no more messages or there is an error
 		// No messages there was an error or time to exit
 		for {
-			if l.Exit() {
+			if exit() || ctx.Err() != nil {
 				return
 			}
-			ms, err := l.ConsumeBatch(size)
+			ms, err := consume(ctx, size)
 			// If exit then
 			if len(ms) == 0 || err != nil {
 				break
 			}
-			messages <- ms
+			select {
+			case messages <- ms:
+			case <-ctx.Done():
+				// The context is already done so the unlock can not use it
+				unlock(context.WithoutCancel(ctx), ms)
+				return
+			}
 		}
 		// Breather so not just infinate loop of queries
-		time.Sleep(pause)
+		select {
+		case <-time.After(pause):
+		case <-ctx.Done():
+			return
+		}
 	}
 }
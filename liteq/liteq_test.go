@@ -1,32 +1,42 @@
 package liteq
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"log"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/lateefj/gq"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/lateefj/gq/gqtest"
 )
 
 var db *sql.DB
 
-const (
-	testPath = "/tmp/gq_liteq_test.db"
-)
+const testPath = "/tmp/gq_liteq_test.db"
 
 func init() {
 	var err error
 	os.Remove(testPath)
 
-	db, err = sql.Open("sqlite3", testPath)
+	db, err = sql.Open(DriverName, testDSN)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+var _ gq.DeadLetterQueue = (*Liteq)(nil)
+var _ gq.ContextMQ = (*Liteq)(nil)
+var _ gq.TxMQ = (*Liteq)(nil)
+var _ gq.Extender = (*Liteq)(nil)
+var _ gq.Extender = (*Group)(nil)
+var _ gq.StatsQueue = (*Liteq)(nil)
+var _ gq.Browser = (*Liteq)(nil)
+var _ gq.Restorer = (*Liteq)(nil)
+
 func setup() *Liteq {
 	return &Liteq{DB: db, Prefix: "test_"}
 }
@@ -47,6 +57,65 @@ func TestSchema(t *testing.T) {
 
 }
 
+// Test a table created by the first release is upgraded with the new columns and its
+// messages are still delivered
+func TestUpgradeSchema(t *testing.T) {
+	mq := setup()
+	defer cleanup(mq)
+	baseline := `
+CREATE TABLE IF NOT EXISTS test_q (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	checkout TIMESTAMP,
+	payload BLOB
+);
+CREATE INDEX IF NOT EXISTS test_q_timestamp_idx ON test_q (checkout ASC, timestamp ASC);
+INSERT INTO test_q (payload) VALUES ('before upgrade');
+`
+	if _, err := db.Exec(baseline); err != nil {
+		t.Fatalf("Could not create the baseline schema %s", err)
+	}
+	if err := mq.Create(); err != nil {
+		t.Fatalf("Could not upgrade the schema %s", err)
+	}
+	// Upgrading twice is a no op
+	if err := mq.Create(); err != nil {
+		t.Fatalf("Could not create the upgraded schema %s", err)
+	}
+	var old int
+	db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'test_q_timestamp_idx';").Scan(&old)
+	if old != 0 {
+		t.Errorf("Expected the old index to be replaced")
+	}
+	err := mq.Publish([]*gq.Message{&gq.Message{Payload: []byte("after upgrade"), Headers: map[string]string{"a": "b"}, Priority: 1}})
+	if err != nil {
+		t.Fatalf("Failed to publish after the upgrade %s", err)
+	}
+	ms, err := mq.ConsumeBatch(10)
+	if err != nil || len(ms) != 2 {
+		t.Fatalf("Expected both messages got %d error %v", len(ms), err)
+	}
+	if string(ms[0].Payload) != "after upgrade" || ms[0].Headers["a"] != "b" || string(ms[1].Payload) != "before upgrade" || ms[1].Attempts != 1 {
+		t.Errorf("Expected the new message by priority then the old one got %+v %+v", ms[0], ms[1])
+	}
+}
+
+// Test the driver gives the time precision and RETURNING support the queries rely on
+func TestCheckDriver(t *testing.T) {
+	err := CheckDriver(context.Background(), db)
+	if err != nil {
+		t.Fatalf("Expected the %s driver to pass the check got %s", DriverName, err)
+	}
+	mq := setup()
+	if err = mq.Create(); err != nil {
+		t.Fatalf("Could not create schema %s", err)
+	}
+	defer cleanup(mq)
+	if _, ok := checked.Load(db); !ok {
+		t.Error("Expected Create to remember the database passed the check")
+	}
+}
+
 func TestPublishConsume(t *testing.T) {
 	mq := setup()
 	err := mq.Create()
@@ -179,6 +248,110 @@ func TestStreamLifecycle(t *testing.T) {
 	}
 }
 
+// Test many consumers across separate connection pools never get the same message and
+// wait for each other whether or not the pools have a busy timeout
+func TestConcurrentConsumeNoDuplicates(t *testing.T) {
+	for _, tc := range []struct{ name, dsn string }{{"BusyTimeout", testDSN}, {"NoBusyTimeout", noBusyTimeoutDSN}} {
+		t.Run(tc.name, func(t *testing.T) { concurrentConsume(t, tc.dsn) })
+	}
+}
+
+func concurrentConsume(t *testing.T, dsn string) {
+	mq := setup()
+	err := mq.Create()
+	if err != nil {
+		t.Fatalf("Could not create schema %s", err)
+	}
+	defer cleanup(mq)
+
+	// Two more pools act like other processes sharing the file. The cgo driver runs
+	// pragmas as it opens a connection that would fail without a busy timeout while a
+	// consumer holds the lock, so every connection is opened before the consumers start.
+	consumers := 8
+	pools := make([]*sql.DB, 2)
+	for i := range pools {
+		pools[i], err = sql.Open(DriverName, dsn)
+		if err != nil {
+			t.Fatalf("Failed to open connection %s", err)
+		}
+		defer pools[i].Close()
+		size := consumers / len(pools)
+		pools[i].SetMaxOpenConns(size)
+		pools[i].SetMaxIdleConns(size)
+		conns := make([]*sql.Conn, size)
+		for j := range conns {
+			if conns[j], err = pools[i].Conn(context.Background()); err != nil {
+				t.Fatalf("Failed to open connection %s", err)
+			}
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+
+	total := 2000
+	messages := make([]*gq.Message, total)
+	for i := 0; i < total; i++ {
+		messages[i] = &gq.Message{Payload: []byte(fmt.Sprintf("%d", i))}
+	}
+	err = mq.Publish(messages)
+	if err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	seen := make(map[int64]int)
+	errs := make(chan error, consumers)
+	for c := 0; c < consumers; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			q := &Liteq{DB: pools[c%2], Prefix: mq.Prefix}
+			for {
+				batch, err := q.ConsumeBatch(7)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if len(batch) == 0 {
+					return
+				}
+				mutex.Lock()
+				for _, m := range batch {
+					seen[m.Id]++
+				}
+				mutex.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Consumer failed %s", err)
+	}
+	if len(seen) != total {
+		t.Errorf("Expected %d distinct messages however got %d", total, len(seen))
+	}
+	for id, count := range seen {
+		if count != 1 {
+			t.Errorf("Message %d was delivered %d times", id, count)
+		}
+	}
+}
+
+func TestTopics(t *testing.T) {
+	gqtest.RunTopics(t, func(t *testing.T) gqtest.TopicQueue[*Liteq] { return setup() })
+}
+
+func TestTx(t *testing.T) {
+	gqtest.RunTx(t, db, func(t *testing.T) gqtest.TxQueue { return setup() })
+}
+
+func TestGroups(t *testing.T) {
+	gqtest.RunGroups(t, func(t *testing.T) gqtest.GroupQueue[*Group] { return setup() })
+}
+
 func publishConsumeSize(b *testing.B, size int) {
 	b.ReportAllocs()
 
@@ -221,3 +394,12 @@ func BenchmarkPublishConsume10(b *testing.B)    { publishConsumeSize(b, 10) }
 func BenchmarkPublishConsume100(b *testing.B)   { publishConsumeSize(b, 100) }
 func BenchmarkPublishConsume1000(b *testing.B)  { publishConsumeSize(b, 1000) }
 func BenchmarkPublishConsume10000(b *testing.B) { publishConsumeSize(b, 10000) }
+
+func TestConformance(t *testing.T) {
+	queues := 0
+	gqtest.RunConformance(t, func(t *testing.T, cfg gqtest.Config) gq.MQ {
+		queues++
+		return &Liteq{DB: db, Prefix: fmt.Sprintf("conformance%d_", queues), TTL: cfg.TTL, MaxAttempts: cfg.MaxAttempts,
+			Backoff: cfg.Backoff, DedupWindow: cfg.DedupWindow, Aging: cfg.Aging}
+	})
+}
@@ -0,0 +1,48 @@
+package liteq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lateefj/gq"
+)
+
+// Stats ... Counts of the messages by state, the age of the oldest message and the size
+// of the database file. SQLite has no estimated counts so estimate is ignored.
+func (l *Liteq) Stats(ctx context.Context, estimate bool) (*gq.Stats, error) {
+	s := &gq.Stats{}
+	var age sql.NullFloat64
+	// Restore keeps the publish time so the lowest id is not always the oldest
+	ready, _ := l.state(gq.StateReady)
+	q := fmt.Sprintf("SELECT (JULIANDAY('now') - JULIANDAY(min(timestamp))) * 86400 FROM %sq WHERE %s;", l.Prefix, ready)
+	err := l.DB.QueryRowContext(ctx, q).Scan(&age)
+	if err != nil {
+		return nil, err
+	}
+	s.OldestAge = time.Duration(age.Float64 * float64(time.Second))
+
+	// Tables share the file so this is the size of the whole database
+	q = "SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size();"
+	if err = l.DB.QueryRowContext(ctx, q).Scan(&s.Bytes); err != nil {
+		return nil, err
+	}
+
+	// Counted in the same order they are scanned
+	columns := ""
+	for _, state := range []gq.MessageState{gq.StateReady, gq.StateInFlight, gq.StateExpired, gq.StateDelayed} {
+		condition, _ := l.state(state)
+		columns += fmt.Sprintf("COUNT(*) FILTER (WHERE %s), ", condition)
+	}
+	q = fmt.Sprintf("SELECT %sCOUNT(*) FROM %sq;", columns, l.Prefix)
+	err = l.DB.QueryRowContext(ctx, q).Scan(&s.Ready, &s.InFlight, &s.Expired, &s.Delayed, &s.Total)
+	if err != nil {
+		return nil, err
+	}
+	err = l.DB.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %sdlq;", l.Prefix)).Scan(&s.DeadLetters)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
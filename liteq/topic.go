@@ -0,0 +1,205 @@
+package liteq
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/lateefj/gq"
+)
+
+// Each topic gets its own tables named <prefix><topic>_ which are listed in the
+// <prefix>topics table
+var createTopicsSchema = `
+CREATE TABLE IF NOT EXISTS %stopics (
+	name TEXT NOT NULL PRIMARY KEY,
+	timestamp TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+`
+
+// Topic ... Queue for a named topic sharing the database and settings, the
+// topic tables are created and the topic registered on first use by PublishTopic
+// or CreateContext
+func (l *Liteq) Topic(name string) (*Liteq, error) {
+	if err := gq.ValidateTopic(name); err != nil {
+		return nil, err
+	}
+	l.topicMutex.Lock()
+	defer l.topicMutex.Unlock()
+	if t, ok := l.topics[name]; ok {
+		return t, nil
+	}
+	return l.newTopic(name), nil
+}
+
+func (l *Liteq) newTopic(name string) *Liteq {
+	return &Liteq{
+		DB:          l.DB,
+		Prefix:      fmt.Sprintf("%s%s_", l.Prefix, name),
+		TTL:         l.TTL,
+		MaxAttempts: l.MaxAttempts,
+		Backoff:     l.Backoff,
+		Retention:   l.Retention,
+		DedupWindow: l.DedupWindow,
+		Aging:       l.Aging,
+		mutex:       &sync.RWMutex{},
+		topic:       name,
+		parent:      l,
+	}
+}
+
+// ensureTopic ... Topic queue with its tables created and registered. The lock is not
+// held while the tables are created, creating is idempotent so concurrent first uses of
+// a topic can both do it and the first to finish is kept.
+func (l *Liteq) ensureTopic(ctx context.Context, name string) (*Liteq, error) {
+	if err := gq.ValidateTopic(name); err != nil {
+		return nil, err
+	}
+	l.topicMutex.Lock()
+	t, ok := l.topics[name]
+	l.topicMutex.Unlock()
+	if ok {
+		return t, nil
+	}
+	t = l.newTopic(name)
+	if err := t.CreateContext(ctx); err != nil {
+		return nil, err
+	}
+	l.topicMutex.Lock()
+	defer l.topicMutex.Unlock()
+	return l.topics[name], nil
+}
+
+// registerTopic ... Lists the topic in the topics table and keeps its queue, called
+// when a topic queue is created
+func (l *Liteq) registerTopic(ctx context.Context, t *Liteq) error {
+	_, err := l.DB.ExecContext(ctx, fmt.Sprintf(createTopicsSchema, l.Prefix))
+	if err != nil {
+		return err
+	}
+	q := fmt.Sprintf("INSERT OR IGNORE INTO %stopics (name) VALUES (?);", l.Prefix)
+	_, err = l.DB.ExecContext(ctx, q, t.topic)
+	if err != nil {
+		return err
+	}
+	l.topicMutex.Lock()
+	defer l.topicMutex.Unlock()
+	if _, ok := l.topics[t.topic]; ok {
+		return nil
+	}
+	if l.topics == nil {
+		l.topics = make(map[string]*Liteq)
+	}
+	l.topics[t.topic] = t
+	return nil
+}
+
+// PublishTopic ... Publish messages to a topic creating it if it does not exist
+func (l *Liteq) PublishTopic(ctx context.Context, topic string, messages []*gq.Message) error {
+	t, err := l.ensureTopic(ctx, topic)
+	if err != nil {
+		return err
+	}
+	return t.PublishContext(ctx, messages)
+}
+
+// ConsumeTopics ... Consume up to size messages across the topics, each message
+// has its Topic set. The starting topic rotates between calls so no topic starves.
+func (l *Liteq) ConsumeTopics(ctx context.Context, topics []string, size int) ([]*gq.ConsumerMessage, error) {
+	if len(topics) == 0 {
+		return make([]*gq.ConsumerMessage, 0), nil
+	}
+	l.topicMutex.Lock()
+	turn := l.topicTurn % len(topics)
+	l.topicTurn++
+	l.topicMutex.Unlock()
+	return gq.ConsumeTopics(ctx, topics, turn, size, func(ctx context.Context, topic string, size int) ([]*gq.ConsumerMessage, error) {
+		t, err := l.ensureTopic(ctx, topic)
+		if err != nil {
+			return nil, err
+		}
+		return t.ConsumeBatchContext(ctx, size)
+	})
+}
+
+// CommitTopics ... Commit receipts to the topics they were consumed from, receipts
+// without a topic go to this queue. Each topic commits in its own transaction.
+func (l *Liteq) CommitTopics(ctx context.Context, recipts []*gq.Receipt) error {
+	return gq.CommitTopics(ctx, recipts, func(ctx context.Context, topic string, rs []*gq.Receipt) error {
+		if topic == "" {
+			return l.CommitContext(ctx, rs)
+		}
+		t, err := l.ensureTopic(ctx, topic)
+		if err != nil {
+			return err
+		}
+		return t.CommitContext(ctx, rs)
+	})
+}
+
+// Topics ... Names of the topics that exist
+func (l *Liteq) Topics(ctx context.Context) ([]string, error) {
+	names := make([]string, 0)
+	ok, err := l.hasTopics(ctx)
+	if err != nil || !ok {
+		return names, err
+	}
+	rows, err := l.DB.QueryContext(ctx, fmt.Sprintf("SELECT name FROM %stopics ORDER BY name ASC;", l.Prefix))
+	if err != nil {
+		return names, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return names, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// DeleteTopic ... Removes the topic tables and everything in them
+func (l *Liteq) DeleteTopic(ctx context.Context, name string) error {
+	t, err := l.Topic(name)
+	if err != nil {
+		return err
+	}
+	return t.DestroyContext(ctx)
+}
+
+// unregisterTopic ... Forgets the topic and removes it from the topics table, called
+// when a topic queue is destroyed
+func (l *Liteq) unregisterTopic(ctx context.Context, name string) error {
+	l.topicMutex.Lock()
+	delete(l.topics, name)
+	l.topicMutex.Unlock()
+	ok, err := l.hasTopics(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	_, err = l.DB.ExecContext(ctx, fmt.Sprintf("DELETE FROM %stopics WHERE name = ?;", l.Prefix), name)
+	return err
+}
+
+// hasTopics ... Whether the topics table exists, it is created when the first topic is
+// registered
+func (l *Liteq) hasTopics(ctx context.Context) (bool, error) {
+	var ok bool
+	err := l.DB.QueryRowContext(ctx, "SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = ?;", l.Prefix+"topics").Scan(&ok)
+	return ok, err
+}
+
+// destroyTopics ... Removes every registered topic
+func (l *Liteq) destroyTopics(ctx context.Context) error {
+	names, err := l.Topics(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err = l.DeleteTopic(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
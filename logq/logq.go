@@ -0,0 +1,673 @@
+// Package logq is a queue kept in append only segment files. The segments are only read
+// when the queue is created, every message that has not been committed is held in memory
+// with its payload and headers, so the memory used grows with the backlog and not just
+// with what is checked out.
+package logq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lateefj/gq"
+)
+
+// ErrClosed returned when the queue is used before Create or after Close
+var ErrClosed = errors.New("logq: queue is not open")
+
+// SyncPolicy when writes are flushed to disk with fsync
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs before every publish and commit returns so nothing acknowledged
+	// is lost in a crash
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs at most every SyncEvery, writes are also fsynced in the
+	// background so a crash can only lose those of the last SyncEvery
+	SyncInterval
+	// SyncNever leaves flushing to the operating system
+	SyncNever
+)
+
+// DefaultSegmentSize size after which a new segment is started
+const DefaultSegmentSize = 64 << 20
+
+// entry ... Message in the queue with the checkout state that is only kept in memory
+type entry struct {
+	gq.ConsumerMessage
+	visibleAt  time.Time
+	leaseUntil time.Time
+}
+
+// Logq Structure for a queue stored in append only segment files in a directory, for
+// when there is no database. Published messages are appended to the newest segment and
+// committed ids to an ack index, a segment is deleted once every message in it has been
+// committed. Checkouts are only kept in memory so after a crash or restart messages that
+// were checked out are delivered again with their attempts reset. Create opens the queue
+// recovering it from the segments and Close releases the files.
+type Logq struct {
+	Dir string
+	TTL time.Duration
+	// Delay before a failed message is delivered again, nil means right away
+	Backoff gq.Backoff
+	// Size after which a new segment is started, defaults to DefaultSegmentSize
+	SegmentSize int64
+	// When writes are fsynced, defaults to SyncAlways
+	Sync SyncPolicy
+	// How often writes are fsynced with SyncInterval
+	SyncEvery  time.Duration
+	mutex      sync.Mutex
+	exit       bool
+	open       bool
+	lastId     int64
+	messages   []*entry
+	segments   []*segment
+	acked      map[int64]bool
+	active     *os.File
+	activeSize int64
+	acks       *os.File
+	acksSize   int64
+	lastSync   time.Time
+	// Writes made since the last fsync with SyncInterval
+	dirty bool
+	// Error from a background fsync, returned by the next write
+	syncErr error
+	done    chan struct{}
+}
+
+// NewLogq ... Queue stored in the directory with the default settings
+func NewLogq(dir string) *Logq {
+	return &Logq{Dir: dir}
+}
+
+// ttl ... Message TTL falling back to the queue TTL, with neither a checkout never expires
+func (l *Logq) ttl(e *entry) time.Duration {
+	if e.TTL > 0 {
+		return e.TTL
+	}
+	return l.TTL
+}
+
+// expired ... Checked out message that is available again because the TTL and any
+// lease extension have passed
+func (l *Logq) expired(e *entry, now time.Time) bool {
+	ttl := l.ttl(e)
+	if e.Checkout.IsZero() || ttl <= 0 {
+		return false
+	}
+	return e.Checkout.Add(ttl).Before(now) && (e.leaseUntil.IsZero() || e.leaseUntil.Before(now))
+}
+
+// available ... Message that can be checked out
+func (l *Logq) available(e *entry, now time.Time) bool {
+	return !e.visibleAt.After(now) && (e.Checkout.IsZero() || l.expired(e, now))
+}
+
+// segmentFor ... Index of the segment holding the id
+func (l *Logq) segmentFor(id int64) int {
+	return sort.Search(len(l.segments), func(i int) bool { return l.segments[i].first > id }) - 1
+}
+
+// Create ... Opens the queue creating the directory or recovering the messages in it
+func (l *Logq) Create() error {
+	return l.CreateContext(context.Background())
+}
+
+// CreateContext ... Opens the queue creating the directory or recovering the messages in it.
+// Segments are scanned in order, a partly written record left by a crash is truncated and
+// segments with every message committed are deleted.
+func (l *Logq) CreateContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.open {
+		return nil
+	}
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	acksPath := filepath.Join(l.Dir, acksFile)
+	acked, acksSize, err := readAcks(acksPath)
+	if err != nil {
+		return err
+	}
+	segments, err := listSegments(l.Dir)
+	if err != nil {
+		return err
+	}
+	l.acked = acked
+	l.messages = nil
+	l.segments = nil
+	l.lastId = 0
+	var activeSize int64
+	for _, s := range segments {
+		records, size, err := readSegment(s.path)
+		if err != nil {
+			return err
+		}
+		if err = os.Truncate(s.path, size); err != nil {
+			return err
+		}
+		for _, r := range records {
+			if r.Id > l.lastId {
+				l.lastId = r.Id
+			}
+			if acked[r.Id] {
+				continue
+			}
+			e := &entry{visibleAt: r.VisibleAt}
+			e.Id = r.Id
+			e.Payload = r.Payload
+			e.Headers = r.Headers
+			e.TTL = r.TTL
+			e.OrderingKey = r.OrderingKey
+			e.Priority = r.Priority
+			e.Timestamp = r.Timestamp
+			l.messages = append(l.messages, e)
+			s.live++
+		}
+		l.segments = append(l.segments, s)
+		activeSize = size
+	}
+	// Ids continue after an empty newest segment
+	if n := len(l.segments); n > 0 && l.segments[n-1].first > l.lastId {
+		l.lastId = l.segments[n-1].first - 1
+	}
+	if len(l.segments) == 0 {
+		s := &segment{path: segmentPath(l.Dir, l.lastId+1), first: l.lastId + 1}
+		l.segments = append(l.segments, s)
+		activeSize = 0
+	}
+	l.active, err = os.OpenFile(l.segments[len(l.segments)-1].path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.activeSize = activeSize
+	if err = os.Truncate(acksPath, acksSize); err != nil && !os.IsNotExist(err) {
+		l.active.Close()
+		return err
+	}
+	l.acks, err = os.OpenFile(acksPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		l.active.Close()
+		return err
+	}
+	l.acksSize = acksSize
+	if l.Sync != SyncNever {
+		// The active segment and ack index may have just been created
+		if err = syncDir(l.Dir); err != nil {
+			l.active.Close()
+			l.acks.Close()
+			return err
+		}
+	}
+	l.open = true
+	l.lastSync = time.Now()
+	l.dirty = false
+	l.syncErr = nil
+	if err = l.compact(); err != nil {
+		l.close()
+		return err
+	}
+	if l.Sync == SyncInterval && l.SyncEvery > 0 {
+		l.done = make(chan struct{})
+		go l.syncLoop(l.done, l.SyncEvery)
+	}
+	return nil
+}
+
+// syncLoop ... Flushes writes left unsynced by SyncInterval until done is closed
+func (l *Logq) syncLoop(done chan struct{}, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		l.mutex.Lock()
+		if l.open && l.dirty && time.Since(l.lastSync) >= every {
+			if err := l.flush(); err != nil && l.syncErr == nil {
+				l.syncErr = err
+			}
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// Close ... Flushes and closes the files, Create opens the queue again
+func (l *Logq) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.open {
+		return nil
+	}
+	return l.close()
+}
+
+func (l *Logq) close() error {
+	l.open = false
+	if l.done != nil {
+		close(l.done)
+		l.done = nil
+	}
+	err := l.active.Sync()
+	if closeErr := l.active.Close(); err == nil {
+		err = closeErr
+	}
+	if syncErr := l.acks.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := l.acks.Close(); err == nil {
+		err = closeErr
+	}
+	l.messages = nil
+	return err
+}
+
+// Destroy ... Closes the queue and removes the segments and ack index, the directory is kept
+func (l *Logq) Destroy() error {
+	return l.DestroyContext(context.Background())
+}
+
+// DestroyContext ... Closes the queue and removes the segments and ack index, the directory is kept
+func (l *Logq) DestroyContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.open {
+		l.close()
+	}
+	segments, err := listSegments(l.Dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if err = os.Remove(s.path); err != nil {
+			return err
+		}
+	}
+	for _, name := range []string{acksFile, acksFile + ".tmp"} {
+		if err = os.Remove(filepath.Join(l.Dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	l.segments = nil
+	l.acked = nil
+	l.lastId = 0
+	return nil
+}
+
+// sync ... Flushes the files when the sync policy calls for it
+func (l *Logq) sync() error {
+	if err := l.syncErr; err != nil {
+		l.syncErr = nil
+		return err
+	}
+	switch l.Sync {
+	case SyncNever:
+		return nil
+	case SyncInterval:
+		if time.Since(l.lastSync) < l.SyncEvery {
+			l.dirty = true
+			return nil
+		}
+	}
+	return l.flush()
+}
+
+// flush ... Fsyncs the active segment and ack index
+func (l *Logq) flush() error {
+	l.lastSync = time.Now()
+	l.dirty = false
+	if err := l.active.Sync(); err != nil {
+		l.dirty = true
+		return err
+	}
+	if err := l.acks.Sync(); err != nil {
+		l.dirty = true
+		return err
+	}
+	return nil
+}
+
+// rotate ... Starts a new segment for the messages after the last id
+func (l *Logq) rotate() error {
+	if l.Sync != SyncNever {
+		if err := l.active.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := l.active.Close(); err != nil {
+		return err
+	}
+	s := &segment{path: segmentPath(l.Dir, l.lastId+1), first: l.lastId + 1}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.segments = append(l.segments, s)
+	l.active = f
+	l.activeSize = 0
+	if l.Sync != SyncNever {
+		if err = syncDir(l.Dir); err != nil {
+			return err
+		}
+	}
+	return l.compact()
+}
+
+// compact ... Deletes every segment but the active one that has no live messages and
+// drops their ids from the ack index
+func (l *Logq) compact() error {
+	kept := make([]*segment, 0, len(l.segments))
+	removed := false
+	for i, s := range l.segments {
+		if s.live > 0 || i == len(l.segments)-1 {
+			kept = append(kept, s)
+			continue
+		}
+		if err := os.Remove(s.path); err != nil {
+			return err
+		}
+		next := l.segments[i+1].first
+		for id := s.first; id < next; id++ {
+			delete(l.acked, id)
+		}
+		removed = true
+	}
+	l.segments = kept
+	if !removed {
+		return nil
+	}
+	path := filepath.Join(l.Dir, acksFile)
+	if err := l.acks.Close(); err != nil {
+		return err
+	}
+	// Removed segments are flushed from the directory along with the renamed index
+	err := writeAcks(path, l.acked)
+	// The index is reopened even when the rewrite failed so the queue stays usable
+	f, openErr := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if openErr != nil {
+		return openErr
+	}
+	l.acks = f
+	info, statErr := f.Stat()
+	if statErr != nil {
+		return statErr
+	}
+	l.acksSize = info.Size()
+	return err
+}
+
+// StopConsumer ... Stop consuming messages
+func (l *Logq) StopConsumer() {
+	l.mutex.Lock()
+	l.exit = true
+	l.mutex.Unlock()
+}
+
+// Exit ...
+func (l *Logq) Exit() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.exit
+}
+
+// Publish ... Appends the messages to the newest segment
+func (l *Logq) Publish(messages []*gq.Message) error {
+	return l.PublishContext(context.Background(), messages)
+}
+
+// PublishContext ... Appends the messages to the newest segment, idempotency keys are not
+// checked
+func (l *Logq) PublishContext(ctx context.Context, messages []*gq.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.open {
+		return ErrClosed
+	}
+	segmentSize := l.SegmentSize
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	now := time.Now().UTC()
+	for _, m := range messages {
+		r := &record{Id: l.lastId + 1, Timestamp: now, VisibleAt: now, TTL: m.TTL, OrderingKey: m.OrderingKey,
+			Priority: m.Priority, Headers: m.Headers, Payload: m.Payload}
+		if !m.NotBefore.IsZero() {
+			r.VisibleAt = m.NotBefore
+		}
+		frame, err := encodeRecord(r)
+		if err != nil {
+			return err
+		}
+		if _, err = l.active.Write(frame); err != nil {
+			// A partly written frame would hide every record appended after it
+			if truncErr := l.active.Truncate(l.activeSize); truncErr != nil {
+				return fmt.Errorf("logq: write failed %v and truncating the segment failed %w", err, truncErr)
+			}
+			return err
+		}
+		l.lastId = r.Id
+		l.activeSize += int64(len(frame))
+		l.segments[len(l.segments)-1].live++
+		e := &entry{visibleAt: r.VisibleAt}
+		e.Id = r.Id
+		e.Message = *m.Clone()
+		e.Timestamp = now
+		l.messages = append(l.messages, e)
+		if l.activeSize >= segmentSize {
+			if err = l.rotate(); err != nil {
+				return err
+			}
+		}
+	}
+	return l.sync()
+}
+
+// Commit ... Records messages that succeeded in the ack index and releases those that failed
+func (l *Logq) Commit(recipts []*gq.Receipt) error {
+	return l.CommitContext(context.Background(), recipts)
+}
+
+// CommitContext ... Records messages that succeeded in the ack index, deleting segments
+// that have no messages left, failed messages are released for retry after the backoff
+func (l *Logq) CommitContext(ctx context.Context, recipts []*gq.Receipt) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.open {
+		return ErrClosed
+	}
+	now := time.Now().UTC()
+	results := make(map[int64]*gq.Receipt, len(recipts))
+	for _, r := range recipts {
+		results[r.Id] = r
+	}
+	kept := l.messages[:0]
+	var err error
+	for _, e := range l.messages {
+		r, ok := results[e.Id]
+		if !ok || err != nil {
+			kept = append(kept, e)
+			continue
+		}
+		if !r.Success {
+			e.Checkout = time.Time{}
+			e.leaseUntil = time.Time{}
+			e.visibleAt = now
+			if l.Backoff != nil {
+				e.visibleAt = now.Add(l.Backoff.Delay(e.Attempts))
+			}
+			kept = append(kept, e)
+			continue
+		}
+		if _, err = l.acks.Write(encodeAck(e.Id)); err != nil {
+			// A partly written id would misalign every id appended after it
+			if truncErr := l.acks.Truncate(l.acksSize); truncErr != nil {
+				err = fmt.Errorf("logq: write failed %v and truncating the ack index failed %w", err, truncErr)
+			}
+			kept = append(kept, e)
+			continue
+		}
+		l.acksSize += 8
+		l.acked[e.Id] = true
+		if i := l.segmentFor(e.Id); i >= 0 {
+			l.segments[i].live--
+		}
+	}
+	for i := len(kept); i < len(l.messages); i++ {
+		l.messages[i] = nil
+	}
+	l.messages = kept
+	if err != nil {
+		return err
+	}
+	if err = l.sync(); err != nil {
+		return err
+	}
+	return l.compact()
+}
+
+// Extend ... Extends the lease on checked out messages so they are not delivered again
+// until lease from now even if the TTL passes, see gq.Heartbeat
+func (l *Logq) Extend(ctx context.Context, ms []*gq.ConsumerMessage, lease time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	checkouts := make(map[int64]time.Time, len(ms))
+	for _, m := range ms {
+		checkouts[m.Id] = m.Checkout
+	}
+	leaseUntil := time.Now().UTC().Add(lease)
+	for _, e := range l.messages {
+		if checkout, ok := checkouts[e.Id]; ok && !e.Checkout.IsZero() && e.Checkout.Equal(checkout) {
+			e.leaseUntil = leaseUntil
+		}
+	}
+	return nil
+}
+
+// ConsumeBatch ... This consumes a number of messages up to the limit
+func (l *Logq) ConsumeBatch(size int) ([]*gq.ConsumerMessage, error) {
+	return l.ConsumeBatchContext(context.Background(), size)
+}
+
+// ConsumeBatchContext ... Checks out up to size messages, highest priority first then
+// oldest first, only the oldest message of an ordering key is delivered at a time
+func (l *Logq) ConsumeBatchContext(ctx context.Context, size int) ([]*gq.ConsumerMessage, error) {
+	ms := make([]*gq.ConsumerMessage, 0)
+	if err := ctx.Err(); err != nil {
+		return ms, err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.open {
+		return ms, ErrClosed
+	}
+	now := time.Now().UTC()
+	candidates := make([]*entry, 0)
+	// Messages are in id order so the first seen for a key is the oldest
+	keys := make(map[string]bool)
+	for _, e := range l.messages {
+		if e.OrderingKey != "" {
+			if keys[e.OrderingKey] {
+				continue
+			}
+			keys[e.OrderingKey] = true
+		}
+		if l.available(e, now) {
+			candidates = append(candidates, e)
+		}
+	}
+	// Like the database backends messages never checked out come before expired ones
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if !a.Checkout.Equal(b.Checkout) {
+			return a.Checkout.Before(b.Checkout)
+		}
+		return a.Priority > b.Priority
+	})
+	if size < len(candidates) {
+		candidates = candidates[:size]
+	}
+	for _, e := range candidates {
+		e.Checkout = now
+		e.leaseUntil = time.Time{}
+		e.Attempts++
+		c := e.ConsumerMessage
+		c.Message = *e.Clone()
+		ms = append(ms, &c)
+	}
+	return ms, nil
+}
+
+// unlock ... Returns checked out messages that were never handed to a consumer to the
+// queue straight away, the delivery does not count as an attempt
+func (l *Logq) unlock(ms []*gq.ConsumerMessage) {
+	checkouts := make(map[int64]time.Time, len(ms))
+	for _, m := range ms {
+		checkouts[m.Id] = m.Checkout
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, e := range l.messages {
+		if checkout, ok := checkouts[e.Id]; ok && e.Checkout.Equal(checkout) {
+			e.Checkout = time.Time{}
+			e.leaseUntil = time.Time{}
+			e.Attempts--
+		}
+	}
+}
+
+// Stream ... Creates a stream of consumption
+func (l *Logq) Stream(size int, messages chan []*gq.ConsumerMessage, pause time.Duration) {
+	l.StreamContext(context.Background(), size, messages, pause)
+}
+
+// StreamContext ... Creates a stream of consumption that ends when the context is done
+// or StopConsumer is called
+func (l *Logq) StreamContext(ctx context.Context, size int, messages chan []*gq.ConsumerMessage, pause time.Duration) {
+	defer close(messages)
+	for {
+		// Consume until there are no more messages or there is an error
+		for {
+			if l.Exit() || ctx.Err() != nil {
+				return
+			}
+			ms, err := l.ConsumeBatchContext(ctx, size)
+			if len(ms) == 0 || err != nil {
+				break
+			}
+			select {
+			case messages <- ms:
+			case <-ctx.Done():
+				l.unlock(ms)
+				return
+			}
+		}
+		select {
+		case <-time.After(pause):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package logq
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lateefj/gq"
+	"github.com/lateefj/gq/gqtest"
+)
+
+var _ gq.ContextMQ = (*Logq)(nil)
+var _ gq.Extender = (*Logq)(nil)
+
+func setup(t *testing.T) *Logq {
+	mq := NewLogq(t.TempDir())
+	if err := mq.Create(); err != nil {
+		t.Fatalf("Could not create queue %s", err)
+	}
+	return mq
+}
+
+// reopen ... Same queue after a restart
+func reopen(t *testing.T, mq *Logq) *Logq {
+	if err := mq.Close(); err != nil {
+		t.Fatalf("Could not close queue %s", err)
+	}
+	restarted := &Logq{Dir: mq.Dir, SegmentSize: mq.SegmentSize}
+	if err := restarted.Create(); err != nil {
+		t.Fatalf("Could not reopen queue %s", err)
+	}
+	return restarted
+}
+
+func publish(t *testing.T, mq *Logq, size int) {
+	messages := make([]*gq.Message, size)
+	for i := range messages {
+		messages[i] = &gq.Message{Payload: []byte(fmt.Sprintf("%d", i)), Headers: map[string]string{"n": fmt.Sprintf("%d", i)}}
+	}
+	if err := mq.Publish(messages); err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+}
+
+func segmentFiles(t *testing.T, mq *Logq) int {
+	paths, err := filepath.Glob(filepath.Join(mq.Dir, "*"+segmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(paths)
+}
+
+func TestConformance(t *testing.T) {
+	gqtest.RunConformance(t, func(t *testing.T, cfg gqtest.Config) gq.MQ {
+		// Dead letters, deduplication and aging are not supported
+		if cfg.MaxAttempts > 0 || cfg.DedupWindow > 0 || cfg.Aging > 0 {
+			return nil
+		}
+		return &Logq{Dir: t.TempDir(), TTL: cfg.TTL, Backoff: cfg.Backoff, Sync: SyncNever}
+	})
+}
+
+// Test committed messages stay committed and the rest are delivered again after a restart
+func TestRecovery(t *testing.T) {
+	mq := setup(t)
+	publish(t, mq, 5)
+	ms, err := mq.ConsumeBatch(3)
+	if err != nil || len(ms) != 3 {
+		t.Fatalf("Expected 3 messages got %d error %v", len(ms), err)
+	}
+	err = mq.Commit([]*gq.Receipt{&gq.Receipt{Id: ms[0].Id, Success: true}, &gq.Receipt{Id: ms[2].Id, Success: true}})
+	if err != nil {
+		t.Fatalf("Failed to commit %s", err)
+	}
+
+	mq = reopen(t, mq)
+	defer mq.Close()
+	ms, err = mq.ConsumeBatch(10)
+	if err != nil || len(ms) != 3 {
+		t.Fatalf("Expected the 3 uncommitted messages got %d error %v", len(ms), err)
+	}
+	for i, payload := range []string{"1", "3", "4"} {
+		if string(ms[i].Payload) != payload || ms[i].Headers["n"] != payload || ms[i].Attempts != 1 {
+			t.Errorf("Expected message %s recovered got %+v", payload, ms[i])
+		}
+	}
+	// New ids carry on after the recovered ones
+	publish(t, mq, 1)
+	next, _ := mq.ConsumeBatch(1)
+	if len(next) != 1 || next[0].Id != 6 {
+		t.Errorf("Expected the next id to be 6 got %+v", next)
+	}
+}
+
+// Test a record cut short by a crash is dropped and the queue keeps working
+func TestTornWrite(t *testing.T) {
+	mq := setup(t)
+	publish(t, mq, 2)
+	mq.Close()
+	path := segmentPath(mq.Dir, 1)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cut the last record in half
+	if err = os.Truncate(path, info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+	mq = &Logq{Dir: mq.Dir}
+	if err = mq.Create(); err != nil {
+		t.Fatalf("Could not recover queue %s", err)
+	}
+	defer mq.Close()
+	publish(t, mq, 1)
+	ms, _ := mq.ConsumeBatch(10)
+	if len(ms) != 2 || string(ms[0].Payload) != "0" || ms[1].Id != 2 {
+		t.Fatalf("Expected the intact message and the new one got %+v", ms)
+	}
+	mq = reopen(t, mq)
+	defer mq.Close()
+	if ms, _ = mq.ConsumeBatch(10); len(ms) != 2 {
+		t.Errorf("Expected the segment to be readable after the new write got %d messages", len(ms))
+	}
+}
+
+// Test a segment is deleted once every message in it is committed
+func TestSegmentCleanup(t *testing.T) {
+	mq := NewLogq(t.TempDir())
+	mq.SegmentSize = 256
+	if err := mq.Create(); err != nil {
+		t.Fatalf("Could not create queue %s", err)
+	}
+	defer mq.Destroy()
+	publish(t, mq, 20)
+	segments := segmentFiles(t, mq)
+	if segments < 3 {
+		t.Fatalf("Expected messages spread over several segments got %d", segments)
+	}
+	ms, _ := mq.ConsumeBatch(10)
+	receipts := make([]*gq.Receipt, len(ms))
+	for i, m := range ms {
+		receipts[i] = &gq.Receipt{Id: m.Id, Success: true}
+	}
+	if err := mq.Commit(receipts); err != nil {
+		t.Fatalf("Failed to commit %s", err)
+	}
+	remaining := segmentFiles(t, mq)
+	if remaining >= segments {
+		t.Fatalf("Expected committed segments to be deleted still have %d of %d", remaining, segments)
+	}
+	mq = reopen(t, mq)
+	ms, _ = mq.ConsumeBatch(20)
+	if len(ms) != 10 || string(ms[0].Payload) != "10" {
+		t.Errorf("Expected the 10 uncommitted messages after cleanup got %d", len(ms))
+	}
+	if _, err := os.Stat(filepath.Join(mq.Dir, acksFile)); err != nil {
+		t.Errorf("Expected the ack index to exist %s", err)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	mq := NewLogq(t.TempDir())
+	if err := mq.Publish([]*gq.Message{&gq.Message{Payload: []byte("test")}}); err != ErrClosed {
+		t.Errorf("Expected closed error before create got %v", err)
+	}
+}
+
+func TestSyncInterval(t *testing.T) {
+	mq := &Logq{Dir: t.TempDir(), Sync: SyncInterval, SyncEvery: 20 * time.Millisecond}
+	if err := mq.Create(); err != nil {
+		t.Fatalf("Could not create queue %s", err)
+	}
+	defer mq.Close()
+	publish(t, mq, 1)
+	publish(t, mq, 1)
+	dirty := func() bool {
+		mq.mutex.Lock()
+		defer mq.mutex.Unlock()
+		return mq.dirty
+	}
+	if !dirty() {
+		t.Fatal("Expected the second publish to be left for the background sync")
+	}
+	deadline := time.Now().Add(time.Second)
+	for dirty() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the last writes to be synced in the background")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,177 @@
+package logq
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	segmentExt = ".seg"
+	acksFile   = "acks.idx"
+	// frameHeader length then checksum of the record body
+	frameHeader = 8
+)
+
+// record ... Message as it is written to a segment
+type record struct {
+	Id          int64             `json:"id"`
+	Timestamp   time.Time         `json:"timestamp"`
+	VisibleAt   time.Time         `json:"visible_at"`
+	TTL         time.Duration     `json:"ttl,omitempty"`
+	OrderingKey string            `json:"ordering_key,omitempty"`
+	Priority    int               `json:"priority,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Payload     []byte            `json:"payload"`
+}
+
+// segment ... File holding the messages with ids from first up to the next segment
+type segment struct {
+	path  string
+	first int64
+	// Messages in the segment that have not been committed
+	live int
+}
+
+// segmentPath ... File name for the segment starting at first, zero padded so names sort by id
+func segmentPath(dir string, first int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", first, segmentExt))
+}
+
+// encodeRecord ... Frame for the record, the length and checksum let a torn write be detected
+func encodeRecord(r *record) ([]byte, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, frameHeader+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(body))
+	copy(frame[frameHeader:], body)
+	return frame, nil
+}
+
+// readSegment ... Records in the segment file and the size of the valid part of it,
+// reading stops at the first incomplete or corrupt frame left by a crash
+func readSegment(path string) ([]*record, int64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	records := make([]*record, 0)
+	var offset int64
+	for int64(len(b))-offset >= frameHeader {
+		size := int64(binary.BigEndian.Uint32(b[offset:]))
+		sum := binary.BigEndian.Uint32(b[offset+4:])
+		end := offset + frameHeader + size
+		if end > int64(len(b)) {
+			break
+		}
+		body := b[offset+frameHeader : end]
+		if crc32.ChecksumIEEE(body) != sum {
+			break
+		}
+		r := &record{}
+		if err = json.Unmarshal(body, r); err != nil {
+			break
+		}
+		records = append(records, r)
+		offset = end
+	}
+	return records, offset, nil
+}
+
+// listSegments ... Segment files in the directory ordered by first id
+func listSegments(dir string) ([]*segment, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	segments := make([]*segment, 0, len(paths))
+	for _, p := range paths {
+		s := &segment{path: p}
+		if _, err = fmt.Sscanf(filepath.Base(p), "%d"+segmentExt, &s.first); err != nil {
+			return nil, fmt.Errorf("logq: unexpected segment file %s", p)
+		}
+		segments = append(segments, s)
+	}
+	return segments, nil
+}
+
+// encodeAck ... Entry in the ack index
+func encodeAck(id int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return b
+}
+
+// readAcks ... Ids in the ack index and the size of the valid part of it
+func readAcks(path string) (map[int64]bool, int64, error) {
+	acked := make(map[int64]bool)
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return acked, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	// A torn write leaves a partial id at the end
+	size := int64(len(b)) / 8 * 8
+	for i := int64(0); i < size; i += 8 {
+		acked[int64(binary.BigEndian.Uint64(b[i:]))] = true
+	}
+	return acked, size, nil
+}
+
+// writeAcks ... Replaces the ack index with the ids, written to a temporary file and renamed
+// so a crash leaves either the old or the new index
+func writeAcks(path string, acked map[int64]bool) error {
+	ids := make([]int64, 0, len(acked))
+	for id := range acked {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	b := make([]byte, 0, len(ids)*8)
+	for _, id := range ids {
+		b = append(b, encodeAck(id)...)
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir ... Flushes the directory so files created, renamed or removed in it survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+package memq
+
+import (
+	"context"
+	"time"
+
+	"github.com/lateefj/gq"
+)
+
+// Purge ... Removes every message, dead letters are kept
+func (m *Memq) Purge(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	m.messages = nil
+	m.mutex.Unlock()
+	return nil
+}
+
+// ReleaseCheckouts ... Makes checked out messages available again, those checked out longer
+// than olderThan or when it is 0 those past their TTL
+func (m *Memq) ReleaseCheckouts(ctx context.Context, olderThan time.Duration) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := m.now()
+	var released int64
+	for _, e := range m.messages {
+		if e.Checkout.IsZero() {
+			continue
+		}
+		if (olderThan > 0 && e.Checkout.Before(now.Add(-olderThan))) || (olderThan <= 0 && m.expired(e, now)) {
+			e.Checkout = time.Time{}
+			e.leaseUntil = time.Time{}
+			released++
+		}
+	}
+	return released, nil
+}
+
+// Restore ... Publishes messages keeping their publish time and attempts, ids are
+// assigned by the queue. Idempotency keys are not checked.
+func (m *Memq) Restore(ctx context.Context, messages []*gq.ConsumerMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := m.now()
+	for _, c := range messages {
+		e := &entry{visibleAt: now}
+		e.Message = *c.Clone()
+		e.Timestamp = c.Timestamp
+		e.Attempts = c.Attempts
+		if e.Timestamp.IsZero() {
+			e.Timestamp = now
+		}
+		if !c.NotBefore.IsZero() {
+			e.visibleAt = c.NotBefore
+		}
+		m.insert(e)
+	}
+	return nil
+}
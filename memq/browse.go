@@ -0,0 +1,96 @@
+package memq
+
+import (
+	"context"
+	"time"
+
+	"github.com/lateefj/gq"
+)
+
+// state ... Condition for messages in the state
+func (m *Memq) state(state gq.MessageState) (func(e *entry, now time.Time) bool, error) {
+	switch state {
+	case gq.StateAll:
+		return func(e *entry, now time.Time) bool { return true }, nil
+	case gq.StateReady:
+		return func(e *entry, now time.Time) bool { return e.Checkout.IsZero() && !e.visibleAt.After(now) }, nil
+	case gq.StateInFlight:
+		return func(e *entry, now time.Time) bool { return !e.Checkout.IsZero() && !m.expired(e, now) }, nil
+	case gq.StateExpired:
+		return func(e *entry, now time.Time) bool { return m.expired(e, now) }, nil
+	case gq.StateDelayed:
+		return func(e *entry, now time.Time) bool { return e.Checkout.IsZero() && e.visibleAt.After(now) }, nil
+	}
+	return nil, gq.ErrInvalidState
+}
+
+// Browse ... Messages ordered by id without checking them out, delayed messages have
+// NotBefore set to when they become visible
+func (m *Memq) Browse(ctx context.Context, opts gq.BrowseOptions) ([]*gq.ConsumerMessage, error) {
+	ms := make([]*gq.ConsumerMessage, 0)
+	if err := ctx.Err(); err != nil {
+		return ms, err
+	}
+	condition, err := m.state(opts.State)
+	if err != nil {
+		return ms, err
+	}
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := m.now()
+	for _, e := range m.messages {
+		if len(ms) == limit {
+			break
+		}
+		if e.Id <= opts.After || e.Timestamp.Before(opts.Since) || !condition(e, now) {
+			continue
+		}
+		c := e.ConsumerMessage
+		c.Message = *e.Clone()
+		c.NotBefore = time.Time{}
+		if e.visibleAt.After(now) {
+			c.NotBefore = e.visibleAt
+		}
+		ms = append(ms, &c)
+	}
+	return ms, nil
+}
+
+// Stats ... Counts of the messages by state, the age of the oldest message and the size
+// of the payloads. Counts are always exact so estimate is ignored.
+func (m *Memq) Stats(ctx context.Context, estimate bool) (*gq.Stats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := m.now()
+	s := &gq.Stats{Total: int64(len(m.messages)), DeadLetters: int64(len(m.dead))}
+	// Restore keeps the publish time so the lowest id is not always the oldest
+	ready, _ := m.state(gq.StateReady)
+	for _, e := range m.messages {
+		if ready(e, now) && now.Sub(e.Timestamp) > s.OldestAge {
+			s.OldestAge = now.Sub(e.Timestamp)
+		}
+	}
+	counts := map[gq.MessageState]*int64{gq.StateReady: &s.Ready, gq.StateInFlight: &s.InFlight, gq.StateExpired: &s.Expired, gq.StateDelayed: &s.Delayed}
+	for state, count := range counts {
+		condition, _ := m.state(state)
+		for _, e := range m.messages {
+			if condition(e, now) {
+				*count++
+			}
+		}
+	}
+	for _, e := range m.messages {
+		s.Bytes += int64(len(e.Payload))
+	}
+	for _, d := range m.dead {
+		s.Bytes += int64(len(d.Payload))
+	}
+	return s, nil
+}
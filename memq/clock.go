@@ -0,0 +1,49 @@
+package memq
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock source of the current time for a queue
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock ... Wall clock used when no Clock is set
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// ManualClock clock that only moves when told to, so TTL, delay and backoff can be
+// tested without sleeping
+type ManualClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// NewManualClock ... Clock stopped at now
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+// Now ... Current time of the clock
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Advance ... Moves the clock forward by d
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	c.now = c.now.Add(d)
+	c.mutex.Unlock()
+}
+
+// Set ... Moves the clock to t
+func (c *ManualClock) Set(t time.Time) {
+	c.mutex.Lock()
+	c.now = t
+	c.mutex.Unlock()
+}
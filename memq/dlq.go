@@ -0,0 +1,86 @@
+package memq
+
+import (
+	"context"
+	"time"
+
+	"github.com/lateefj/gq"
+)
+
+// DeadLetters ... List dead letters with an id greater than after
+func (m *Memq) DeadLetters(ctx context.Context, after int64, limit int) ([]*gq.DeadLetter, error) {
+	ds := make([]*gq.DeadLetter, 0)
+	if err := ctx.Err(); err != nil {
+		return ds, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, d := range m.dead {
+		if len(ds) == limit {
+			break
+		}
+		if d.Id > after {
+			c := *d
+			c.Message = *d.Clone()
+			ds = append(ds, &c)
+		}
+	}
+	return ds, nil
+}
+
+// DeadLetter ... Inspect a single dead letter
+func (m *Memq) DeadLetter(ctx context.Context, id int64) (*gq.DeadLetter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, d := range m.dead {
+		if d.Id == id {
+			c := *d
+			c.Message = *d.Clone()
+			return &c, nil
+		}
+	}
+	return nil, gq.ErrNotFound
+}
+
+// RequeueDeadLetters ... Moves dead letters back into the queue with the attempts reset
+func (m *Memq) RequeueDeadLetters(ctx context.Context, ids []int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	requeue := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		requeue[id] = true
+	}
+	now := m.now()
+	var moved int64
+	kept := make([]*gq.DeadLetter, 0, len(m.dead))
+	for _, d := range m.dead {
+		if !requeue[d.Id] {
+			kept = append(kept, d)
+			continue
+		}
+		e := &entry{ConsumerMessage: d.ConsumerMessage, visibleAt: now, lastError: d.Error}
+		e.Checkout = time.Time{}
+		e.Attempts = 0
+		m.insert(e)
+		moved++
+	}
+	m.dead = kept
+	return moved, nil
+}
+
+// PurgeDeadLetters ... Removes all dead letters
+func (m *Memq) PurgeDeadLetters(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	m.dead = nil
+	m.mutex.Unlock()
+	return nil
+}
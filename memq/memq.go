@@ -0,0 +1,389 @@
+package memq
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lateefj/gq"
+)
+
+// entry ... Message in the queue with the state the database backends keep in columns
+type entry struct {
+	gq.ConsumerMessage
+	visibleAt  time.Time
+	leaseUntil time.Time
+	lastError  string
+}
+
+// Memq Structure for an in process queue, nothing is persisted so it suits unit tests
+// and embedded use. The zero value is ready to use and Create is only needed to satisfy
+// gq.MQ. Set Clock to a ManualClock to control TTL, delayed delivery and backoff.
+// Payloads and headers are copied on the way in and out so callers can reuse them.
+type Memq struct {
+	TTL time.Duration
+	// Deliveries before a message is moved to the dead letters, 0 means unlimited
+	MaxAttempts int
+	// Delay before a failed message is delivered again, nil means right away
+	Backoff gq.Backoff
+	// How long an idempotency key is remembered before it can be published again, 0 means forever
+	DedupWindow time.Duration
+	// Wait after which a message is treated as one priority higher so low priority
+	// messages are not starved, 0 means strict priority order
+	Aging time.Duration
+	// Source of the current time, nil means the wall clock
+	Clock    Clock
+	mutex    sync.Mutex
+	exit     bool
+	lastId   int64
+	messages []*entry
+	dead     []*gq.DeadLetter
+	keys     map[string]time.Time
+}
+
+// NewMemq ... Empty queue using the wall clock
+func NewMemq() *Memq {
+	return &Memq{}
+}
+
+// now ... Current time of the clock
+func (m *Memq) now() time.Time {
+	if m.Clock == nil {
+		return systemClock{}.Now()
+	}
+	return m.Clock.Now()
+}
+
+// ttl ... Message TTL falling back to the queue TTL, with neither a checkout never expires
+func (m *Memq) ttl(e *entry) time.Duration {
+	if e.TTL > 0 {
+		return e.TTL
+	}
+	return m.TTL
+}
+
+// expired ... Checked out message that is available again because the TTL and any
+// lease extension have passed
+func (m *Memq) expired(e *entry, now time.Time) bool {
+	ttl := m.ttl(e)
+	if e.Checkout.IsZero() || ttl <= 0 {
+		return false
+	}
+	return e.Checkout.Add(ttl).Before(now) && (e.leaseUntil.IsZero() || e.leaseUntil.Before(now))
+}
+
+// available ... Message that can be checked out
+func (m *Memq) available(e *entry, now time.Time) bool {
+	return !e.visibleAt.After(now) && (e.Checkout.IsZero() || m.expired(e, now))
+}
+
+// priority ... Priority used to order checkout, with Aging a message gains one priority
+// for every Aging it has waited
+func (m *Memq) priority(e *entry, now time.Time) int {
+	if m.Aging <= 0 {
+		return e.Priority
+	}
+	return e.Priority + int(now.Sub(e.Timestamp)/m.Aging)
+}
+
+// index ... Position of the id in the messages or -1
+func (m *Memq) index(id int64) int {
+	i := sort.Search(len(m.messages), func(i int) bool { return m.messages[i].Id >= id })
+	if i < len(m.messages) && m.messages[i].Id == id {
+		return i
+	}
+	return -1
+}
+
+// insert ... Adds the entry keeping the messages in id order
+func (m *Memq) insert(e *entry) {
+	if e.Id == 0 {
+		m.lastId++
+		e.Id = m.lastId
+	} else if e.Id > m.lastId {
+		m.lastId = e.Id
+	}
+	i := sort.Search(len(m.messages), func(i int) bool { return m.messages[i].Id >= e.Id })
+	m.messages = append(m.messages, nil)
+	copy(m.messages[i+1:], m.messages[i:])
+	m.messages[i] = e
+}
+
+// remove ... Drops the messages matching the condition
+func (m *Memq) remove(condition func(e *entry) bool) {
+	kept := m.messages[:0]
+	for _, e := range m.messages {
+		if !condition(e) {
+			kept = append(kept, e)
+		}
+	}
+	for i := len(kept); i < len(m.messages); i++ {
+		m.messages[i] = nil
+	}
+	m.messages = kept
+}
+
+// deadLetter ... Moves messages matching the condition into the dead letters
+func (m *Memq) deadLetter(now time.Time, condition func(e *entry) bool) {
+	m.remove(func(e *entry) bool {
+		if !condition(e) {
+			return false
+		}
+		m.dead = append(m.dead, &gq.DeadLetter{ConsumerMessage: e.ConsumerMessage, Error: e.lastError, DeadAt: now})
+		return true
+	})
+	// Dead letters are listed in id order
+	sort.SliceStable(m.dead, func(i, j int) bool { return m.dead[i].Id < m.dead[j].Id })
+}
+
+// Create ... Nothing to build, the queue is ready to use
+func (m *Memq) Create() error {
+	return m.CreateContext(context.Background())
+}
+
+// CreateContext ... Nothing to build, the queue is ready to use
+func (m *Memq) CreateContext(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// Destroy ... Removes every message, dead letter and idempotency key
+func (m *Memq) Destroy() error {
+	return m.DestroyContext(context.Background())
+}
+
+// DestroyContext ... Removes every message, dead letter and idempotency key
+func (m *Memq) DestroyContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.messages = nil
+	m.dead = nil
+	m.keys = nil
+	return nil
+}
+
+// StopConsumer ... Stop consuming messages
+func (m *Memq) StopConsumer() {
+	m.mutex.Lock()
+	m.exit = true
+	m.mutex.Unlock()
+}
+
+// Exit ...
+func (m *Memq) Exit() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.exit
+}
+
+// Publish ... Adds the messages to the queue
+func (m *Memq) Publish(messages []*gq.Message) error {
+	return m.PublishContext(context.Background(), messages)
+}
+
+// PublishContext ... Adds the messages to the queue
+func (m *Memq) PublishContext(ctx context.Context, messages []*gq.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := m.now()
+	if m.keys == nil {
+		m.keys = make(map[string]time.Time)
+	}
+	if m.DedupWindow > 0 {
+		for key, t := range m.keys {
+			if t.Before(now.Add(-m.DedupWindow)) {
+				delete(m.keys, key)
+			}
+		}
+	}
+	for _, msg := range messages {
+		if msg.IdempotencyKey != "" {
+			// A key seen within the window means this is a retried publish
+			if _, ok := m.keys[msg.IdempotencyKey]; ok {
+				continue
+			}
+			m.keys[msg.IdempotencyKey] = now
+		}
+		e := &entry{visibleAt: now}
+		e.Message = *msg.Clone()
+		e.Timestamp = now
+		if !msg.NotBefore.IsZero() {
+			e.visibleAt = msg.NotBefore
+		}
+		m.insert(e)
+	}
+	return nil
+}
+
+// Commit ... Removes messages that succeeded and releases those that failed
+func (m *Memq) Commit(recipts []*gq.Receipt) error {
+	return m.CommitContext(context.Background(), recipts)
+}
+
+// CommitContext ... Removes messages that succeeded, failed messages record the error
+// and are released for retry after the backoff or dead lettered when out of attempts
+func (m *Memq) CommitContext(ctx context.Context, recipts []*gq.Receipt) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := m.now()
+	results := make(map[int64]*gq.Receipt, len(recipts))
+	for _, r := range recipts {
+		results[r.Id] = r
+	}
+	m.remove(func(e *entry) bool {
+		r, ok := results[e.Id]
+		return ok && r.Success
+	})
+	for _, r := range recipts {
+		i := m.index(r.Id)
+		if r.Success || i < 0 {
+			continue
+		}
+		e := m.messages[i]
+		e.lastError = r.Error
+		e.Checkout = time.Time{}
+		e.leaseUntil = time.Time{}
+		e.visibleAt = now
+		if m.Backoff != nil {
+			e.visibleAt = now.Add(m.Backoff.Delay(e.Attempts))
+		}
+	}
+	// Failed messages that are out of attempts go straight to the dead letters
+	if m.MaxAttempts > 0 {
+		m.deadLetter(now, func(e *entry) bool {
+			r, ok := results[e.Id]
+			return ok && !r.Success && e.Attempts >= m.MaxAttempts
+		})
+	}
+	return nil
+}
+
+// Extend ... Extends the lease on checked out messages so they are not delivered again
+// until lease from now even if the TTL passes, see gq.Heartbeat
+func (m *Memq) Extend(ctx context.Context, ms []*gq.ConsumerMessage, lease time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	leaseUntil := m.now().Add(lease)
+	for _, c := range ms {
+		if i := m.index(c.Id); i >= 0 && m.messages[i].Checkout.Equal(c.Checkout) {
+			m.messages[i].leaseUntil = leaseUntil
+		}
+	}
+	return nil
+}
+
+// ConsumeBatch ... This consumes a number of messages up to the limit
+func (m *Memq) ConsumeBatch(size int) ([]*gq.ConsumerMessage, error) {
+	return m.ConsumeBatchContext(context.Background(), size)
+}
+
+// ConsumeBatchContext ... Checks out up to size messages, highest priority first then
+// oldest first, only the oldest message of an ordering key is delivered at a time
+func (m *Memq) ConsumeBatchContext(ctx context.Context, size int) ([]*gq.ConsumerMessage, error) {
+	ms := make([]*gq.ConsumerMessage, 0)
+	if err := ctx.Err(); err != nil {
+		return ms, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := m.now()
+	// Messages out of attempts are dead lettered instead of delivered again
+	if m.MaxAttempts > 0 {
+		m.deadLetter(now, func(e *entry) bool { return m.available(e, now) && e.Attempts >= m.MaxAttempts })
+	}
+	candidates := make([]*entry, 0)
+	// Messages are in id order so the first seen for a key is the oldest
+	keys := make(map[string]bool)
+	for _, e := range m.messages {
+		if e.OrderingKey != "" {
+			if keys[e.OrderingKey] {
+				continue
+			}
+			keys[e.OrderingKey] = true
+		}
+		if m.available(e, now) {
+			candidates = append(candidates, e)
+		}
+	}
+	// Like the database backends messages never checked out come before expired ones
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if !a.Checkout.Equal(b.Checkout) {
+			return a.Checkout.Before(b.Checkout)
+		}
+		return m.priority(a, now) > m.priority(b, now)
+	})
+	if size < len(candidates) {
+		candidates = candidates[:size]
+	}
+	for _, e := range candidates {
+		e.Checkout = now
+		e.leaseUntil = time.Time{}
+		e.Attempts++
+		c := e.ConsumerMessage
+		c.Message = *e.Clone()
+		ms = append(ms, &c)
+	}
+	return ms, nil
+}
+
+// unlock ... Returns checked out messages that were never handed to a consumer to the
+// queue straight away, the delivery does not count as an attempt
+func (m *Memq) unlock(ms []*gq.ConsumerMessage) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, c := range ms {
+		if i := m.index(c.Id); i >= 0 && m.messages[i].Checkout.Equal(c.Checkout) {
+			e := m.messages[i]
+			e.Checkout = time.Time{}
+			e.leaseUntil = time.Time{}
+			e.Attempts--
+		}
+	}
+}
+
+// Stream ... Creates a stream of consumption
+func (m *Memq) Stream(size int, messages chan []*gq.ConsumerMessage, pause time.Duration) {
+	m.StreamContext(context.Background(), size, messages, pause)
+}
+
+// StreamContext ... Creates a stream of consumption that ends when the context is done
+// or StopConsumer is called. The pause between empty polls is wall clock time.
+func (m *Memq) StreamContext(ctx context.Context, size int, messages chan []*gq.ConsumerMessage, pause time.Duration) {
+	defer close(messages)
+	for {
+		// Consume until there are no more messages
+		for {
+			if m.Exit() || ctx.Err() != nil {
+				return
+			}
+			ms, err := m.ConsumeBatchContext(ctx, size)
+			if len(ms) == 0 || err != nil {
+				break
+			}
+			select {
+			case messages <- ms:
+			case <-ctx.Done():
+				m.unlock(ms)
+				return
+			}
+		}
+		select {
+		case <-time.After(pause):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
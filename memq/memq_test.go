@@ -0,0 +1,215 @@
+package memq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lateefj/gq"
+	"github.com/lateefj/gq/gqtest"
+)
+
+var _ gq.DeadLetterQueue = (*Memq)(nil)
+var _ gq.ContextMQ = (*Memq)(nil)
+var _ gq.Extender = (*Memq)(nil)
+var _ gq.StatsQueue = (*Memq)(nil)
+var _ gq.Browser = (*Memq)(nil)
+var _ gq.Restorer = (*Memq)(nil)
+var _ gq.AdminQueue = (*Memq)(nil)
+
+func setup() (*Memq, *ManualClock) {
+	clock := NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	mq := NewMemq()
+	mq.Clock = clock
+	return mq, clock
+}
+
+func publish(t *testing.T, mq *Memq, messages ...*gq.Message) {
+	if err := mq.Publish(messages); err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+}
+
+func TestPublishConsume(t *testing.T) {
+	mq, _ := setup()
+	publish(t, mq, &gq.Message{Payload: []byte("one"), Headers: map[string]string{"type": "test"}}, &gq.Message{Payload: []byte("two")})
+	ms, err := mq.ConsumeBatch(10)
+	if err != nil || len(ms) != 2 {
+		t.Fatalf("Expected 2 messages got %d error %v", len(ms), err)
+	}
+	if string(ms[0].Payload) != "one" || ms[0].Headers["type"] != "test" || ms[0].Attempts != 1 || ms[0].Checkout.IsZero() {
+		t.Errorf("Expected the first message with metadata got %+v", ms[0])
+	}
+	ms2, _ := mq.ConsumeBatch(10)
+	if len(ms2) != 0 {
+		t.Fatalf("Expected checked out messages to not be delivered again got %d", len(ms2))
+	}
+	err = mq.Commit([]*gq.Receipt{&gq.Receipt{Id: ms[0].Id, Success: true}, &gq.Receipt{Id: ms[1].Id, Success: false, Error: "failed"}})
+	if err != nil {
+		t.Fatalf("Failed to commit %s", err)
+	}
+	ms, _ = mq.ConsumeBatch(10)
+	if len(ms) != 1 || string(ms[0].Payload) != "two" || ms[0].Attempts != 2 {
+		t.Errorf("Expected the failed message to be delivered again got %+v", ms)
+	}
+}
+
+func TestConsumeTimeout(t *testing.T) {
+	mq, clock := setup()
+	mq.TTL = 100 * time.Millisecond
+	publish(t, mq, &gq.Message{Payload: []byte("queue ttl")}, &gq.Message{Payload: []byte("message ttl"), TTL: time.Second})
+	ms, _ := mq.ConsumeBatch(10)
+	if len(ms) != 2 {
+		t.Fatalf("Expected 2 messages got %d", len(ms))
+	}
+	clock.Advance(100 * time.Millisecond)
+	if ms, _ = mq.ConsumeBatch(10); len(ms) != 0 {
+		t.Fatalf("Expected nothing until the TTL has passed got %d", len(ms))
+	}
+	clock.Advance(time.Millisecond)
+	if ms, _ = mq.ConsumeBatch(10); len(ms) != 1 || string(ms[0].Payload) != "queue ttl" {
+		t.Fatalf("Expected the queue TTL message to be redelivered got %+v", ms)
+	}
+	// A lease holds the message past its TTL
+	if err := mq.Extend(context.Background(), ms, time.Second); err != nil {
+		t.Fatalf("Failed to extend %s", err)
+	}
+	clock.Advance(500 * time.Millisecond)
+	if ms, _ = mq.ConsumeBatch(10); len(ms) != 0 {
+		t.Fatalf("Expected nothing while leased got %d", len(ms))
+	}
+	clock.Advance(501 * time.Millisecond)
+	if ms, _ = mq.ConsumeBatch(10); len(ms) != 2 {
+		t.Errorf("Expected both messages once the lease and message TTL passed got %d", len(ms))
+	}
+}
+
+func TestDelayedDelivery(t *testing.T) {
+	mq, clock := setup()
+	mq.Backoff = gq.FixedBackoff(time.Minute)
+	publish(t, mq, &gq.Message{Payload: []byte("later"), NotBefore: clock.Now().Add(time.Hour)}, &gq.Message{Payload: []byte("now")})
+	ms, _ := mq.ConsumeBatch(10)
+	if len(ms) != 1 || string(ms[0].Payload) != "now" {
+		t.Fatalf("Expected only the message without a delay got %+v", ms)
+	}
+	mq.Commit([]*gq.Receipt{&gq.Receipt{Id: ms[0].Id, Success: false}})
+	clock.Advance(59 * time.Second)
+	if ms, _ = mq.ConsumeBatch(10); len(ms) != 0 {
+		t.Fatalf("Expected the failed message to wait for the backoff got %d", len(ms))
+	}
+	clock.Advance(time.Second)
+	if ms, _ = mq.ConsumeBatch(10); len(ms) != 1 || string(ms[0].Payload) != "now" {
+		t.Fatalf("Expected the failed message after the backoff got %+v", ms)
+	}
+	clock.Advance(time.Hour)
+	if ms, _ = mq.ConsumeBatch(10); len(ms) != 1 || string(ms[0].Payload) != "later" {
+		t.Errorf("Expected the delayed message once visible got %+v", ms)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	mq, _ := setup()
+	ctx := context.Background()
+	mq.MaxAttempts = 2
+	publish(t, mq, &gq.Message{Payload: []byte("poison")})
+	for i := 0; i < 2; i++ {
+		ms, _ := mq.ConsumeBatch(1)
+		if len(ms) != 1 {
+			t.Fatalf("Expected delivery %d got %d messages", i+1, len(ms))
+		}
+		mq.Commit([]*gq.Receipt{&gq.Receipt{Id: ms[0].Id, Success: false, Error: "bad"}})
+	}
+	ds, err := mq.DeadLetters(ctx, 0, 10)
+	if err != nil || len(ds) != 1 || ds[0].Error != "bad" || ds[0].Attempts != 2 {
+		t.Fatalf("Expected the message dead lettered with its error got %+v error %v", ds, err)
+	}
+	if _, err = mq.DeadLetter(ctx, 99); err != gq.ErrNotFound {
+		t.Errorf("Expected not found got %v", err)
+	}
+	moved, err := mq.RequeueDeadLetters(ctx, []int64{ds[0].Id, 99})
+	if err != nil {
+		t.Fatalf("Failed to requeue %s", err)
+	}
+	if moved != 1 {
+		t.Errorf("Expected 1 dead letter requeued got %d", moved)
+	}
+	ms, _ := mq.ConsumeBatch(1)
+	if len(ms) != 1 || ms[0].Id != ds[0].Id || ms[0].Attempts != 1 {
+		t.Errorf("Expected the requeued message with attempts reset got %+v", ms)
+	}
+}
+
+func TestOrderingPriority(t *testing.T) {
+	mq, _ := setup()
+	publish(t, mq,
+		&gq.Message{Payload: []byte("a1"), OrderingKey: "a"},
+		&gq.Message{Payload: []byte("a2"), OrderingKey: "a", Priority: 10},
+		&gq.Message{Payload: []byte("low")},
+		&gq.Message{Payload: []byte("high"), Priority: 5},
+	)
+	ms, _ := mq.ConsumeBatch(10)
+	payloads := ""
+	for _, m := range ms {
+		payloads += string(m.Payload) + " "
+	}
+	if payloads != "high a1 low " {
+		t.Fatalf("Expected priority order with one message per key got %s", payloads)
+	}
+	mq.Commit([]*gq.Receipt{&gq.Receipt{Id: ms[1].Id, Success: true}})
+	ms, _ = mq.ConsumeBatch(10)
+	if len(ms) != 1 || string(ms[0].Payload) != "a2" {
+		t.Errorf("Expected the next message for the key once the first was committed got %+v", ms)
+	}
+}
+
+func TestStreamLifecycle(t *testing.T) {
+	mq, clock := setup()
+	publish(t, mq, &gq.Message{Payload: []byte("now")}, &gq.Message{Payload: []byte("later"), NotBefore: clock.Now().Add(time.Minute)})
+	messages := make(chan []*gq.ConsumerMessage)
+	go mq.Stream(10, messages, time.Millisecond)
+	ms := <-messages
+	if len(ms) != 1 || string(ms[0].Payload) != "now" {
+		t.Fatalf("Expected the visible message first got %+v", ms)
+	}
+	clock.Advance(time.Minute)
+	ms = <-messages
+	if len(ms) != 1 || string(ms[0].Payload) != "later" {
+		t.Fatalf("Expected the delayed message after the clock moved got %+v", ms)
+	}
+	mq.StopConsumer()
+	for range messages {
+	}
+}
+
+func TestStatsBrowse(t *testing.T) {
+	mq, clock := setup()
+	ctx := context.Background()
+	mq.TTL = time.Second
+	publish(t, mq, &gq.Message{Payload: []byte("expired")}, &gq.Message{Payload: []byte("in flight"), TTL: time.Hour})
+	mq.ConsumeBatch(2)
+	clock.Advance(2 * time.Second)
+	notBefore := clock.Now().Add(time.Hour)
+	publish(t, mq, &gq.Message{Payload: []byte("ready")}, &gq.Message{Payload: []byte("delayed"), NotBefore: notBefore})
+	clock.Advance(time.Second)
+	s, err := mq.Stats(ctx, false)
+	if err != nil {
+		t.Fatalf("Failed to get stats %s", err)
+	}
+	// Only the ready message counts towards the oldest age
+	if s.Ready != 1 || s.InFlight != 1 || s.Expired != 1 || s.Delayed != 1 || s.Total != 4 || s.OldestAge != time.Second {
+		t.Errorf("Expected one message in each state got %+v", s)
+	}
+	ms, err := mq.Browse(ctx, gq.BrowseOptions{State: gq.StateDelayed})
+	if err != nil || len(ms) != 1 || !ms[0].NotBefore.Equal(notBefore) {
+		t.Errorf("Expected the delayed message with not before got %+v error %v", ms, err)
+	}
+	if _, err = mq.Browse(ctx, gq.BrowseOptions{State: "bogus"}); err != gq.ErrInvalidState {
+		t.Errorf("Expected invalid state error got %v", err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	gqtest.RunConformance(t, func(t *testing.T, cfg gqtest.Config) gq.MQ {
+		return &Memq{TTL: cfg.TTL, MaxAttempts: cfg.MaxAttempts, Backoff: cfg.Backoff, DedupWindow: cfg.DedupWindow, Aging: cfg.Aging}
+	})
+}
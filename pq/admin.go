@@ -0,0 +1,76 @@
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lateefj/gq"
+)
+
+// Purge ... Removes every message and the consumer group progress on them, dead letters are kept
+func (p *Pgmq) Purge(ctx context.Context) error {
+	_, err := p.DB.ExecContext(ctx, fmt.Sprintf("TRUNCATE %[1]sacks, %[1]sq;", p.Prefix))
+	return err
+}
+
+// ReleaseCheckouts ... Makes checked out messages available again, those checked out longer
+// than olderThan or when it is 0 those past their TTL. Use it for messages stuck with a
+// consumer that died when the queue has no TTL.
+func (p *Pgmq) ReleaseCheckouts(ctx context.Context, olderThan time.Duration) (int64, error) {
+	condition := p.expired("", "")
+	if olderThan > 0 {
+		condition = fmt.Sprintf("checkout + (%d * interval '1 millisecond') < now()", olderThan.Milliseconds())
+	}
+	q := fmt.Sprintf("UPDATE %sq SET checkout = NULL, lease_until = NULL WHERE checkout IS NOT null AND %s;", p.Prefix, condition)
+	res, err := p.DB.ExecContext(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Restore ... Publishes messages keeping their publish time and attempts, ids are
+// assigned by the queue. Idempotency keys are not checked.
+func (p *Pgmq) Restore(ctx context.Context, messages []*gq.ConsumerMessage) error {
+	txn, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = p.restore(ctx, txn, messages)
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+func (p *Pgmq) restore(ctx context.Context, txn *sql.Tx, messages []*gq.ConsumerMessage) error {
+	q := fmt.Sprintf(`INSERT INTO %sq (payload, headers, ttl, ordering_key, priority, attempts, timestamp, visible_at)
+VALUES ($1, $2, $3, $4, $5, $6, COALESCE($7::timestamptz, now()), COALESCE($8::timestamptz, now()));`, p.Prefix)
+	stmt, err := txn.PrepareContext(ctx, q)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, m := range messages {
+		headers, err := encodeHeaders(m.Headers)
+		if err == nil {
+			_, err = stmt.ExecContext(ctx, m.Payload, headers, ttlMs(m.TTL), orderingKey(m.OrderingKey), m.Priority, m.Attempts,
+				optionalTime(m.Timestamp), optionalTime(m.NotBefore))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return p.notify(ctx, txn)
+}
+
+// optionalTime ... Value for a time parameter or nil when it is not set
+func optionalTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
@@ -0,0 +1,75 @@
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lateefj/gq"
+)
+
+// state ... Condition for messages in the state
+func (p *Pgmq) state(state gq.MessageState) (string, error) {
+	switch state {
+	case gq.StateAll:
+		return "true", nil
+	case gq.StateReady:
+		return "checkout IS null AND visible_at <= now()", nil
+	case gq.StateInFlight:
+		return fmt.Sprintf("checkout IS NOT null AND NOT COALESCE((%s), false)", p.expired("", "")), nil
+	case gq.StateExpired:
+		return fmt.Sprintf("checkout IS NOT null AND COALESCE((%s), false)", p.expired("", "")), nil
+	case gq.StateDelayed:
+		return "checkout IS null AND visible_at > now()", nil
+	}
+	return "", gq.ErrInvalidState
+}
+
+// Browse ... Messages ordered by id without checking them out, delayed messages have
+// NotBefore set to when they become visible
+func (p *Pgmq) Browse(ctx context.Context, opts gq.BrowseOptions) ([]*gq.ConsumerMessage, error) {
+	ms := make([]*gq.ConsumerMessage, 0)
+	condition, err := p.state(opts.State)
+	if err != nil {
+		return ms, err
+	}
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	args := []interface{}{opts.After, limit}
+	if !opts.Since.IsZero() {
+		condition = fmt.Sprintf("%s AND timestamp >= $3::timestamptz", condition)
+		args = append(args, opts.Since)
+	}
+	q := fmt.Sprintf(`SELECT id, payload, headers, timestamp, checkout, attempts, ttl, ordering_key, priority,
+	CASE WHEN visible_at > now() THEN visible_at END
+FROM %sq WHERE id > $1 AND %s ORDER BY id ASC LIMIT $2;`, p.Prefix, condition)
+	rows, err := p.DB.QueryContext(ctx, q, args...)
+	if err != nil {
+		return ms, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		m := &gq.ConsumerMessage{}
+		var headers []byte
+		var checkout, notBefore sql.NullTime
+		var ttl sql.NullInt64
+		var key sql.NullString
+		err = rows.Scan(&m.Id, &m.Payload, &headers, &m.Timestamp, &checkout, &m.Attempts, &ttl, &key, &m.Priority, &notBefore)
+		if err == nil {
+			m.Headers, err = decodeHeaders(headers)
+		}
+		if err != nil {
+			return make([]*gq.ConsumerMessage, 0), err
+		}
+		m.Checkout = checkout.Time
+		m.NotBefore = notBefore.Time
+		m.TTL = time.Duration(ttl.Int64) * time.Millisecond
+		m.OrderingKey = key.String
+		m.Topic = p.topic
+		ms = append(ms, m)
+	}
+	return ms, rows.Err()
+}
@@ -0,0 +1,96 @@
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lateefj/gq"
+	pq "github.com/lib/pq" // Postgresql Driver
+)
+
+const deadLetterColumns = "id, timestamp, checkout, attempts, headers, payload, last_error, dead_at"
+
+// scanDeadLetter ... Reads a row of deadLetterColumns
+func scanDeadLetter(row interface{ Scan(...interface{}) error }) (*gq.DeadLetter, error) {
+	d := &gq.DeadLetter{}
+	var checkout sql.NullTime
+	var headers []byte
+	var lastError sql.NullString
+	err := row.Scan(&d.Id, &d.Timestamp, &checkout, &d.Attempts, &headers, &d.Payload, &lastError, &d.DeadAt)
+	if err != nil {
+		return nil, err
+	}
+	d.Checkout = checkout.Time
+	d.Error = lastError.String
+	d.Headers, err = decodeHeaders(headers)
+	return d, err
+}
+
+// DeadLetters ... List dead letters with an id greater than after
+func (p *Pgmq) DeadLetters(ctx context.Context, after int64, limit int) ([]*gq.DeadLetter, error) {
+	ds := make([]*gq.DeadLetter, 0)
+	q := fmt.Sprintf("SELECT %s FROM %sdlq WHERE id > $1 ORDER BY id ASC LIMIT $2;", deadLetterColumns, p.Prefix)
+	rows, err := p.DB.QueryContext(ctx, q, after, limit)
+	if err != nil {
+		return ds, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d, err := scanDeadLetter(rows)
+		if err != nil {
+			return ds, err
+		}
+		ds = append(ds, d)
+	}
+	return ds, rows.Err()
+}
+
+// DeadLetter ... Inspect a single dead letter
+func (p *Pgmq) DeadLetter(ctx context.Context, id int64) (*gq.DeadLetter, error) {
+	q := fmt.Sprintf("SELECT %s FROM %sdlq WHERE id = $1;", deadLetterColumns, p.Prefix)
+	d, err := scanDeadLetter(p.DB.QueryRowContext(ctx, q, id))
+	if err == sql.ErrNoRows {
+		return nil, gq.ErrNotFound
+	}
+	return d, err
+}
+
+// RequeueDeadLetters ... Moves dead letters back into the queue with the attempts reset
+// and wakes any listening streams
+func (p *Pgmq) RequeueDeadLetters(ctx context.Context, ids []int64) (int64, error) {
+	txn, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	n, err := p.requeueDeadLetters(ctx, txn, ids)
+	if err != nil {
+		txn.Rollback()
+		return 0, err
+	}
+	return n, txn.Commit()
+}
+
+func (p *Pgmq) requeueDeadLetters(ctx context.Context, txn *sql.Tx, ids []int64) (int64, error) {
+	q := fmt.Sprintf(`WITH requeue AS (
+	DELETE FROM %[1]sdlq WHERE id = ANY($1)
+	RETURNING id, timestamp, headers, payload, last_error, ttl, ordering_key, priority
+)
+INSERT INTO %[1]sq (id, timestamp, headers, payload, last_error, ttl, ordering_key, priority)
+SELECT id, timestamp, headers, payload, last_error, ttl, ordering_key, priority FROM requeue;`, p.Prefix)
+	result, err := txn.ExecContext(ctx, q, pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, p.notify(ctx, txn)
+}
+
+// PurgeDeadLetters ... Removes all dead letters
+func (p *Pgmq) PurgeDeadLetters(ctx context.Context) error {
+	_, err := p.DB.ExecContext(ctx, fmt.Sprintf("DELETE FROM %sdlq;", p.Prefix))
+	return err
+}
@@ -0,0 +1,348 @@
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lateefj/gq"
+	pq "github.com/lib/pq" // Postgresql Driver
+)
+
+// Group ... Named consumer group, every group receives every message and tracks
+// its own progress in the <prefix>acks table. A message is removed once every
+// group has acknowledged it or it is older than the queue Retention. Groups do
+// not dead letter, failed messages are retried after the queue Backoff.
+type Group struct {
+	Queue *Pgmq
+	Name  string
+	exit  bool
+	mutex sync.RWMutex
+}
+
+// Group ... Consumer group on this queue, Create registers it
+func (p *Pgmq) Group(name string) *Group {
+	return &Group{Queue: p, Name: name}
+}
+
+// Groups ... Names of the registered consumer groups
+func (p *Pgmq) Groups(ctx context.Context) ([]string, error) {
+	names := make([]string, 0)
+	rows, err := p.DB.QueryContext(ctx, fmt.Sprintf("SELECT name FROM %sgroups ORDER BY name ASC;", p.Prefix))
+	if err != nil {
+		return names, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return names, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// Collect ... Removes messages every group has acknowledged or that are past the retention,
+// group commits already do this for the messages they acknowledge so this is for cleanup
+// after groups are added or removed
+func (p *Pgmq) Collect(ctx context.Context) error {
+	txn, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = p.collect(ctx, txn, fmt.Sprintf("id IN (SELECT DISTINCT id FROM %sacks WHERE acked)", p.Prefix))
+	if err == nil {
+		err = p.expire(ctx, txn)
+	}
+	if err == nil {
+		// Progress for messages that no longer exist
+		q := fmt.Sprintf("DELETE FROM %[1]sacks a WHERE NOT EXISTS (SELECT 1 FROM %[1]sq q WHERE q.id = a.id);", p.Prefix)
+		_, err = txn.ExecContext(ctx, q)
+	}
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+// expire ... Deletes messages past the retention along with the group progress on them
+func (p *Pgmq) expire(ctx context.Context, txn *sql.Tx) error {
+	if p.Retention <= 0 {
+		return nil
+	}
+	q := fmt.Sprintf(`WITH expired AS (
+	DELETE FROM %[1]sq WHERE timestamp + ($1 * interval '1 millisecond') < now() RETURNING id
+)
+DELETE FROM %[1]sacks WHERE id IN (SELECT id FROM expired);`, p.Prefix)
+	_, err := txn.ExecContext(ctx, q, p.Retention.Milliseconds())
+	return err
+}
+
+// collect ... Deletes messages matching the condition that every group has acknowledged
+func (p *Pgmq) collect(ctx context.Context, txn *sql.Tx, condition string, args ...interface{}) error {
+	q := fmt.Sprintf(`WITH done AS (
+	DELETE FROM %[1]sq q WHERE %[2]s AND EXISTS (SELECT 1 FROM %[1]sgroups)
+	AND NOT EXISTS (
+		SELECT 1 FROM %[1]sgroups g WHERE NOT EXISTS (
+			SELECT 1 FROM %[1]sacks a WHERE a.grp = g.name AND a.id = q.id AND a.acked
+		)
+	) RETURNING id
+)
+DELETE FROM %[1]sacks WHERE id IN (SELECT id FROM done);`, p.Prefix, condition)
+	_, err := txn.ExecContext(ctx, q, args...)
+	return err
+}
+
+// groupAvailable ... Condition on the group progress a for messages q the group can
+// check out again, a checkout expires like a queue checkout with the message TTL and lease
+func (g *Group) groupAvailable() string {
+	return fmt.Sprintf("NOT a.acked AND a.visible_at <= now() AND (a.checkout IS null OR (%s))", g.Queue.expired("a.", "q."))
+}
+
+// ordered ... Condition on the queue for messages that are the oldest this group has not
+// acknowledged for their ordering key, the group name is $1
+func (g *Group) ordered() string {
+	return fmt.Sprintf(`(q.ordering_key IS null OR NOT EXISTS (
+		SELECT 1 FROM %[1]sq o WHERE o.ordering_key = q.ordering_key AND o.id < q.id
+		AND NOT EXISTS (SELECT 1 FROM %[1]sacks oa WHERE oa.grp = $1 AND oa.id = o.id AND oa.acked)
+	))`, g.Queue.Prefix)
+}
+
+// Create ... Registers the group
+func (g *Group) Create() error {
+	return g.CreateContext(context.Background())
+}
+
+// CreateContext ... Registers the group, a new group receives every message still retained
+func (g *Group) CreateContext(ctx context.Context) error {
+	q := fmt.Sprintf("INSERT INTO %sgroups (name) VALUES ($1) ON CONFLICT DO NOTHING;", g.Queue.Prefix)
+	_, err := g.Queue.DB.ExecContext(ctx, q, g.Name)
+	return err
+}
+
+// Destroy ... Unregisters the group
+func (g *Group) Destroy() error {
+	return g.DestroyContext(context.Background())
+}
+
+// DestroyContext ... Unregisters the group and removes its progress
+func (g *Group) DestroyContext(ctx context.Context) error {
+	txn, err := g.Queue.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	_, err = txn.ExecContext(ctx, fmt.Sprintf("DELETE FROM %sgroups WHERE name = $1;", g.Queue.Prefix), g.Name)
+	if err == nil {
+		_, err = txn.ExecContext(ctx, fmt.Sprintf("DELETE FROM %sacks WHERE grp = $1;", g.Queue.Prefix), g.Name)
+	}
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+// Publish ... Publishes to the queue so every group receives the messages
+func (g *Group) Publish(messages []*gq.Message) error {
+	return g.Queue.PublishContext(context.Background(), messages)
+}
+
+// PublishContext ... Publishes to the queue so every group receives the messages
+func (g *Group) PublishContext(ctx context.Context, messages []*gq.Message) error {
+	return g.Queue.PublishContext(ctx, messages)
+}
+
+// ConsumeBatch ... Consumes messages this group has not yet acknowledged
+func (g *Group) ConsumeBatch(size int) ([]*gq.ConsumerMessage, error) {
+	return g.ConsumeBatchContext(context.Background(), size)
+}
+
+// ConsumeBatchContext ... Consumes messages this group has not yet acknowledged
+func (g *Group) ConsumeBatchContext(ctx context.Context, size int) ([]*gq.ConsumerMessage, error) {
+	ms := make([]*gq.ConsumerMessage, 0)
+	// Progress rows for messages the group has not seen yet so they can be locked, only
+	// as many as one batch could claim
+	insert := fmt.Sprintf(`INSERT INTO %[1]sacks (grp, id)
+SELECT $1, q.id FROM %[1]sq q
+WHERE q.visible_at <= now() AND NOT EXISTS (SELECT 1 FROM %[1]sacks a WHERE a.grp = $1 AND a.id = q.id) AND %[2]s
+ORDER BY %[3]s DESC, q.id ASC LIMIT $2
+ON CONFLICT (grp, id) DO NOTHING;`, g.Queue.Prefix, g.ordered(), g.Queue.priority("q"))
+	// Claim like the queue does, consumers of the same group skip progress rows another
+	// is claiming rather than waiting for them
+	q := fmt.Sprintf(`WITH claimed AS (
+	UPDATE %[1]sacks SET checkout = now(), lease_until = NULL, attempts = %[1]sacks.attempts + 1
+	WHERE grp = $1 AND id IN (
+		SELECT a.id FROM %[1]sacks a JOIN %[1]sq q ON q.id = a.id
+		WHERE a.grp = $1 AND %[2]s AND %[3]s
+		ORDER BY a.checkout ASC NULLS FIRST, %[4]s DESC, q.id ASC LIMIT $2
+		FOR UPDATE OF a SKIP LOCKED
+	)
+	RETURNING id, checkout, attempts
+)
+SELECT q.id, q.payload, q.headers, q.timestamp, c.checkout, c.attempts, q.ttl, q.ordering_key, q.priority
+FROM claimed c JOIN %[1]sq q ON q.id = c.id ORDER BY q.id ASC;`, g.Queue.Prefix, g.groupAvailable(), g.ordered(), g.Queue.priority("q"))
+	txn, err := g.Queue.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return ms, err
+	}
+	_, err = txn.ExecContext(ctx, insert, g.Name, size)
+	if err != nil {
+		txn.Rollback()
+		return ms, err
+	}
+	rows, err := txn.QueryContext(ctx, q, g.Name, size)
+	if err != nil {
+		txn.Rollback()
+		return ms, err
+	}
+	for rows.Next() {
+		m := &gq.ConsumerMessage{}
+		var headers []byte
+		var ttl sql.NullInt64
+		var key sql.NullString
+		err = rows.Scan(&m.Id, &m.Payload, &headers, &m.Timestamp, &m.Checkout, &m.Attempts, &ttl, &key, &m.Priority)
+		if err == nil {
+			m.Headers, err = decodeHeaders(headers)
+		}
+		if err != nil {
+			rows.Close()
+			txn.Rollback()
+			return make([]*gq.ConsumerMessage, 0), err
+		}
+		m.TTL = time.Duration(ttl.Int64) * time.Millisecond
+		m.OrderingKey = key.String
+		m.Topic = g.Queue.topic
+		ms = append(ms, m)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		txn.Rollback()
+		return make([]*gq.ConsumerMessage, 0), err
+	}
+	if err = txn.Commit(); err != nil {
+		return make([]*gq.ConsumerMessage, 0), err
+	}
+	sortByPriority(ms)
+	return ms, nil
+}
+
+// Extend ... Extends the lease on messages checked out by the group so they are not
+// delivered to it again until lease from now even if the TTL passes, see gq.Heartbeat
+func (g *Group) Extend(ctx context.Context, ms []*gq.ConsumerMessage, lease time.Duration) error {
+	ids, attempts := checkouts(ms)
+	q := fmt.Sprintf(`UPDATE %[1]sacks SET lease_until = now() + ($4 * interval '1 millisecond')
+FROM unnest($2::int8[], $3::int8[]) AS m(id, attempts)
+WHERE grp = $1 AND %[1]sacks.id = m.id AND %[1]sacks.attempts = m.attempts AND checkout IS NOT null;`, g.Queue.Prefix)
+	_, err := g.Queue.DB.ExecContext(ctx, q, g.Name, pq.Array(ids), pq.Array(attempts), lease.Milliseconds())
+	return err
+}
+
+// Commit ... Acknowledges messages for this group
+func (g *Group) Commit(recipts []*gq.Receipt) error {
+	return g.CommitContext(context.Background(), recipts)
+}
+
+// CommitContext ... Acknowledges successful messages for this group and removes any that
+// every group has now acknowledged, failed messages are released after the backoff
+func (g *Group) CommitContext(ctx context.Context, recipts []*gq.Receipt) error {
+	ackIds := make([]int64, 0)
+	failedIds := make([]int64, 0)
+	failedErrors := make([]string, 0)
+	for _, r := range recipts {
+		if r.Success {
+			ackIds = append(ackIds, r.Id)
+		} else {
+			failedIds = append(failedIds, r.Id)
+			failedErrors = append(failedErrors, r.Error)
+		}
+	}
+	txn, err := g.Queue.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if len(ackIds) > 0 {
+		q := fmt.Sprintf("UPDATE %sacks SET acked = true, checkout = NULL WHERE grp = $1 AND id = ANY($2);", g.Queue.Prefix)
+		_, err = txn.ExecContext(ctx, q, g.Name, pq.Array(ackIds))
+		if err == nil {
+			err = g.Queue.collect(ctx, txn, "q.id = ANY($1)", pq.Array(ackIds))
+		}
+	}
+	if err == nil && len(failedIds) > 0 {
+		var failedDelays []int64
+		failedDelays, err = g.delays(ctx, txn, failedIds)
+		if err == nil {
+			q := fmt.Sprintf(`UPDATE %[1]sacks SET checkout = NULL, last_error = f.reason, visible_at = now() + (f.delay * interval '1 millisecond')
+FROM unnest($2::int8[], $3::text[], $4::int8[]) AS f(id, reason, delay) WHERE %[1]sacks.grp = $1 AND %[1]sacks.id = f.id;`, g.Queue.Prefix)
+			_, err = txn.ExecContext(ctx, q, g.Name, pq.Array(failedIds), pq.Array(failedErrors), pq.Array(failedDelays))
+		}
+	}
+	if err == nil {
+		err = g.Queue.expire(ctx, txn)
+	}
+	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+// delays ... Backoff for each of the failed ids in the same order
+func (g *Group) delays(ctx context.Context, txn *sql.Tx, ids []int64) ([]int64, error) {
+	attempts := make(map[int64]int)
+	q := fmt.Sprintf("SELECT id, attempts FROM %sacks WHERE grp = $1 AND id = ANY($2);", g.Queue.Prefix)
+	rows, err := txn.QueryContext(ctx, q, g.Name, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int64
+		var a int
+		if err = rows.Scan(&id, &a); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		attempts[id] = a
+	}
+	rows.Close()
+	delays := make([]int64, len(ids))
+	for i, id := range ids {
+		delays[i] = g.Queue.retryDelay(attempts[id]).Milliseconds()
+	}
+	return delays, rows.Err()
+}
+
+// Stream ... Creates a stream of consumption for the group
+func (g *Group) Stream(size int, messages chan []*gq.ConsumerMessage, pause time.Duration) {
+	g.StreamContext(context.Background(), size, messages, pause)
+}
+
+// StreamContext ... Creates a stream of consumption for the group that ends when the context is done
+func (g *Group) StreamContext(ctx context.Context, size int, messages chan []*gq.ConsumerMessage, pause time.Duration) {
+	g.Queue.stream(ctx, size, messages, pause, g.ConsumeBatchContext, g.unlock, g.Exit)
+}
+
+// unlock ... Makes messages checked out by the group but never handed to a consumer
+// available to it again straight away, the delivery does not count as an attempt
+func (g *Group) unlock(ctx context.Context, ms []*gq.ConsumerMessage) error {
+	q := fmt.Sprintf("UPDATE %sacks SET checkout = NULL, attempts = attempts - 1 WHERE grp = $1 AND id = ANY($2) AND checkout IS NOT null;", g.Queue.Prefix)
+	_, err := g.Queue.DB.ExecContext(ctx, q, g.Name, pq.Array(messageIds(ms)))
+	return err
+}
+
+// StopConsumer ... Stop consuming messages
+func (g *Group) StopConsumer() {
+	g.mutex.Lock()
+	g.exit = true
+	g.mutex.Unlock()
+}
+
+// Exit ...
+func (g *Group) Exit() bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return g.exit
+}
@@ -2,9 +2,13 @@ package pq
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 
@@ -20,15 +24,77 @@ CREATE TABLE IF NOT EXISTS {{.TableName}}q (
 	id INT8 NOT NULL DEFAULT nextval('{{.TableName}}q_id_seq') PRIMARY KEY,
 	timestamp TIMESTAMP NOT NULL DEFAULt now(),
 	checkout TIMESTAMP,
-	payload BYTEA
+	visible_at TIMESTAMP NOT NULL DEFAULT now(),
+	attempts INT4 NOT NULL DEFAULT 0,
+	headers JSONB,
+	payload BYTEA,
+	last_error TEXT,
+	ttl INT8,
+	lease_until TIMESTAMP,
+	ordering_key TEXT,
+	priority INT4 NOT NULL DEFAULT 0
 );
-CREATE INDEX IF NOT EXISTS {{.TableName}}q_timestamp_idx ON {{.TableName}}q (checkout ASC NULLS FIRST, timestamp ASC);
+CREATE TABLE IF NOT EXISTS {{.TableName}}dlq (
+	id INT8 NOT NULL PRIMARY KEY,
+	timestamp TIMESTAMP NOT NULL,
+	checkout TIMESTAMP,
+	attempts INT4 NOT NULL DEFAULT 0,
+	headers JSONB,
+	payload BYTEA,
+	last_error TEXT,
+	ttl INT8,
+	ordering_key TEXT,
+	priority INT4 NOT NULL DEFAULT 0,
+	dead_at TIMESTAMP NOT NULL DEFAULT now()
+);
+CREATE TABLE IF NOT EXISTS {{.TableName}}groups (
+	name TEXT NOT NULL PRIMARY KEY,
+	timestamp TIMESTAMP NOT NULL DEFAULT now()
+);
+CREATE TABLE IF NOT EXISTS {{.TableName}}acks (
+	grp TEXT NOT NULL,
+	id INT8 NOT NULL,
+	checkout TIMESTAMP,
+	visible_at TIMESTAMP NOT NULL DEFAULT now(),
+	attempts INT4 NOT NULL DEFAULT 0,
+	acked BOOLEAN NOT NULL DEFAULT false,
+	last_error TEXT,
+	lease_until TIMESTAMP,
+	PRIMARY KEY (grp, id)
+);
+CREATE TABLE IF NOT EXISTS {{.TableName}}keys (
+	key TEXT NOT NULL PRIMARY KEY,
+	timestamp TIMESTAMP NOT NULL DEFAULT now()
+);
+-- Columns added since the tables were first released, before the indexes that use them
+ALTER TABLE {{.TableName}}q ADD COLUMN IF NOT EXISTS visible_at TIMESTAMP NOT NULL DEFAULT now();
+ALTER TABLE {{.TableName}}q ADD COLUMN IF NOT EXISTS attempts INT4 NOT NULL DEFAULT 0;
+ALTER TABLE {{.TableName}}q ADD COLUMN IF NOT EXISTS headers JSONB;
+ALTER TABLE {{.TableName}}q ADD COLUMN IF NOT EXISTS last_error TEXT;
+ALTER TABLE {{.TableName}}q ADD COLUMN IF NOT EXISTS ttl INT8;
+ALTER TABLE {{.TableName}}q ADD COLUMN IF NOT EXISTS lease_until TIMESTAMP;
+ALTER TABLE {{.TableName}}q ADD COLUMN IF NOT EXISTS ordering_key TEXT;
+ALTER TABLE {{.TableName}}q ADD COLUMN IF NOT EXISTS priority INT4 NOT NULL DEFAULT 0;
+ALTER TABLE {{.TableName}}dlq ADD COLUMN IF NOT EXISTS ttl INT8;
+ALTER TABLE {{.TableName}}dlq ADD COLUMN IF NOT EXISTS ordering_key TEXT;
+ALTER TABLE {{.TableName}}dlq ADD COLUMN IF NOT EXISTS priority INT4 NOT NULL DEFAULT 0;
+ALTER TABLE {{.TableName}}acks ADD COLUMN IF NOT EXISTS lease_until TIMESTAMP;
+CREATE INDEX IF NOT EXISTS {{.TableName}}keys_timestamp_idx ON {{.TableName}}keys (timestamp);
+CREATE INDEX IF NOT EXISTS {{.TableName}}acks_id_idx ON {{.TableName}}acks (id);
+CREATE INDEX IF NOT EXISTS {{.TableName}}q_ordering_key_idx ON {{.TableName}}q (ordering_key, id) WHERE ordering_key IS NOT NULL;
+DROP INDEX IF EXISTS {{.TableName}}q_timestamp_idx;
+CREATE INDEX IF NOT EXISTS {{.TableName}}q_checkout_idx ON {{.TableName}}q (checkout ASC NULLS FIRST, priority DESC, timestamp ASC, visible_at ASC);
 ALTER TABLE {{.TableName}}q SET (autovacuum_vacuum_scale_factor = 0.0);
 ALTER TABLE {{.TableName}}q SET (autovacuum_vacuum_threshold = 250000);
 ALTER TABLE {{.TableName}}q SET (autovacuum_analyze_scale_factor = 0.0);
 ALTER TABLE {{.TableName}}q SET (autovacuum_analyze_threshold = 50000);
 `
 var dropScrema = `
+DROP TABLE IF EXISTS {{.TableName}}keys;
+DROP TABLE IF EXISTS {{.TableName}}acks;
+DROP TABLE IF EXISTS {{.TableName}}groups;
+DROP TABLE IF EXISTS {{.TableName}}topics;
+DROP TABLE IF EXISTS {{.TableName}}dlq;
 DROP TABLE IF EXISTS {{.TableName}}q;
 DROP SEQUENCE IF EXISTS {{.TableName}}q_id_seq;
 `
@@ -38,16 +104,176 @@ type Pgmq struct {
 	DB     *sql.DB
 	Prefix string
 	Ttl    time.Duration
-	exit   bool
-	Mutex  *sync.RWMutex
+	// Connection info for a LISTEN connection so Stream wakes up on publish, empty means poll only
+	DSN string
+	// Called with the events of the LISTEN connection, streams keep polling while it is
+	// down so this is the only place a bad DSN or lost connection shows up
+	OnListenerEvent func(event pq.ListenerEventType, err error)
+	// Deliveries before a message is moved to the dead letter table, 0 means unlimited
+	MaxAttempts int
+	// Delay before a failed message is delivered again, nil means right away
+	Backoff gq.Backoff
+	// How long messages are kept for consumer groups that have not acknowledged them, 0 means until every group has
+	Retention time.Duration
+	// How long an idempotency key is remembered before it can be published again, 0 means forever
+	DedupWindow time.Duration
+	// Wait after which a message is treated as one priority higher so low priority
+	// messages are not starved, 0 means strict priority order
+	Aging time.Duration
+	exit  bool
+	Mutex *sync.RWMutex
+	// Topic name when this queue was made by Topic
+	topic string
+	// Queue whose topics table lists this topic
+	parent     *Pgmq
+	topics     map[string]*Pgmq
+	topicTurn  int
+	topicMutex sync.Mutex
+}
+
+// encodeHeaders ... JSON text for the headers column or nil when there are none
+func encodeHeaders(headers map[string]string) (interface{}, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(headers)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// decodeHeaders ... Parse the headers column
+func decodeHeaders(b []byte) (map[string]string, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	headers := make(map[string]string)
+	err := json.Unmarshal(b, &headers)
+	return headers, err
 }
 
 func NewPgmq(db *sql.DB, prefix string) *Pgmq {
-	return &Pgmq{DB: db, Prefix: prefix, Ttl: 0 * time.Millisecond, exit: false, Mutex: &sync.RWMutex{}}
+	return &Pgmq{DB: db, Prefix: prefix, Ttl: 0 * time.Millisecond, MaxAttempts: 0, exit: false, Mutex: &sync.RWMutex{}}
+}
+
+// ttlMs ... Message TTL in milliseconds for the ttl column or nil to use the queue TTL
+func ttlMs(ttl time.Duration) interface{} {
+	if ttl <= 0 {
+		return nil
+	}
+	return ttl.Milliseconds()
+}
+
+// orderingKey ... Value for the ordering_key column, nil when the message is unordered
+func orderingKey(key string) interface{} {
+	if key == "" {
+		return nil
+	}
+	return key
+}
+
+// ordered ... Condition for messages that are the oldest still in the queue for their
+// ordering key. The older message stays in the table while it is checked out, so a
+// concurrent consumer skipping its locked row still can not take the next one.
+func (p *Pgmq) ordered() string {
+	return fmt.Sprintf("(ordering_key IS null OR NOT EXISTS (SELECT 1 FROM %[1]sq o WHERE o.ordering_key = %[1]sq.ordering_key AND o.id < %[1]sq.id))", p.Prefix)
+}
+
+// priority ... Expression for the priority of the table rows used to order checkout,
+// with Aging a message gains one priority for every Aging it has waited
+func (p *Pgmq) priority(table string) string {
+	if p.Aging <= 0 {
+		return fmt.Sprintf("%s.priority", table)
+	}
+	return fmt.Sprintf("(%[1]s.priority + FLOOR(EXTRACT(EPOCH FROM (now() - %[1]s.timestamp)) * 1000 / %[2]d))", table, p.Aging.Milliseconds())
+}
+
+// sortByPriority ... Highest priority first then oldest first
+func sortByPriority(ms []*gq.ConsumerMessage) {
+	sort.SliceStable(ms, func(i, j int) bool {
+		if ms[i].Priority != ms[j].Priority {
+			return ms[i].Priority > ms[j].Priority
+		}
+		return ms[i].Id < ms[j].Id
+	})
+}
+
+// available ... Condition for messages that can be checked out
+func (p *Pgmq) available() string {
+	return fmt.Sprintf("visible_at <= now() AND (checkout IS null OR (%s))", p.expired("", ""))
+}
+
+// expired ... Condition for checked out messages that are available again because the
+// TTL and any lease extension have passed. The checkout and lease_until columns are
+// prefixed with checkouts and the ttl column with messages so consumer groups can use
+// their own checkouts, empty prefixes for the queue table.
+func (p *Pgmq) expired(checkouts, messages string) string {
+	// Message TTL falls back to the queue TTL, with neither a checkout never expires
+	ttl := messages + "ttl"
+	if p.Ttl.Seconds() > 0.0 {
+		ttl = fmt.Sprintf("COALESCE(%sttl, %d)", messages, p.Ttl.Milliseconds())
+	}
+	return fmt.Sprintf("%[1]scheckout + (%[2]s * interval '1 millisecond') < now() AND (%[1]slease_until IS null OR %[1]slease_until < now())", checkouts, ttl)
+}
+
+// retryDelay ... How long a message that failed should wait before it is delivered again
+func (p *Pgmq) retryDelay(attempts int) time.Duration {
+	if p.Backoff == nil {
+		return 0
+	}
+	return p.Backoff.Delay(attempts)
+}
+
+// release ... Returns failed messages to the queue so they are delivered again after the backoff
+func (p *Pgmq) release(ctx context.Context, txn *sql.Tx, ids []int64) error {
+	q := fmt.Sprintf("SELECT id, attempts FROM %sq WHERE id = ANY($1) FOR UPDATE;", p.Prefix)
+	rows, err := txn.QueryContext(ctx, q, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	releaseIds := make([]int64, 0)
+	delays := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		var attempts int
+		err = rows.Scan(&id, &attempts)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		releaseIds = append(releaseIds, id)
+		delays = append(delays, p.retryDelay(attempts).Milliseconds())
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	q = fmt.Sprintf("UPDATE %[1]sq SET checkout = NULL, visible_at = now() + (r.delay * interval '1 millisecond') FROM unnest($1::int8[], $2::int8[]) AS r(id, delay) WHERE %[1]sq.id = r.id;", p.Prefix)
+	_, err = txn.ExecContext(ctx, q, pq.Array(releaseIds), pq.Array(delays))
+	return err
+}
+
+// deadLetter ... Atomically moves messages matching the condition into the dead letter table
+func (p *Pgmq) deadLetter(ctx context.Context, txn *sql.Tx, condition string, args ...interface{}) error {
+	q := fmt.Sprintf(`WITH dead AS (
+	DELETE FROM %[1]sq WHERE id IN (SELECT id FROM %[1]sq WHERE %[2]s FOR UPDATE SKIP LOCKED)
+	RETURNING id, timestamp, checkout, attempts, headers, payload, last_error, ttl, ordering_key, priority
+)
+INSERT INTO %[1]sdlq (id, timestamp, checkout, attempts, headers, payload, last_error, ttl, ordering_key, priority)
+SELECT id, timestamp, checkout, attempts, headers, payload, last_error, ttl, ordering_key, priority FROM dead;`, p.Prefix, condition)
+	_, err := txn.ExecContext(ctx, q, args...)
+	return err
 }
 
 // Create... builds any required tables
 func (p *Pgmq) Create() error {
+	return p.CreateContext(context.Background())
+}
+
+// CreateContext ... builds any required tables, a topic queue is also registered
+// with the queue it came from
+func (p *Pgmq) CreateContext(ctx context.Context) error {
 	d := struct{ TableName string }{
 		TableName: p.Prefix,
 	}
@@ -58,24 +284,39 @@ func (p *Pgmq) Create() error {
 	if err != nil {
 		return err
 	}
-	_, err = p.DB.Exec(b.String())
-	return err
+	_, err = p.DB.ExecContext(ctx, b.String())
+	if err != nil || p.parent == nil {
+		return err
+	}
+	return p.parent.registerTopic(ctx, p)
 }
 
 // Destroy ... removes any tables
 func (p *Pgmq) Destroy() error {
+	return p.DestroyContext(context.Background())
+}
+
+// DestroyContext ... removes any tables
+func (p *Pgmq) DestroyContext(ctx context.Context) error {
 	d := struct{ TableName string }{
 		TableName: p.Prefix,
 	}
 
+	err := p.destroyTopics(ctx)
+	if err != nil {
+		return err
+	}
 	t := template.Must(template.New("drop_table").Parse(dropScrema))
 	var b bytes.Buffer
-	err := t.Execute(&b, d)
+	err = t.Execute(&b, d)
 	if err != nil {
 		return err
 	}
-	_, err = p.DB.Exec(b.String())
-	return err
+	_, err = p.DB.ExecContext(ctx, b.String())
+	if err != nil || p.parent == nil {
+		return err
+	}
+	return p.parent.unregisterTopic(ctx, p.topic)
 }
 
 func (p *Pgmq) StopConsumer() {
@@ -93,63 +334,266 @@ func (p *Pgmq) Exit() bool {
 
 // Publish ... This pushes a list of messages into the DB
 func (p *Pgmq) Publish(messages []*gq.Message) error {
+	return p.PublishContext(context.Background(), messages)
+}
+
+// PublishContext ... This pushes a list of messages into the DB
+func (p *Pgmq) PublishContext(ctx context.Context, messages []*gq.Message) error {
 
-	txn, err := p.DB.Begin()
-	defer txn.Commit()
+	txn, err := p.DB.BeginTx(ctx, nil)
 	if err != nil {
-		fmt.Printf("Error with %s\n", err)
 		return err
 	}
-
-	stmt, err := txn.Prepare(pq.CopyIn(fmt.Sprintf("%sq", p.Prefix), "payload"))
+	err = p.publish(ctx, txn, messages)
 	if err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+// listenerPing ... How often a stream checks its LISTEN connection is still alive
+const listenerPing = time.Minute
+
+// channel ... Name of the channel publishes are notified on
+func (p *Pgmq) channel() string {
+	return fmt.Sprintf("%sq", p.Prefix)
+}
+
+func (p *Pgmq) publish(ctx context.Context, txn *sql.Tx, messages []*gq.Message) error {
+	messages, err := p.dedupe(ctx, txn, messages)
+	if err != nil || len(messages) == 0 {
 		return err
 	}
+	// Delayed messages need a visible time so they can not go through the copy
+	immediate := make([]*gq.Message, 0, len(messages))
 	for _, m := range messages {
-		_, err := stmt.Exec(m.Payload)
+		if m.NotBefore.IsZero() {
+			immediate = append(immediate, m)
+			continue
+		}
+		headers, err := encodeHeaders(m.Headers)
+		if err != nil {
+			return err
+		}
+		q := fmt.Sprintf("INSERT INTO %sq (payload, headers, ttl, ordering_key, priority, visible_at) VALUES ($1, $2, $3, $4, $5, $6::timestamptz);", p.Prefix)
+		_, err = txn.ExecContext(ctx, q, m.Payload, headers, ttlMs(m.TTL), orderingKey(m.OrderingKey), m.Priority, m.NotBefore)
 		if err != nil {
 			return err
 		}
 	}
-	_, err = stmt.Exec()
+	if len(immediate) == 0 {
+		return p.notify(ctx, txn)
+	}
+
+	stmt, err := txn.PrepareContext(ctx, pq.CopyIn(fmt.Sprintf("%sq", p.Prefix), "payload", "headers", "ttl", "ordering_key", "priority"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, m := range immediate {
+		headers, err := encodeHeaders(m.Headers)
+		if err == nil {
+			_, err = stmt.ExecContext(ctx, m.Payload, headers, ttlMs(m.TTL), orderingKey(m.OrderingKey), m.Priority)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = stmt.ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+	return p.notify(ctx, txn)
+}
+
+// dedupe ... Messages whose idempotency key has not been seen within the window,
+// the keys are recorded so a retried publish of the same key is dropped
+func (p *Pgmq) dedupe(ctx context.Context, txn *sql.Tx, messages []*gq.Message) ([]*gq.Message, error) {
+	keys := make([]string, 0)
+	for _, m := range messages {
+		if m.IdempotencyKey != "" {
+			keys = append(keys, m.IdempotencyKey)
+		}
+	}
+	if len(keys) == 0 {
+		return messages, nil
+	}
+	if p.DedupWindow > 0 {
+		q := fmt.Sprintf("DELETE FROM %skeys WHERE timestamp + ($1 * interval '1 millisecond') < now();", p.Prefix)
+		_, err := txn.ExecContext(ctx, q, p.DedupWindow.Milliseconds())
+		if err != nil {
+			return nil, err
+		}
+	}
+	q := fmt.Sprintf("INSERT INTO %skeys (key) SELECT unnest($1::text[]) ON CONFLICT DO NOTHING RETURNING key;", p.Prefix)
+	rows, err := txn.QueryContext(ctx, q, pq.Array(keys))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	inserted := make(map[string]bool)
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		inserted[key] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	unique := make([]*gq.Message, 0, len(messages))
+	for _, m := range messages {
+		if m.IdempotencyKey != "" {
+			if !inserted[m.IdempotencyKey] {
+				continue
+			}
+			// Only the first message with a key in the batch
+			delete(inserted, m.IdempotencyKey)
+		}
+		unique = append(unique, m)
+	}
+	return unique, nil
+}
+
+// notify ... Wake any listening streams once the transaction commits
+func (p *Pgmq) notify(ctx context.Context, txn *sql.Tx) error {
+	_, err := txn.ExecContext(ctx, "SELECT pg_notify($1, '');", p.channel())
 	return err
 }
 
+// PublishTx ... Publishes inside a transaction the caller owns so the messages are only
+// visible if the caller commits, the caller is responsible for commit or rollback
+func (p *Pgmq) PublishTx(ctx context.Context, txn *sql.Tx, messages []*gq.Message) error {
+	return p.publish(ctx, txn, messages)
+}
+
+// CommitTx ... Commits receipts inside a transaction the caller owns so processing
+// results and the receipts land together
+func (p *Pgmq) CommitTx(ctx context.Context, txn *sql.Tx, recipts []*gq.Receipt) error {
+	return p.commit(ctx, txn, recipts)
+}
+
+// Commit ... Removes any messages that have been successfully consumed
 func (p *Pgmq) Commit(recipts []*gq.Receipt) error {
-	deleteQuery := fmt.Sprintf("DELETE FROM %sq WHERE id = ANY($1)", p.Prefix)
-	deleteStmt, err := p.DB.Prepare(deleteQuery)
+	return p.CommitContext(context.Background(), recipts)
+}
+
+// CommitContext ... Removes any messages that have been successfully consumed,
+// failed messages record the error and are released for retry after the backoff
+func (p *Pgmq) CommitContext(ctx context.Context, recipts []*gq.Receipt) error {
+	txn, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = p.commit(ctx, txn, recipts)
 	if err != nil {
+		txn.Rollback()
 		return err
 	}
-	defer deleteStmt.Close()
+	return txn.Commit()
+}
+
+func (p *Pgmq) commit(ctx context.Context, txn *sql.Tx, recipts []*gq.Receipt) error {
 	deleteIds := make([]int64, 0)
+	failedIds := make([]int64, 0)
+	failedErrors := make([]string, 0)
 	for _, r := range recipts {
 		if r.Success {
 			deleteIds = append(deleteIds, r.Id)
+		} else {
+			failedIds = append(failedIds, r.Id)
+			failedErrors = append(failedErrors, r.Error)
+		}
+	}
+	if len(deleteIds) > 0 {
+		deleteQuery := fmt.Sprintf("DELETE FROM %sq WHERE id = ANY($1)", p.Prefix)
+		_, err := txn.ExecContext(ctx, deleteQuery, pq.Array(deleteIds))
+		if err != nil {
+			return err
 		}
 	}
-	_, err = deleteStmt.Exec(pq.Array(deleteIds))
+	if len(failedIds) == 0 {
+		return nil
+	}
+	errorQuery := fmt.Sprintf("UPDATE %[1]sq SET last_error = f.reason FROM unnest($1::int8[], $2::text[]) AS f(id, reason) WHERE %[1]sq.id = f.id", p.Prefix)
+	_, err := txn.ExecContext(ctx, errorQuery, pq.Array(failedIds), pq.Array(failedErrors))
+	if err != nil {
+		return err
+	}
+	// Failed messages that are out of attempts go straight to the dead letter table
+	if p.MaxAttempts > 0 {
+		err = p.deadLetter(ctx, txn, fmt.Sprintf("id = ANY($1) AND attempts >= %d", p.MaxAttempts), pq.Array(failedIds))
+		if err != nil {
+			return err
+		}
+	}
+	return p.release(ctx, txn, failedIds)
+}
+
+// Extend ... Extends the lease on checked out messages so they are not delivered again
+// until lease from now even if the TTL passes. Call it periodically while a message
+// is still being worked on, see gq.Heartbeat.
+func (p *Pgmq) Extend(ctx context.Context, ms []*gq.ConsumerMessage, lease time.Duration) error {
+	ids, attempts := checkouts(ms)
+	q := fmt.Sprintf(`UPDATE %[1]sq SET lease_until = now() + ($3 * interval '1 millisecond')
+FROM unnest($1::int8[], $2::int8[]) AS m(id, attempts)
+WHERE %[1]sq.id = m.id AND %[1]sq.attempts = m.attempts AND %[1]sq.checkout IS NOT null;`, p.Prefix)
+	_, err := p.DB.ExecContext(ctx, q, pq.Array(ids), pq.Array(attempts), lease.Milliseconds())
 	return err
 }
 
+// checkouts ... Ids and attempts of the messages, every checkout adds an attempt so a
+// message checked out again since does not match its attempts
+func checkouts(ms []*gq.ConsumerMessage) ([]int64, []int64) {
+	ids := make([]int64, len(ms))
+	attempts := make([]int64, len(ms))
+	for i, m := range ms {
+		ids[i] = m.Id
+		attempts[i] = int64(m.Attempts)
+	}
+	return ids, attempts
+}
+
 // ConsumeBatch ... This consumes a number of messages up to the limit
 func (p *Pgmq) ConsumeBatch(size int) ([]*gq.ConsumerMessage, error) {
-	ms := make([]*gq.ConsumerMessage, 0)
-	// Query any messages that have not been checked out
-	q := fmt.Sprintf("UPDATE %sq SET checkout = now() WHERE id IN (SELECT id FROM %sq WHERE checkout IS null ", p.Prefix, p.Prefix)
-	// If there is a TTL then checkout messages that have expired
-	if p.Ttl.Seconds() > 0.0 {
-		q = fmt.Sprintf("OR checkout + $2 > now()")
+	return p.ConsumeBatchContext(context.Background(), size)
+}
+
+// ConsumeBatchContext ... This consumes a number of messages up to the limit
+func (p *Pgmq) ConsumeBatchContext(ctx context.Context, size int) ([]*gq.ConsumerMessage, error) {
+	txn, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return make([]*gq.ConsumerMessage, 0), err
 	}
-	q = fmt.Sprintf("%s ORDER BY checkout ASC NULLS FIRST, timestamp ASC FOR UPDATE SKIP LOCKED LIMIT $1) RETURNING id, payload;", q)
-	//fmt.Printf("%s\n", q)
-	txn, err := p.DB.Begin()
+	ms, err := p.consume(ctx, txn, size)
 	if err != nil {
+		txn.Rollback()
 		return ms, err
 	}
-	defer txn.Commit()
+	if err = txn.Commit(); err != nil {
+		return make([]*gq.ConsumerMessage, 0), err
+	}
+	return ms, nil
+}
+
+// consume ... Checks out up to size messages in the transaction, the rows stay locked until it ends
+func (p *Pgmq) consume(ctx context.Context, txn *sql.Tx, size int) ([]*gq.ConsumerMessage, error) {
+	ms := make([]*gq.ConsumerMessage, 0)
+	// Query any messages that have not been checked out
+	q := fmt.Sprintf("UPDATE %sq SET checkout = now(), lease_until = NULL, attempts = attempts + 1 WHERE id IN (SELECT id FROM %sq WHERE %s AND %s", p.Prefix, p.Prefix, p.available(), p.ordered())
+	q = fmt.Sprintf("%s ORDER BY checkout ASC NULLS FIRST, %s DESC, timestamp ASC, id ASC FOR UPDATE SKIP LOCKED LIMIT $1) RETURNING id, payload, headers, timestamp, checkout, attempts, ttl, ordering_key, priority;", q, p.priority(p.Prefix+"q"))
 
-	stmt, err := p.DB.Prepare(q)
+	// Messages out of attempts are dead lettered instead of delivered again
+	if p.MaxAttempts > 0 {
+		err := p.deadLetter(ctx, txn, fmt.Sprintf("%s AND attempts >= %d", p.available(), p.MaxAttempts))
+		if err != nil {
+			return ms, err
+		}
+	}
+
+	stmt, err := txn.PrepareContext(ctx, q)
 	if err != nil {
 		return ms, err
 	}
@@ -157,45 +601,217 @@ func (p *Pgmq) ConsumeBatch(size int) ([]*gq.ConsumerMessage, error) {
 
 	var rows *sql.Rows
 
-	// TTL queries takes an extra param
-	if p.Ttl.Seconds() > 0.0 {
-		rows, err = stmt.Query(size, p.Ttl)
-	} else {
-		rows, err = stmt.Query(size)
-	}
+	rows, err = stmt.QueryContext(ctx, size)
 	if err != nil {
 		return ms, err
 	}
-
 	defer rows.Close()
+
 	for rows.Next() {
-		var id int64
-		var payload []byte
-		rows.Scan(&id, &payload)
-		ms = append(ms, &gq.ConsumerMessage{Message: gq.Message{Payload: payload}, Id: id})
+		m := &gq.ConsumerMessage{}
+		var headers []byte
+		var ttl sql.NullInt64
+		var key sql.NullString
+		err = rows.Scan(&m.Id, &m.Payload, &headers, &m.Timestamp, &m.Checkout, &m.Attempts, &ttl, &key, &m.Priority)
+		if err == nil {
+			m.Headers, err = decodeHeaders(headers)
+		}
+		if err != nil {
+			return make([]*gq.ConsumerMessage, 0), err
+		}
+		m.TTL = time.Duration(ttl.Int64) * time.Millisecond
+		m.OrderingKey = key.String
+		m.Topic = p.topic
+		ms = append(ms, m)
+	}
+	if err = rows.Err(); err != nil {
+		return make([]*gq.ConsumerMessage, 0), err
 	}
+	// RETURNING does not guarantee order
+	sortByPriority(ms)
 	return ms, nil
 }
 
+// receipts ... Receipt for every message, failed with the error when there is one
+func receipts(ms []*gq.ConsumerMessage, err error) []*gq.Receipt {
+	rs := make([]*gq.Receipt, len(ms))
+	for i, m := range ms {
+		rs[i] = &gq.Receipt{Id: m.Id, Success: err == nil, Topic: m.Topic}
+		if err != nil {
+			rs[i].Error = err.Error()
+		}
+	}
+	return rs
+}
+
+// ConsumeTx ... Checks out up to size messages and hands them to the handler with the
+// same transaction. When the handler succeeds the messages are removed in that
+// transaction so its writes and the removal commit together and the messages can not
+// be redelivered. When it fails its writes are rolled back and the messages are
+// released with the error. Returns the number of messages handled and the handler error.
+func (p *Pgmq) ConsumeTx(ctx context.Context, size int, handler gq.TxHandler) (int, error) {
+	txn, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	ms, err := p.consume(ctx, txn, size)
+	if err != nil || len(ms) == 0 {
+		txn.Rollback()
+		return 0, err
+	}
+	_, err = txn.ExecContext(ctx, "SAVEPOINT gq_handler;")
+	if err != nil {
+		txn.Rollback()
+		return 0, err
+	}
+	handlerErr := handler(ctx, txn, ms)
+	if handlerErr != nil {
+		_, err = txn.ExecContext(ctx, "ROLLBACK TO SAVEPOINT gq_handler;")
+		if err != nil {
+			txn.Rollback()
+			return 0, err
+		}
+	}
+	err = p.commit(ctx, txn, receipts(ms, handlerErr))
+	if err != nil {
+		txn.Rollback()
+		return 0, err
+	}
+	if err = txn.Commit(); err != nil {
+		return 0, err
+	}
+	return len(ms), handlerErr
+}
+
 // Stream ... Creates a stream of consumption
 func (p *Pgmq) Stream(size int, messages chan []*gq.ConsumerMessage, pause time.Duration) {
+	p.StreamContext(context.Background(), size, messages, pause)
+}
+
+// listen ... Listener for publish notifications or nil when there is no DSN. It connects
+// in the background so the stream polls from the start and keeps polling if the listener
+// never connects, once connected it is pinged every listenerPing until done is closed.
+func (p *Pgmq) listen(done <-chan struct{}) *pq.Listener {
+	if p.DSN == "" {
+		return nil
+	}
+	var connected atomic.Bool
+	listener := pq.NewListener(p.DSN, 10*time.Millisecond, time.Minute, func(event pq.ListenerEventType, err error) {
+		// A reconnect also sends a nil notification so the stream polls for anything missed
+		connected.Store(event == pq.ListenerEventConnected || event == pq.ListenerEventReconnected)
+		if p.OnListenerEvent != nil {
+			p.OnListenerEvent(event, err)
+		}
+	})
+	go func() {
+		// Blocks until the first connection, closing the listener ends it
+		if err := listener.Listen(p.channel()); err != nil {
+			return
+		}
+		ticker := time.NewTicker(listenerPing)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// Notifications may be rare so check the connection so a dead one is reconnected
+				if connected.Load() {
+					listener.Ping()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return listener
+}
+
+// wait ... Blocks until a publish notification, the pause or the context is done.
+// Returns false when the context is done.
+func (p *Pgmq) wait(ctx context.Context, listener *pq.Listener, pause time.Duration) bool {
+	var notify <-chan *pq.Notification
+	if listener != nil {
+		notify = listener.Notify
+	}
+	timer := time.NewTimer(pause)
+	defer timer.Stop()
+	select {
+	case <-notify:
+		// A nil notification means the listener reconnected and may have missed some so poll either way
+		// Drain any others that queued up since one poll consumes them all
+		for {
+			select {
+			case <-notify:
+			default:
+				return true
+			}
+		}
+	case <-timer.C:
+		// Polling is the fallback when a notification is missed or there is no listener
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// StreamContext ... Creates a stream of consumption that ends when the context is done.
+// When DSN is set the stream wakes up as soon as messages are published otherwise
+// it polls every pause.
+func (p *Pgmq) StreamContext(ctx context.Context, size int, messages chan []*gq.ConsumerMessage, pause time.Duration) {
+	p.stream(ctx, size, messages, pause, p.ConsumeBatchContext, p.unlock, p.Exit)
+}
+
+// unlock ... Returns checked out messages that were never handed to a consumer to the
+// queue straight away, the delivery does not count as an attempt
+func (p *Pgmq) unlock(ctx context.Context, ms []*gq.ConsumerMessage) error {
+	q := fmt.Sprintf("UPDATE %sq SET checkout = NULL, lease_until = NULL, attempts = attempts - 1 WHERE id = ANY($1) AND checkout IS NOT null;", p.Prefix)
+	_, err := p.DB.ExecContext(ctx, q, pq.Array(messageIds(ms)))
+	return err
+}
+
+// messageIds ... Ids of the messages
+func messageIds(ms []*gq.ConsumerMessage) []int64 {
+	ids := make([]int64, len(ms))
+	for i, m := range ms {
+		ids[i] = m.Id
+	}
+	return ids
+}
+
+// stream ... Feeds batches from consume into messages until exit or the context is done,
+// a batch checked out when the context is done is given back with unlock
+func (p *Pgmq) stream(ctx context.Context, size int, messages chan []*gq.ConsumerMessage, pause time.Duration,
+	consume func(context.Context, int) ([]*gq.ConsumerMessage, error), unlock func(context.Context, []*gq.ConsumerMessage) error, exit func() bool) {
 	defer close(messages)
+	done := make(chan struct{})
+	defer close(done)
+	listener := p.listen(done)
+	if listener != nil {
+		defer listener.Close()
+	}
 	for {
 
 		// Consume until there are no more messages or there is an error
 		// No messages there was an error or time to exit
 		for {
-			if p.Exit() {
+			if exit() || ctx.Err() != nil {
 				return
 			}
-			ms, err := p.ConsumeBatch(size)
+			ms, err := consume(ctx, size)
 			// If exit then
 			if len(ms) == 0 || err != nil {
 				break
 			}
-			messages <- ms
+			select {
+			case messages <- ms:
+			case <-ctx.Done():
+				// The context is already done so the unlock can not use it
+				unlock(context.WithoutCancel(ctx), ms)
+				return
+			}
 		}
 		// Breather so not just infinite loop of queries
-		time.Sleep(pause)
+		if !p.wait(ctx, listener, pause) {
+			return
+		}
 	}
 }
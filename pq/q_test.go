@@ -1,6 +1,7 @@
 package pq
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
@@ -9,15 +10,18 @@ import (
 	"time"
 
 	"github.com/lateefj/gq"
-	_ "github.com/lib/pq" // Postgresql Driver
+	"github.com/lateefj/gq/gqtest"
+	pq "github.com/lib/pq" // Postgresql Driver
 )
 
 var db *sql.DB
+var dsn string
 
 func init() {
 	user := os.Getenv("USER")
 	var err error
-	db, err = sql.Open("postgres", fmt.Sprintf("postgres://%s:@localhost/pgmq?sslmode=disable", user))
+	dsn = fmt.Sprintf("postgres://%s:@localhost/pgmq?sslmode=disable", user)
+	db, err = sql.Open("postgres", dsn)
 	if err != nil {
 		log.Fatal(err)
 		return
@@ -25,6 +29,15 @@ func init() {
 	db.SetMaxOpenConns(8)
 }
 
+var _ gq.DeadLetterQueue = (*Pgmq)(nil)
+var _ gq.ContextMQ = (*Pgmq)(nil)
+var _ gq.TxMQ = (*Pgmq)(nil)
+var _ gq.Extender = (*Pgmq)(nil)
+var _ gq.Extender = (*Group)(nil)
+var _ gq.StatsQueue = (*Pgmq)(nil)
+var _ gq.Browser = (*Pgmq)(nil)
+var _ gq.Restorer = (*Pgmq)(nil)
+
 func setup() *Pgmq {
 	return NewPgmq(db, "test_")
 }
@@ -44,6 +57,50 @@ func TestSchema(t *testing.T) {
 	}
 
 }
+
+// Test a table created by the first release is upgraded with the new columns and its
+// messages are still delivered
+func TestUpgradeSchema(t *testing.T) {
+	mq := setup()
+	defer cleanup(mq)
+	baseline := `
+CREATE SEQUENCE IF NOT EXISTS test_q_id_seq;
+CREATE TABLE IF NOT EXISTS test_q (
+	id INT8 NOT NULL DEFAULT nextval('test_q_id_seq') PRIMARY KEY,
+	timestamp TIMESTAMP NOT NULL DEFAULt now(),
+	checkout TIMESTAMP,
+	payload BYTEA
+);
+CREATE INDEX IF NOT EXISTS test_q_timestamp_idx ON test_q (checkout ASC NULLS FIRST, timestamp ASC);
+INSERT INTO test_q (payload) VALUES ('before upgrade');
+`
+	if _, err := db.Exec(baseline); err != nil {
+		t.Fatalf("Could not create the baseline schema %s", err)
+	}
+	if err := mq.Create(); err != nil {
+		t.Fatalf("Could not upgrade the schema %s", err)
+	}
+	if err := mq.Create(); err != nil {
+		t.Fatalf("Could not create the upgraded schema %s", err)
+	}
+	var old int
+	db.QueryRow("SELECT COUNT(*) FROM pg_indexes WHERE indexname = 'test_q_timestamp_idx';").Scan(&old)
+	if old != 0 {
+		t.Errorf("Expected the old index to be replaced")
+	}
+	err := mq.Publish([]*gq.Message{&gq.Message{Payload: []byte("after upgrade"), Headers: map[string]string{"a": "b"}, Priority: 1}})
+	if err != nil {
+		t.Fatalf("Failed to publish after the upgrade %s", err)
+	}
+	ms, err := mq.ConsumeBatch(10)
+	if err != nil || len(ms) != 2 {
+		t.Fatalf("Expected both messages got %d error %v", len(ms), err)
+	}
+	if string(ms[0].Payload) != "after upgrade" || ms[0].Headers["a"] != "b" || string(ms[1].Payload) != "before upgrade" || ms[1].Attempts != 1 {
+		t.Errorf("Expected the new message by priority then the old one got %+v %+v", ms[0], ms[1])
+	}
+}
+
 func TestPublishConsume(t *testing.T) {
 	// t.Fatal("not implemented")
 	mq := setup()
@@ -133,6 +190,164 @@ func TestStream(t *testing.T) {
 	}
 }
 
+// Test a listening stream wakes up on publish rather than waiting for the pause
+func TestStreamNotify(t *testing.T) {
+	mq := setup()
+	mq.DSN = dsn
+	connected := make(chan struct{}, 1)
+	mq.OnListenerEvent = func(event pq.ListenerEventType, err error) {
+		if event == pq.ListenerEventConnected {
+			connected <- struct{}{}
+		}
+	}
+	err := mq.Create()
+	if err != nil {
+		t.Fatalf("Could not create schema %s", err)
+	}
+	defer cleanup(mq)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := make(chan []*gq.ConsumerMessage, 0)
+	go mq.StreamContext(ctx, 1, stream, 10*time.Second)
+	select {
+	case <-connected:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Listener did not connect")
+	}
+	// Give the stream time to do its first empty poll and start waiting
+	time.Sleep(100 * time.Millisecond)
+	err = mq.Publish([]*gq.Message{&gq.Message{Payload: []byte("test")}})
+	if err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+	select {
+	case group := <-stream:
+		if len(group) != 1 {
+			t.Fatalf("Expected 1 message got %d", len(group))
+		}
+		mq.Commit([]*gq.Receipt{&gq.Receipt{Id: group[0].Id, Success: true}})
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Stream was not woken up by the publish")
+	}
+}
+
+// Test a listening stream wakes up when dead letters are requeued
+func TestRequeueNotify(t *testing.T) {
+	mq := setup()
+	mq.DSN = dsn
+	mq.MaxAttempts = 1
+	connected := make(chan struct{}, 1)
+	mq.OnListenerEvent = func(event pq.ListenerEventType, err error) {
+		if event == pq.ListenerEventConnected {
+			connected <- struct{}{}
+		}
+	}
+	err := mq.Create()
+	if err != nil {
+		t.Fatalf("Could not create schema %s", err)
+	}
+	defer cleanup(mq)
+
+	err = mq.Publish([]*gq.Message{&gq.Message{Payload: []byte("test")}})
+	if err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+	ms, err := mq.ConsumeBatch(1)
+	if err != nil || len(ms) != 1 {
+		t.Fatalf("Expected 1 message got %d error %v", len(ms), err)
+	}
+	err = mq.Commit([]*gq.Receipt{&gq.Receipt{Id: ms[0].Id, Success: false, Error: "failed"}})
+	if err != nil {
+		t.Fatalf("Failed to commit %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := make(chan []*gq.ConsumerMessage, 0)
+	go mq.StreamContext(ctx, 1, stream, 10*time.Second)
+	select {
+	case <-connected:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Listener did not connect")
+	}
+	// Give the stream time to do its first empty poll and start waiting
+	time.Sleep(100 * time.Millisecond)
+	n, err := mq.RequeueDeadLetters(context.Background(), []int64{ms[0].Id})
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 requeued dead letter got %d error %v", n, err)
+	}
+	select {
+	case group := <-stream:
+		if len(group) != 1 {
+			t.Fatalf("Expected 1 message got %d", len(group))
+		}
+		mq.Commit([]*gq.Receipt{&gq.Receipt{Id: group[0].Id, Success: true}})
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Stream was not woken up by the requeue")
+	}
+}
+
+// Test a stream with a DSN that can not connect still polls and ends when cancelled
+func TestStreamBadDSN(t *testing.T) {
+	mq := setup()
+	mq.DSN = "postgres://nobody@127.0.0.1:1/none?sslmode=disable&connect_timeout=1"
+	failed := make(chan error, 1)
+	mq.OnListenerEvent = func(event pq.ListenerEventType, err error) {
+		if event == pq.ListenerEventConnectionAttemptFailed {
+			select {
+			case failed <- err:
+			default:
+			}
+		}
+	}
+	err := mq.Create()
+	if err != nil {
+		t.Fatalf("Could not create schema %s", err)
+	}
+	defer cleanup(mq)
+	err = mq.Publish([]*gq.Message{&gq.Message{Payload: []byte("test")}})
+	if err != nil {
+		t.Fatalf("Failed to publish %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := make(chan []*gq.ConsumerMessage, 0)
+	go mq.StreamContext(ctx, 1, stream, 10*time.Millisecond)
+	select {
+	case group := <-stream:
+		mq.Commit([]*gq.Receipt{&gq.Receipt{Id: group[0].Id, Success: true}})
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Stream did not poll while the listener could not connect")
+	}
+	select {
+	case <-failed:
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected the failed connection to be reported")
+	}
+	cancel()
+	select {
+	case _, ok := <-stream:
+		if ok {
+			t.Fatalf("Expected no more messages")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Stream did not close after the cancel")
+	}
+}
+
+func TestTopics(t *testing.T) {
+	gqtest.RunTopics(t, func(t *testing.T) gqtest.TopicQueue[*Pgmq] { return setup() })
+}
+
+func TestTx(t *testing.T) {
+	gqtest.RunTx(t, db, func(t *testing.T) gqtest.TxQueue { return setup() })
+}
+
+func TestGroups(t *testing.T) {
+	gqtest.RunGroups(t, func(t *testing.T) gqtest.GroupQueue[*Group] { return setup() })
+}
+
 func publishConsumeSize(b *testing.B, size int) {
 	b.ReportAllocs()
 
@@ -175,3 +390,17 @@ func BenchmarkPublishConsume10(b *testing.B)    { publishConsumeSize(b, 10) }
 func BenchmarkPublishConsume100(b *testing.B)   { publishConsumeSize(b, 100) }
 func BenchmarkPublishConsume1000(b *testing.B)  { publishConsumeSize(b, 1000) }
 func BenchmarkPublishConsume10000(b *testing.B) { publishConsumeSize(b, 10000) }
+
+func TestConformance(t *testing.T) {
+	queues := 0
+	gqtest.RunConformance(t, func(t *testing.T, cfg gqtest.Config) gq.MQ {
+		queues++
+		mq := NewPgmq(db, fmt.Sprintf("conformance%d_", queues))
+		mq.Ttl = cfg.TTL
+		mq.MaxAttempts = cfg.MaxAttempts
+		mq.Backoff = cfg.Backoff
+		mq.DedupWindow = cfg.DedupWindow
+		mq.Aging = cfg.Aging
+		return mq
+	})
+}
@@ -0,0 +1,59 @@
+package pq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lateefj/gq"
+)
+
+// Stats ... Counts of the messages by state, the age of the oldest message and the size
+// of the queue tables. With estimate the counts come from pg_class.reltuples, which
+// is only as fresh as the last ANALYZE, and only Total and DeadLetters are set.
+func (p *Pgmq) Stats(ctx context.Context, estimate bool) (*gq.Stats, error) {
+	s := &gq.Stats{Estimated: estimate}
+	var age sql.NullFloat64
+	// Restore keeps the publish time so the lowest id is not always the oldest
+	ready, _ := p.state(gq.StateReady)
+	q := fmt.Sprintf("SELECT EXTRACT(EPOCH FROM (now() - min(timestamp))) FROM %sq WHERE %s;", p.Prefix, ready)
+	err := p.DB.QueryRowContext(ctx, q).Scan(&age)
+	if err != nil {
+		return nil, err
+	}
+	s.OldestAge = time.Duration(age.Float64 * float64(time.Second))
+
+	q = fmt.Sprintf("SELECT pg_total_relation_size('%[1]sq') + pg_total_relation_size('%[1]sdlq');", p.Prefix)
+	if err = p.DB.QueryRowContext(ctx, q).Scan(&s.Bytes); err != nil {
+		return nil, err
+	}
+
+	if estimate {
+		// reltuples is -1 for a table that has never been analyzed
+		q = fmt.Sprintf(`SELECT GREATEST(q.reltuples, 0)::int8, GREATEST(d.reltuples, 0)::int8
+FROM pg_class q, pg_class d WHERE q.oid = '%[1]sq'::regclass AND d.oid = '%[1]sdlq'::regclass;`, p.Prefix)
+		err = p.DB.QueryRowContext(ctx, q).Scan(&s.Total, &s.DeadLetters)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	// Counted in the same order they are scanned
+	columns := ""
+	for _, state := range []gq.MessageState{gq.StateReady, gq.StateInFlight, gq.StateExpired, gq.StateDelayed} {
+		condition, _ := p.state(state)
+		columns += fmt.Sprintf("COUNT(*) FILTER (WHERE %s), ", condition)
+	}
+	q = fmt.Sprintf("SELECT %sCOUNT(*) FROM %sq;", columns, p.Prefix)
+	err = p.DB.QueryRowContext(ctx, q).Scan(&s.Ready, &s.InFlight, &s.Expired, &s.Delayed, &s.Total)
+	if err != nil {
+		return nil, err
+	}
+	err = p.DB.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %sdlq;", p.Prefix)).Scan(&s.DeadLetters)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
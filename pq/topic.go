@@ -0,0 +1,207 @@
+package pq
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/lateefj/gq"
+)
+
+// Each topic gets its own tables named <prefix><topic>_ which are listed in the
+// <prefix>topics table
+var createTopicsSchema = `
+CREATE TABLE IF NOT EXISTS %stopics (
+	name TEXT NOT NULL PRIMARY KEY,
+	timestamp TIMESTAMP NOT NULL DEFAULT now()
+);
+`
+
+// Topic ... Queue for a named topic sharing the database and settings, the
+// topic tables are created and the topic registered on first use by PublishTopic
+// or CreateContext
+func (p *Pgmq) Topic(name string) (*Pgmq, error) {
+	if err := gq.ValidateTopic(name); err != nil {
+		return nil, err
+	}
+	p.topicMutex.Lock()
+	defer p.topicMutex.Unlock()
+	if t, ok := p.topics[name]; ok {
+		return t, nil
+	}
+	return p.newTopic(name), nil
+}
+
+func (p *Pgmq) newTopic(name string) *Pgmq {
+	return &Pgmq{
+		DB:              p.DB,
+		Prefix:          fmt.Sprintf("%s%s_", p.Prefix, name),
+		Ttl:             p.Ttl,
+		DSN:             p.DSN,
+		OnListenerEvent: p.OnListenerEvent,
+		MaxAttempts:     p.MaxAttempts,
+		Backoff:         p.Backoff,
+		Retention:       p.Retention,
+		DedupWindow:     p.DedupWindow,
+		Aging:           p.Aging,
+		Mutex:           &sync.RWMutex{},
+		topic:           name,
+		parent:          p,
+	}
+}
+
+// ensureTopic ... Topic queue with its tables created and registered. The lock is not
+// held while the tables are created, creating is idempotent so concurrent first uses of
+// a topic can both do it and the first to finish is kept.
+func (p *Pgmq) ensureTopic(ctx context.Context, name string) (*Pgmq, error) {
+	if err := gq.ValidateTopic(name); err != nil {
+		return nil, err
+	}
+	p.topicMutex.Lock()
+	t, ok := p.topics[name]
+	p.topicMutex.Unlock()
+	if ok {
+		return t, nil
+	}
+	t = p.newTopic(name)
+	if err := t.CreateContext(ctx); err != nil {
+		return nil, err
+	}
+	p.topicMutex.Lock()
+	defer p.topicMutex.Unlock()
+	return p.topics[name], nil
+}
+
+// registerTopic ... Lists the topic in the topics table and keeps its queue, called
+// when a topic queue is created
+func (p *Pgmq) registerTopic(ctx context.Context, t *Pgmq) error {
+	_, err := p.DB.ExecContext(ctx, fmt.Sprintf(createTopicsSchema, p.Prefix))
+	if err != nil {
+		return err
+	}
+	q := fmt.Sprintf("INSERT INTO %stopics (name) VALUES ($1) ON CONFLICT DO NOTHING;", p.Prefix)
+	_, err = p.DB.ExecContext(ctx, q, t.topic)
+	if err != nil {
+		return err
+	}
+	p.topicMutex.Lock()
+	defer p.topicMutex.Unlock()
+	if _, ok := p.topics[t.topic]; ok {
+		return nil
+	}
+	if p.topics == nil {
+		p.topics = make(map[string]*Pgmq)
+	}
+	p.topics[t.topic] = t
+	return nil
+}
+
+// PublishTopic ... Publish messages to a topic creating it if it does not exist
+func (p *Pgmq) PublishTopic(ctx context.Context, topic string, messages []*gq.Message) error {
+	t, err := p.ensureTopic(ctx, topic)
+	if err != nil {
+		return err
+	}
+	return t.PublishContext(ctx, messages)
+}
+
+// ConsumeTopics ... Consume up to size messages across the topics, each message
+// has its Topic set. The starting topic rotates between calls so no topic starves.
+func (p *Pgmq) ConsumeTopics(ctx context.Context, topics []string, size int) ([]*gq.ConsumerMessage, error) {
+	if len(topics) == 0 {
+		return make([]*gq.ConsumerMessage, 0), nil
+	}
+	p.topicMutex.Lock()
+	turn := p.topicTurn % len(topics)
+	p.topicTurn++
+	p.topicMutex.Unlock()
+	return gq.ConsumeTopics(ctx, topics, turn, size, func(ctx context.Context, topic string, size int) ([]*gq.ConsumerMessage, error) {
+		t, err := p.ensureTopic(ctx, topic)
+		if err != nil {
+			return nil, err
+		}
+		return t.ConsumeBatchContext(ctx, size)
+	})
+}
+
+// CommitTopics ... Commit receipts to the topics they were consumed from, receipts
+// without a topic go to this queue. Each topic commits in its own transaction.
+func (p *Pgmq) CommitTopics(ctx context.Context, recipts []*gq.Receipt) error {
+	return gq.CommitTopics(ctx, recipts, func(ctx context.Context, topic string, rs []*gq.Receipt) error {
+		if topic == "" {
+			return p.CommitContext(ctx, rs)
+		}
+		t, err := p.ensureTopic(ctx, topic)
+		if err != nil {
+			return err
+		}
+		return t.CommitContext(ctx, rs)
+	})
+}
+
+// Topics ... Names of the topics that exist
+func (p *Pgmq) Topics(ctx context.Context) ([]string, error) {
+	names := make([]string, 0)
+	ok, err := p.hasTopics(ctx)
+	if err != nil || !ok {
+		return names, err
+	}
+	rows, err := p.DB.QueryContext(ctx, fmt.Sprintf("SELECT name FROM %stopics ORDER BY name ASC;", p.Prefix))
+	if err != nil {
+		return names, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return names, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// DeleteTopic ... Removes the topic tables and everything in them
+func (p *Pgmq) DeleteTopic(ctx context.Context, name string) error {
+	t, err := p.Topic(name)
+	if err != nil {
+		return err
+	}
+	return t.DestroyContext(ctx)
+}
+
+// unregisterTopic ... Forgets the topic and removes it from the topics table, called
+// when a topic queue is destroyed
+func (p *Pgmq) unregisterTopic(ctx context.Context, name string) error {
+	p.topicMutex.Lock()
+	delete(p.topics, name)
+	p.topicMutex.Unlock()
+	ok, err := p.hasTopics(ctx)
+	if err != nil || !ok {
+		return err
+	}
+	_, err = p.DB.ExecContext(ctx, fmt.Sprintf("DELETE FROM %stopics WHERE name = $1;", p.Prefix), name)
+	return err
+}
+
+// hasTopics ... Whether the topics table exists, it is created when the first topic is
+// registered
+func (p *Pgmq) hasTopics(ctx context.Context) (bool, error) {
+	var ok bool
+	err := p.DB.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL;", p.Prefix+"topics").Scan(&ok)
+	return ok, err
+}
+
+// destroyTopics ... Removes every registered topic
+func (p *Pgmq) destroyTopics(ctx context.Context) error {
+	names, err := p.Topics(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err = p.DeleteTopic(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
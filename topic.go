@@ -0,0 +1,55 @@
+package gq
+
+import (
+	"context"
+	"errors"
+	"regexp"
+)
+
+// ErrInvalidTopic returned when a topic name can not be used as part of a table name
+var ErrInvalidTopic = errors.New("gq: topic names must be 1 to 32 lower case letters, digits or underscores")
+
+var topicPattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// ValidateTopic checks the topic name is safe to use in a table name
+func ValidateTopic(name string) error {
+	if !topicPattern.MatchString(name) {
+		return ErrInvalidTopic
+	}
+	return nil
+}
+
+// ConsumeTopics ... Consumes up to size messages across the topics with consume, starting
+// at the topic turn picks so callers can rotate it between calls and no topic starves.
+// Shared by the backends that keep each topic in its own queue.
+func ConsumeTopics(ctx context.Context, topics []string, turn int, size int,
+	consume func(ctx context.Context, topic string, size int) ([]*ConsumerMessage, error)) ([]*ConsumerMessage, error) {
+	ms := make([]*ConsumerMessage, 0)
+	for i := 0; i < len(topics) && len(ms) < size; i++ {
+		batch, err := consume(ctx, topics[(turn+i)%len(topics)], size-len(ms))
+		if err != nil {
+			return ms, err
+		}
+		ms = append(ms, batch...)
+	}
+	return ms, nil
+}
+
+// CommitTopics ... Commits the receipts with commit once per topic they were consumed
+// from, receipts without a topic are committed with an empty topic
+func CommitTopics(ctx context.Context, recipts []*Receipt, commit func(ctx context.Context, topic string, recipts []*Receipt) error) error {
+	byTopic := make(map[string][]*Receipt)
+	topics := make([]string, 0)
+	for _, r := range recipts {
+		if _, ok := byTopic[r.Topic]; !ok {
+			topics = append(topics, r.Topic)
+		}
+		byTopic[r.Topic] = append(byTopic[r.Topic], r)
+	}
+	for _, topic := range topics {
+		if err := commit(ctx, topic, byTopic[topic]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package gq
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestConsumeTopics(t *testing.T) {
+	calls := make([]string, 0)
+	consume := func(ctx context.Context, topic string, size int) ([]*ConsumerMessage, error) {
+		calls = append(calls, fmt.Sprintf("%s:%d", topic, size))
+		m := &ConsumerMessage{}
+		m.Topic = topic
+		return []*ConsumerMessage{m}, nil
+	}
+	ms, err := ConsumeTopics(context.Background(), []string{"a", "b", "c"}, 1, 2, consume)
+	if err != nil || len(ms) != 2 {
+		t.Fatalf("Expected 2 messages got %d error %v", len(ms), err)
+	}
+	if fmt.Sprint(calls) != "[b:2 c:1]" {
+		t.Errorf("Expected to start at the turn and stop once full got %v", calls)
+	}
+}
+
+func TestCommitTopics(t *testing.T) {
+	committed := make([]string, 0)
+	commit := func(ctx context.Context, topic string, recipts []*Receipt) error {
+		committed = append(committed, fmt.Sprintf("%s:%d", topic, len(recipts)))
+		return nil
+	}
+	recipts := []*Receipt{&Receipt{Id: 1, Topic: "b"}, &Receipt{Id: 2}, &Receipt{Id: 3, Topic: "b"}}
+	if err := CommitTopics(context.Background(), recipts, commit); err != nil {
+		t.Fatalf("Failed to commit %s", err)
+	}
+	if fmt.Sprint(committed) != "[b:2 :1]" {
+		t.Errorf("Expected one commit per topic in order got %v", committed)
+	}
+}
@@ -1,15 +1,68 @@
 package gq
 
-import "time"
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrNotFound returned when a requested message does not exist
+var ErrNotFound = errors.New("gq: message not found")
 
 // Message minimal message definition
 type Message struct {
 	Payload []byte
+	// Optional key value pairs such as content type or trace id
+	Headers map[string]string
+	// Optional time before which the message is not delivered
+	NotBefore time.Time
+	// Optional key that makes publish idempotent, a message with a key already
+	// published within the queue dedup window is dropped
+	IdempotencyKey string
+	// Optional time a checked out message is held before it is delivered again,
+	// overrides the queue TTL for this message
+	TTL time.Duration
+	// Optional key for strict ordering, messages with the same key are delivered one
+	// at a time in publish order while different keys are delivered in parallel
+	OrderingKey string
+	// Optional priority, higher priority messages are delivered first
+	Priority int
+}
+
+// Clone ... Copy of the message with its own payload and headers, used by the queues
+// that keep messages in memory so callers can reuse their buffers
+func (m *Message) Clone() *Message {
+	c := *m
+	if m.Payload != nil {
+		c.Payload = append([]byte{}, m.Payload...)
+	}
+	if m.Headers != nil {
+		c.Headers = make(map[string]string, len(m.Headers))
+		for k, v := range m.Headers {
+			c.Headers[k] = v
+		}
+	}
+	return &c
+}
+
+// Metadata read only information the queue tracks about a message, it is
+// set by the queue on consume and ignored on publish
+type Metadata struct {
+	// When the message was published
+	Timestamp time.Time
+	// When the message was checked out by this delivery
+	Checkout time.Time
+	// Number of times the message has been delivered including this one
+	Attempts int
+	// Topic the message was consumed from, empty for the default queue
+	Topic string
 }
 
 // ConsumerMessage message for a consumer
 type ConsumerMessage struct {
 	Message
+	Metadata
 	Id int64
 }
 
@@ -17,6 +70,72 @@ type ConsumerMessage struct {
 type Receipt struct {
 	Id      int64
 	Success bool
+	// Reason the message failed, stored with the message when Success is false
+	Error string
+	// Topic the message was consumed from, empty for the default queue
+	Topic string
+}
+
+// DeadLetter message that was moved out of the queue after too many delivery attempts
+type DeadLetter struct {
+	ConsumerMessage
+	// Last error reported for the message
+	Error string
+	// When the message was dead lettered
+	DeadAt time.Time
+}
+
+// MessageState where a message is in its delivery life cycle
+type MessageState string
+
+const (
+	// StateAll any state
+	StateAll MessageState = ""
+	// StateReady can be checked out now
+	StateReady MessageState = "ready"
+	// StateInFlight checked out and still within its TTL or lease
+	StateInFlight MessageState = "in_flight"
+	// StateExpired checked out but the TTL passed so it will be delivered again
+	StateExpired MessageState = "expired"
+	// StateDelayed waiting for its not before time or retry backoff
+	StateDelayed MessageState = "delayed"
+)
+
+// ErrInvalidState returned for a MessageState that is not one of the constants
+var ErrInvalidState = errors.New("gq: invalid message state")
+
+// BrowseOptions which messages to look at and where to start
+type BrowseOptions struct {
+	// Only messages with an id greater than this, pass the last id seen to page
+	After int64
+	// Only messages published at or after this time when set
+	Since time.Time
+	// Only messages in this state, StateAll for every message
+	State MessageState
+	// Maximum number of messages, defaults to 100
+	Limit int
+}
+
+// Stats snapshot of the state of a queue
+type Stats struct {
+	// Messages that can be checked out now
+	Ready int64
+	// Messages checked out and still within their TTL or lease
+	InFlight int64
+	// Messages checked out whose TTL has passed so they will be delivered again
+	Expired int64
+	// Messages waiting for their not before time or retry backoff
+	Delayed int64
+	// Messages in the dead letter table
+	DeadLetters int64
+	// Messages in the queue, the only count set when Estimated
+	Total int64
+	// Time since the oldest ready message was published, how far behind the consumers are
+	OldestAge time.Duration
+	// Storage used by the queue in bytes
+	Bytes int64
+	// Total and DeadLetters are planner estimates rather than exact counts
+	Estimated bool
 }
 
 // MQ Implemented message queue interface
@@ -36,3 +155,77 @@ type MQ interface {
 	// Commit that a messages has been processed
 	Commit(recipts []*Receipt) error
 }
+
+// ContextMQ message queue interface where every call honors a context for
+// cancellation and deadlines
+type ContextMQ interface {
+	MQ
+	// Initialization
+	CreateContext(ctx context.Context) error
+	// Destruction
+	DestroyContext(ctx context.Context) error
+	// Simple send message
+	PublishContext(ctx context.Context, messages []*Message) error
+	// Request a batch of messages
+	ConsumeBatchContext(ctx context.Context, size int) ([]*ConsumerMessage, error)
+	// Way to consume a stream of messages, ends when the context is done or StopConsumer is called
+	StreamContext(ctx context.Context, size int, messages chan []*ConsumerMessage, pause time.Duration)
+	// Commit that a messages has been processed
+	CommitContext(ctx context.Context, recipts []*Receipt) error
+}
+
+// TxHandler processes messages inside the transaction they were checked out
+// in, it must not commit or roll back the transaction itself
+type TxHandler func(ctx context.Context, txn *sql.Tx, messages []*ConsumerMessage) error
+
+// TxMQ message queue that can publish and commit inside a transaction the
+// caller owns, the transaction must be on the same database as the queue
+type TxMQ interface {
+	// Publish as part of the transaction
+	PublishTx(ctx context.Context, txn *sql.Tx, messages []*Message) error
+	// Commit receipts as part of the transaction
+	CommitTx(ctx context.Context, txn *sql.Tx, recipts []*Receipt) error
+	// Handle messages in the transaction that checks them out and removes them
+	ConsumeTx(ctx context.Context, size int, handler TxHandler) (int, error)
+}
+
+// StatsQueue message queue that can report its depth
+type StatsQueue interface {
+	// Counts by state, estimate trades exact counts for cheaper queries where supported
+	Stats(ctx context.Context, estimate bool) (*Stats, error)
+}
+
+// Browser message queue that can list messages without checking them out
+type Browser interface {
+	// Messages ordered by id with their metadata, consumers are not affected
+	Browse(ctx context.Context, opts BrowseOptions) ([]*ConsumerMessage, error)
+}
+
+// Restorer message queue that can load messages keeping their publish time and
+// attempts, used to move messages between queues
+type Restorer interface {
+	// Publish messages with their Timestamp and Attempts, ids are assigned by the queue
+	Restore(ctx context.Context, messages []*ConsumerMessage) error
+}
+
+// AdminQueue operations for looking after a queue by hand
+type AdminQueue interface {
+	// Remove every message, dead letters are kept
+	Purge(ctx context.Context) error
+	// Make checked out messages available again, those checked out longer than
+	// olderThan or when it is 0 those past their TTL. Returns the number released.
+	ReleaseCheckouts(ctx context.Context, olderThan time.Duration) (int64, error)
+}
+
+// DeadLetterQueue operations on messages that exceeded the maximum delivery attempts
+type DeadLetterQueue interface {
+	// List dead letters with an id greater than after ordered by id
+	DeadLetters(ctx context.Context, after int64, limit int) ([]*DeadLetter, error)
+	// Inspect a single dead letter, ErrNotFound if it does not exist
+	DeadLetter(ctx context.Context, id int64) (*DeadLetter, error)
+	// Move dead letters back into the queue with the attempts reset. Returns the
+	// number moved, ids that are not dead letters are skipped.
+	RequeueDeadLetters(ctx context.Context, ids []int64) (int64, error)
+	// Remove all dead letters
+	PurgeDeadLetters(ctx context.Context) error
+}